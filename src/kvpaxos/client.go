@@ -1,53 +1,30 @@
 package kvpaxos
 
-import "net/rpc"
-import "fmt"
+import "context"
+import "transport"
 
 type Clerk struct {
   servers []string
+  transport transport.Transport
   // You will have to modify this struct.
 }
 
 
 func MakeClerk(servers []string) *Clerk {
+  return MakeClerkOn(transport.Unix, servers)
+}
+
+//
+// like MakeClerk(), but send RPCs through t.
+//
+func MakeClerkOn(t transport.Transport, servers []string) *Clerk {
   ck := new(Clerk)
   ck.servers = servers
+  ck.transport = t
   // You'll have to add code here.
   return ck
 }
 
-//
-// call() sends an RPC to the rpcname handler on server srv
-// with arguments args, waits for the reply, and leaves the
-// reply in reply. the reply argument should be a pointer
-// to a reply structure.
-//
-// the return value is true if the server responded, and false
-// if call() was not able to contact the server. in particular,
-// the reply's contents are only valid if call() returned true.
-//
-// you should assume that call() will time out and return an
-// error after a while if it doesn't get a reply from the server.
-//
-// please use call() to send all RPCs, in client.go and server.go.
-// please don't change this function.
-//
-func call(srv string, rpcname string,
-          args interface{}, reply interface{}) bool {
-  c, errx := rpc.Dial("unix", srv)
-  if errx != nil {
-    return false
-  }
-  defer c.Close()
-    
-  err := c.Call(rpcname, args, reply)
-  if err == nil {
-    return true
-  }
-
-  fmt.Println(err)
-  return false
-}
 
 //
 // fetch the current value for a key.
@@ -55,8 +32,18 @@ func call(srv string, rpcname string,
 // keeps trying forever in the face of all other errors.
 //
 func (ck *Clerk) Get(key string) string {
+  v, _ := ck.GetContext(context.Background(), key)
+  return v
+}
+
+//
+// like Get(), but stop trying once ctx is done, and
+// return a *transport.Error saying why; use
+// transport.CallContext() and transport.Sleep().
+//
+func (ck *Clerk) GetContext(ctx context.Context, key string) (string, error) {
   // You will have to modify this function.
-  return ""
+  return "", nil
 }
 
 //
@@ -64,8 +51,18 @@ func (ck *Clerk) Get(key string) string {
 // keeps trying until it succeeds.
 //
 func (ck *Clerk) PutExt(key string, value string, dohash bool) string {
+  v, _ := ck.PutExtContext(context.Background(), key, value, dohash)
+  return v
+}
+
+//
+// like PutExt(), but stop trying once ctx is done. the
+// Put may or may not have happened if an error is returned.
+//
+func (ck *Clerk) PutExtContext(ctx context.Context, key string, value string,
+                               dohash bool) (string, error) {
   // You will have to modify this function.
-  return ""
+  return "", nil
 }
 
 func (ck *Clerk) Put(key string, value string) {
@@ -75,3 +72,11 @@ func (ck *Clerk) PutHash(key string, value string) string {
   v := ck.PutExt(key, value, true)
   return v
 }
+
+func (ck *Clerk) PutContext(ctx context.Context, key string, value string) error {
+  _, err := ck.PutExtContext(ctx, key, value, false)
+  return err
+}
+func (ck *Clerk) PutHashContext(ctx context.Context, key string, value string) (string, error) {
+  return ck.PutExtContext(ctx, key, value, true)
+}
@@ -6,10 +6,9 @@ import "net/rpc"
 import "log"
 import "paxos"
 import "sync"
-import "os"
-import "syscall"
 import "encoding/gob"
 import "math/rand"
+import "transport"
 
 const Debug=0
 
@@ -66,6 +65,14 @@ func (kv *KVPaxos) kill() {
 // me is the index of the current server in servers[].
 // 
 func StartServer(servers []string, me int) *KVPaxos {
+  return StartServerOn(transport.Unix, servers, me)
+}
+
+//
+// like StartServer(), but listen, and reach
+// the other servers, through t.
+//
+func StartServerOn(t transport.Transport, servers []string, me int) *KVPaxos {
   // call gob.Register on structures you want
   // Go's RPC library to marshall/unmarshall.
   gob.Register(Op{})
@@ -78,10 +85,9 @@ func StartServer(servers []string, me int) *KVPaxos {
   rpcs := rpc.NewServer()
   rpcs.Register(kv)
 
-  kv.px = paxos.Make(servers, me, rpcs)
+  kv.px = paxos.MakeOn(t, servers, me, rpcs, "")
 
-  os.Remove(servers[me])
-  l, e := net.Listen("unix", servers[me]);
+  l, e := t.Listen(servers[me]);
   if e != nil {
     log.Fatal("listen error: ", e);
   }
@@ -100,9 +106,7 @@ func StartServer(servers []string, me int) *KVPaxos {
           conn.Close()
         } else if kv.unreliable && (rand.Int63() % 1000) < 200 {
           // process the request but force discard of reply.
-          c1 := conn.(*net.UnixConn)
-          f, _ := c1.File()
-          err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
+          err := transport.CloseWrite(conn)
           if err != nil {
             fmt.Printf("shutdown: %v\n", err)
           }
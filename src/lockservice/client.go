@@ -1,7 +1,7 @@
 package lockservice
 
-import "net/rpc"
-import "fmt"
+import "context"
+import "transport"
 
 //
 // the lockservice Clerk lives in the client
@@ -9,50 +9,27 @@ import "fmt"
 //
 type Clerk struct {
   servers [2]string // primary port, backup port
+  transport transport.Transport
   // Your definitions here.
 }
 
 
 func MakeClerk(primary string, backup string) *Clerk {
+  return MakeClerkOn(transport.Unix, primary, backup)
+}
+
+//
+// like MakeClerk(), but send RPCs through t.
+//
+func MakeClerkOn(t transport.Transport, primary string, backup string) *Clerk {
   ck := new(Clerk)
   ck.servers[0] = primary
   ck.servers[1] = backup
+  ck.transport = t
   // Your initialization code here.
   return ck
 }
 
-//
-// call() sends an RPC to the rpcname handler on server srv
-// with arguments args, waits for the reply, and leaves the
-// reply in reply. the reply argument should be the address
-// of a reply structure.
-//
-// call() returns true if the server responded, and false
-// if call() was not able to contact the server. in particular,
-// reply's contents are valid if and only if call() returned true.
-//
-// you should assume that call() will time out and return an
-// error after a while if it doesn't get a reply from the server.
-//
-// please use call() to send all RPCs, in client.go and server.go.
-// please don't change this function.
-//
-func call(srv string, rpcname string,
-          args interface{}, reply interface{}) bool {
-  c, errx := rpc.Dial("unix", srv)
-  if errx != nil {
-    return false
-  }
-  defer c.Close()
-    
-  err := c.Call(rpcname, args, reply)
-  if err == nil {
-    return true
-  }
-
-  fmt.Println(err)
-  return false
-}
 
 //
 // ask the lock service for a lock.
@@ -62,18 +39,33 @@ func call(srv string, rpcname string,
 // you will have to modify this function.
 //
 func (ck *Clerk) Lock(lockname string) bool {
+  ok, _ := ck.LockContext(context.Background(), lockname)
+  return ok
+}
+
+//
+// like Lock(), but give up once ctx is done, and return
+// a *transport.Error saying why. a primary that never
+// replies can otherwise hold Lock() up forever. a failed
+// RPC is a *transport.Error wrapping ErrNoReply, so that
+// it can't be mistaken for a lock that is held.
+//
+func (ck *Clerk) LockContext(ctx context.Context, lockname string) (bool, error) {
   // prepare the arguments.
   args := &LockArgs{}
   args.Lockname = lockname
   var reply LockReply
   
   // send an RPC request, wait for the reply.
-  ok := call(ck.servers[0], "LockServer.Lock", args, &reply)
+  ok := transport.CallContext(ctx, ck.transport, ck.servers[0], "LockServer.Lock", args, &reply)
   if ok == false {
-    return false
+    if ctx.Err() != nil {
+      return false, transport.Abandoned("lockservice.Lock", ctx)
+    }
+    return false, &transport.Error{Op: "lockservice.Lock", Err: transport.ErrNoReply}
   }
   
-  return reply.OK
+  return reply.OK, nil
 }
 
 
@@ -84,8 +76,16 @@ func (ck *Clerk) Lock(lockname string) bool {
 //
 
 func (ck *Clerk) Unlock(lockname string) bool {
+  ok, _ := ck.UnlockContext(context.Background(), lockname)
+  return ok
+}
+
+//
+// like Unlock(), but give up once ctx is done.
+//
+func (ck *Clerk) UnlockContext(ctx context.Context, lockname string) (bool, error) {
 
   // Your code here.
 
-  return false
+  return false, nil
 }
@@ -5,9 +5,9 @@ import "net/rpc"
 import "log"
 import "sync"
 import "fmt"
-import "os"
 import "io"
 import "time"
+import "transport"
 
 type LockServer struct {
   mu sync.Mutex
@@ -17,6 +17,7 @@ type LockServer struct {
 
   am_primary bool // am I the primary?
   backup string   // backup's port
+  transport transport.Transport // for RPCs to the backup
 
   // for each lock name, is it locked?
   locks map[string]bool
@@ -86,7 +87,17 @@ func (dc DeafConn) Read(p []byte) (n int, err error) {
 }
 
 func StartServer(primary string, backup string, am_primary bool) *LockServer {
+  return StartServerOn(transport.Unix, primary, backup, am_primary)
+}
+
+//
+// like StartServer(), but listen, and reach the
+// backup, through t.
+//
+func StartServerOn(t transport.Transport, primary string, backup string,
+                   am_primary bool) *LockServer {
   ls := new(LockServer)
+  ls.transport = t
   ls.backup = backup
   ls.am_primary = am_primary
   ls.locks = map[string]bool{}
@@ -106,9 +117,7 @@ func StartServer(primary string, backup string, am_primary bool) *LockServer {
   rpcs.Register(ls)
 
   // prepare to receive connections from clients.
-  // change "unix" to "tcp" to use over a network.
-  os.Remove(me) // only needed for "unix"
-  l, e := net.Listen("unix", me);
+  l, e := t.Listen(me);
   if e != nil {
     log.Fatal("listen error: ", e);
   }
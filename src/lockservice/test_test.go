@@ -5,6 +5,9 @@ import "runtime"
 import "math/rand"
 import "os"
 import "strconv"
+import "context"
+import "errors"
+import "transport"
 import "time"
 import "fmt"
 
@@ -476,3 +479,18 @@ func TestConcurrentCounts(t *testing.T) {
   b.kill()
   fmt.Printf("  ... Passed\n")
 }
+
+func TestNoReply(t *testing.T) {
+  fmt.Printf("Test: Lock() without a server fails with ErrNoReply ...\n")
+
+  ck := MakeClerk(port("noreply-p"), port("noreply-b"))
+  ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+  defer cancel()
+  ok, err := ck.LockContext(ctx, "a")
+  e, isErr := err.(*transport.Error)
+  if ok || !isErr || !errors.Is(e, transport.ErrNoReply) {
+    t.Fatalf("LockContext() returned %v, %v; expected ErrNoReply", ok, err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,57 @@
+package main
+
+import "os"
+import "fmt"
+import "strings"
+import "mapreduce"
+import "transport"
+
+// Runs any job whose Funcs are registered (see mapreduce/registry.go),
+// such as the built-in wc, index and grep. The index job indexes
+// whole files; the others read their input a line at a time. grep's
+// pattern follows an "=". The output goes to mrtmp.<funcs>.
+//
+// Can be run in 3 ways:
+// 1) Sequential (e.g., go run mr.go sequential wc x.txt y.txt)
+// 2) Master (e.g., go run mr.go master grep=^foo localhost:7777 x.txt)
+// 3) Worker (e.g., go run mr.go worker localhost:7777 localhost:7778 &)
+// A worker can keep its map outputs in a directory of its own
+// (e.g., go run mr.go worker localhost:7777 localhost:7778 /tmp/w1 &)
+func main() {
+	switch {
+	case len(os.Args) >= 4 && os.Args[1] == "sequential":
+		mr := mapreduce.RunSingleJob(job(os.Args[2], os.Args[3:]))
+		fmt.Print(mr.Counters)
+	case len(os.Args) >= 5 && os.Args[1] == "master":
+		mr := mapreduce.MakeMapReduceJob(job(os.Args[2], os.Args[4:]),
+			os.Args[3])
+		// Wait until MR is done
+		<-mr.DoneChannel
+		fmt.Print(mr.Counters)
+	case (len(os.Args) == 4 || len(os.Args) == 5) && os.Args[1] == "worker":
+		wk := mapreduce.MakeRegistryWorker()
+		if len(os.Args) == 5 {
+			wk.Dir = os.Args[4]
+		}
+		wk.Run(transport.Unix, os.Args[2], os.Args[3], -1)
+	default:
+		fmt.Printf("%s: see usage comments in file\n", os.Args[0])
+	}
+}
+
+// The job for funcs, "name" or "name=arg", over files.
+func job(funcs string, files []string) *mapreduce.Job {
+	name, arg, _ := strings.Cut(funcs, "=")
+	job := &mapreduce.Job{
+		Name:     name,
+		Input:    mapreduce.TextInput{Files: files},
+		NMap:     5,
+		NReduce:  3,
+		Funcs:    name,
+		FuncsArg: arg,
+	}
+	if name == "index" {
+		job.Input = mapreduce.FileInput{Files: files}
+	}
+	return job
+}
@@ -0,0 +1,76 @@
+package main
+
+//
+// print what each peer of a paxos group believes.
+//
+// export GOPATH=~/6.824
+// go build pxinspect.go
+// ./pxinspect /var/tmp/824-501/kv-1234-basic-0 /var/tmp/824-501/kv-1234-basic-1 ...
+// ./pxinspect -r 10 20 port1 port2 ...
+// ./pxinspect -tcp host1:port host2:port ...
+//
+// the ports are those of the paxos peers, or of any server
+// (kvpaxos, shardmaster, shardkv) that registers its paxos
+// peer on its own RPC server. -r limits the instances shown;
+// by default every instance a peer still has state for.
+// -tcp is for groups started with transport.TCP.
+//
+
+import "paxos"
+import "os"
+import "fmt"
+import "strconv"
+import "transport"
+
+func usage() {
+  fmt.Printf("Usage: pxinspect [-tcp] [-r from to] port...\n")
+  os.Exit(1)
+}
+
+func main() {
+  args := os.Args[1:]
+  t := transport.Unix
+  if len(args) > 0 && args[0] == "-tcp" {
+    t = transport.TCP
+    args = args[1:]
+  }
+  from := 0
+  to := int(^uint(0) >> 1)
+  if len(args) > 0 && args[0] == "-r" {
+    if len(args) < 3 {
+      usage()
+    }
+    var e1, e2 error
+    from, e1 = strconv.Atoi(args[1])
+    to, e2 = strconv.Atoi(args[2])
+    if e1 != nil || e2 != nil {
+      usage()
+    }
+    args = args[3:]
+  }
+  if len(args) == 0 {
+    usage()
+  }
+
+  for _, srv := range args {
+    st, ok := paxos.InspectPeerOn(t, srv, from, to)
+    if !ok {
+      fmt.Printf("%v: no reply\n\n", srv)
+      continue
+    }
+    fmt.Printf("%v: peer %v min %v max %v leader %v\n",
+      srv, st.Me, st.Min, st.Max, st.Leader)
+    for i, d := range st.Dones {
+      fmt.Printf("  done[%v] = %v  (%v)\n", i, d, st.Peers[i])
+    }
+    for _, inst := range st.Instances {
+      state := "open"
+      if inst.Decided {
+        state = "decided"
+      }
+      fmt.Printf("  seq %v: %v np=%v na=%v va=%v\n",
+        inst.Seq, state, inst.Np, inst.Na, inst.Text)
+    }
+    fmt.Printf("\n")
+  }
+}
@@ -3,57 +3,40 @@ package main
 import "os"
 import "fmt"
 import "mapreduce"
-import "container/list"
-import "strings"
-import "unicode"
-import "strconv"
-
-// our simplified version of MapReduce does not supply a
-// key to the Map function, as in the paper; only a value,
-// which is a part of the input file contents
-func Map(value string) *list.List {
-	res := list.New()
-	count := make(map[string]int)
-
-	words := strings.FieldsFunc(value, func(c rune) bool {
-		return !unicode.IsLetter(c) && !unicode.IsNumber(c)
-	})
-
-	for _, word := range words {
-		count[word]++
-	}
-	for k, v := range count {
-		res.PushBack(mapreduce.KeyValue{k, strconv.Itoa(v)})
-	}
-	return res
-}
-
-// iterate over list and add values
-func Reduce(key string, values *list.List) string {
-	total := 0
-	for iter := values.Front(); iter != nil; iter = iter.Next() {
-		num, _ := strconv.Atoi(iter.Value.(string))
-		total += num
-	}
-	return strconv.Itoa(total)
-}
+import "transport"
 
 // Can be run in 3 ways:
 // 1) Sequential (e.g., go run wc.go master x.txt sequential)
 // 2) Master (e.g., go run wc.go master x.txt localhost:7777)
 // 3) Worker (e.g., go run wc.go worker localhost:7777 localhost:7778 &)
+// A worker can keep its map outputs in a directory of its own
+// (e.g., go run wc.go worker localhost:7777 localhost:7778 /tmp/w1 &)
+// The word count is the mapreduce package's built-in "wc" Funcs.
 func main() {
-	if len(os.Args) != 4 {
+	if len(os.Args) != 4 && !(len(os.Args) == 5 && os.Args[1] == "worker") {
 		fmt.Printf("%s: see usage comments in file\n", os.Args[0])
 	} else if os.Args[1] == "master" {
+		job := &mapreduce.Job{
+			Name:    os.Args[2],
+			Input:   mapreduce.TextInput{Files: []string{os.Args[2]}},
+			NMap:    5,
+			NReduce: 3,
+			Funcs:   "wc",
+		}
+		var mr *mapreduce.MapReduce
 		if os.Args[3] == "sequential" {
-			mapreduce.RunSingle(5, 3, os.Args[2], Map, Reduce)
+			mr = mapreduce.RunSingleJob(job)
 		} else {
-			mr := mapreduce.MakeMapReduce(5, 3, os.Args[2], os.Args[3])
+			mr = mapreduce.MakeMapReduceJob(job, os.Args[3])
 			// Wait until MR is done
 			<-mr.DoneChannel
 		}
+		fmt.Print(mr.Counters)
 	} else {
-		mapreduce.RunWorker(os.Args[2], os.Args[3], Map, Reduce, 100)
+		wk := mapreduce.MakeRegistryWorker()
+		if len(os.Args) == 5 {
+			wk.Dir = os.Args[4]
+		}
+		wk.Run(transport.Unix, os.Args[2], os.Args[3], -1)
 	}
 }
@@ -0,0 +1,98 @@
+package mapreduce
+
+import "sort"
+import "regexp"
+import "strconv"
+import "strings"
+import "unicode"
+import "container/list"
+
+// The Funcs every worker has (see registry.go):
+//
+//   wc     -- word count: each word of each record's value, and how
+//             many times it occurs in the input.
+//   index  -- an inverted index: each word, how many records have it,
+//             and their keys, in order; with FileInput, the files.
+//   grep   -- the records whose values match the job's FuncsArg, a
+//             regular expression: each matching value, with the keys
+//             of the records it is in.
+
+func init() {
+	RegisterFuncs("wc", Funcs{Map: wcMap, Reduce: wcReduce, Combine: wcReduce})
+	RegisterFuncs("index", Funcs{Map: indexMap, Reduce: indexReduce})
+	RegisterFuncsWith("grep", grepFuncs)
+}
+
+func words(s string) []string {
+	return strings.FieldsFunc(s, func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsNumber(c)
+	})
+}
+
+func wcMap(key string, value string) *list.List {
+	count := make(map[string]int)
+	for _, w := range words(value) {
+		count[w]++
+	}
+	res := list.New()
+	for w, n := range count {
+		res.PushBack(KeyValue{w, strconv.Itoa(n)})
+	}
+	return res
+}
+
+func wcReduce(key string, values *list.List) string {
+	total := 0
+	for e := values.Front(); e != nil; e = e.Next() {
+		n, _ := strconv.Atoi(e.Value.(string))
+		total += n
+	}
+	return strconv.Itoa(total)
+}
+
+func indexMap(key string, value string) *list.List {
+	seen := make(map[string]bool)
+	res := list.New()
+	for _, w := range words(value) {
+		if !seen[w] {
+			seen[w] = true
+			res.PushBack(KeyValue{w, key})
+		}
+	}
+	return res
+}
+
+// "2 a,b" for a word in records a and b.
+func indexReduce(key string, values *list.List) string {
+	var keys []string
+	for e := values.Front(); e != nil; e = e.Next() {
+		keys = append(keys, e.Value.(string))
+	}
+	sort.Strings(keys)
+	return strconv.Itoa(len(keys)) + " " + strings.Join(keys, ",")
+}
+
+func grepFuncs(pattern string) (Funcs, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return Funcs{}, err
+	}
+	Map := func(key string, value string) *list.List {
+		res := list.New()
+		if re.MatchString(value) {
+			res.PushBack(KeyValue{value, key})
+		}
+		return res
+	}
+	return Funcs{Map: Map, Reduce: grepReduce}, nil
+}
+
+// The keys of the records with the value, in order.
+func grepReduce(key string, values *list.List) string {
+	var keys []string
+	for e := values.Front(); e != nil; e = e.Next() {
+		keys = append(keys, e.Value.(string))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
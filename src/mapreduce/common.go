@@ -1,8 +1,5 @@
 package mapreduce
 
-import "fmt"
-import "net/rpc"
-
 const (
   Map = "Map"
   Reduce = "Reduce"
@@ -18,10 +15,59 @@ type DoJobArgs struct {
   Operation JobType
   JobNumber int       // this job's number
   NumOtherPhase int   // total number of jobs in other phase (map or reduce)
+  Split Split         // a map job's input
+  Partition Partitioner // how a map job partitions its output; nil to hash
+  Encoding Encoding     // of the files the job writes
+  Funcs string          // which of a service worker's, or the registered, Funcs to use
+  FuncsArg string       // for Funcs that take an argument
+  Locations []string    // for a reduce job, the worker holding each map
+                        // job's output, or "" if it's in the shared directory
 }
 
 type DoJobReply struct {
   OK bool
+  Missing []int // map jobs whose output a reduce job found missing or corrupt
+  Counters Counters // what the job did
+  Err string        // why the job can't be done, by any worker
+  Host string       // the worker holding a map job's output, if it
+                    // isn't in the shared directory
+  Draining bool     // the worker is draining, and didn't run the job
+}
+
+// A worker's Fetch RPC, which serves the map outputs in its local
+// directory to the workers running reduce jobs.
+
+type FetchArgs struct {
+  Name string   // the ReduceName() of the file
+  Offset int64
+}
+
+type FetchReply struct {
+  OK bool     // false if the worker doesn't have the file
+  Data []byte // at most FetchChunk bytes, from Offset
+  EOF bool    // there's nothing more after Data
+}
+
+// Once the job is done, the master tells each worker holding map
+// outputs to remove them.
+
+type RemoveOutputsArgs struct {
+  File string
+  Maps []int    // the map jobs whose outputs to remove
+  NReduce int
+}
+
+type RemoveOutputsReply struct {
+}
+
+// Ask a worker to finish the jobs it's running, and leave.
+
+type DrainArgs struct {
+}
+
+type DrainReply struct {
+  OK bool
+  Njobs int // RPCs it handled, as for Shutdown
 }
 
 type ShutdownArgs struct {
@@ -32,43 +78,61 @@ type ShutdownReply struct {
   OK bool
 }
 
+// A worker can run Slots tasks at once (one if Slots is 0), and
+// has the Labels, which a Job can ask for (e.g. "gpu" or "ssd").
 type RegisterArgs struct {
   Worker string
+  Slots int
+  Labels []string
 }
 
 type RegisterReply struct {
   OK bool
 }
 
-//
-// call() sends an RPC to the rpcname handler on server srv
-// with arguments args, waits for the reply, and leaves the
-// reply in reply. the reply argument should be the address
-// of a reply structure.
-//
-// call() returns true if the server responded, and false
-// if call() was not able to contact the server. in particular,
-// reply's contents are valid if and only if call() returned true.
-//
-// you should assume that call() will time out and return an
-// error after a while if it doesn't get a reply from the server.
-//
-// please use call() to send all RPCs, in master.go, mapreduce.go,
-// and worker.go.  please don't change this function.
-//
-func call(srv string, rpcname string,
-          args interface{}, reply interface{}) bool {
-  c, errx := rpc.Dial("unix", srv)
-  if errx != nil {
-    return false
-  }
-  defer c.Close()
-
-  err := c.Call(rpcname, args, reply)
-  if err == nil {
-    return true
-  }
-
-  fmt.Println(err)
-  return false
+type HeartbeatArgs struct {
+  Worker string
+  Running int // jobs in progress
+  Draining bool // finishing its jobs, to leave; send it no more
+}
+
+type HeartbeatReply struct {
+  OK bool // false if the master doesn't know this worker; it registers again
+}
+
+
+// A Service's RPCs (see service.go).
+
+type SubmitJobArgs struct {
+  Name string           // output goes to "mrtmp." + Name
+  Input InputFormat
+  NMap int
+  NReduce int
+  Funcs string          // the name of the job's Funcs
+  FuncsArg string       // for Funcs that take an argument
+  Partition Partitioner // nil to hash
+  Encoding Encoding
+  Labels []string       // that workers must have to run the job's tasks
+}
+
+type SubmitJobReply struct {
+  OK bool
+  Err string // why the job wasn't accepted
+  ID int
+}
+
+type JobStatusArgs struct {
+  ID int
+}
+
+type JobStatusReply struct {
+  OK bool // false if there's no such job
+  Name string
+  State JobState
+  Err string // why the job failed
+  NMap int
+  MapsDone int
+  NReduce int
+  ReducesDone int
+  Counters Counters // once the job is Done
 }
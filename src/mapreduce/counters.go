@@ -0,0 +1,82 @@
+package mapreduce
+
+import "fmt"
+import "sort"
+import "strings"
+import "container/list"
+
+// Counters of what a job did. Each task counts into its own
+// Counters, which a worker returns in DoJobReply; the master adds up
+// those of the attempts that completed each task, so a task that is
+// re-executed, or has a backup attempt, is only counted once. The
+// job's totals are in MapReduce.Counters once it is done.
+//
+// The built-in counters are named below. A job can add its own: Map
+// may push a Counter onto the list it returns, among the KeyValues,
+// to add N to the counter called Name.
+
+type Counters map[string]int64
+
+const (
+	MapInputRecords      = "map.input.records"
+	MapInputBytes        = "map.input.bytes" // of the records' values
+	MapOutputRecords     = "map.output.records"
+	CombineInputRecords  = "combine.input.records"
+	CombineOutputRecords = "combine.output.records"
+	PartitionRecords     = "partition.records" // written by map tasks
+	ReduceInputGroups    = "reduce.input.groups"
+	ReduceInputRecords   = "reduce.input.records"
+	ReduceOutputRecords  = "reduce.output.records"
+	ReduceOutputBytes    = "reduce.output.bytes"
+	MapMillis            = "map.millis" // time spent in map tasks
+	ReduceMillis         = "reduce.millis"
+)
+
+// The bytes map tasks wrote for reduce partition r.
+func PartitionBytes(r int) string {
+	return fmt.Sprintf("partition.%d.bytes", r)
+}
+
+// Add N to the counter Name.
+type Counter struct {
+	Name string
+	N    int64
+}
+
+func (c Counters) Add(name string, n int64) {
+	c[name] += n
+}
+
+// Add all of o's counters to c's.
+func (c Counters) Merge(o Counters) {
+	for name, n := range o {
+		c[name] += n
+	}
+}
+
+// One "name: value" line per counter, in name order.
+func (c Counters) String() string {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s: %d\n", name, c[name])
+	}
+	return b.String()
+}
+
+// A Reducer that calls f, and counts the values it is called with
+// as in, and the calls as out. nil if f is.
+func counted(f Reducer, c Counters, in string, out string) Reducer {
+	if f == nil {
+		return nil
+	}
+	return func(key string, values *list.List) string {
+		c.Add(in, int64(values.Len()))
+		c.Add(out, 1)
+		return f(key, values)
+	}
+}
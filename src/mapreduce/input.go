@@ -0,0 +1,285 @@
+package mapreduce
+
+import "os"
+import "io"
+import "fmt"
+import "sort"
+import "sync"
+import "bufio"
+import "strings"
+import "strconv"
+import "path/filepath"
+import "encoding/json"
+import "encoding/gob"
+
+// Input formats for the key/value job API (see Job).
+//
+// An InputFormat cuts a job's input into splits, one per map task,
+// and reads the (key, value) records of a split, each of which is
+// handed to a separate call of the job's Map function. The master
+// makes the splits and the workers read them; a worker finds the
+// InputFormat to read a Split with by the name in Split.Format, so a
+// custom InputFormat must be registered with RegisterInputFormat()
+// in the worker's binary as well as the master's. (Jobs submitted to
+// a Service send their InputFormat along with gob, which registering
+// it also arranges for.)
+//
+// The built-in formats are:
+//
+//   TextInput  -- one record per line: the key is the line's byte
+//                 offset in its file, the value is the line itself.
+//   FileInput  -- one record per file: the key is the file's name,
+//                 the value is its contents. DirInput() lists a
+//                 directory of many inputs.
+//   JSONInput  -- one record per line, each a JSON object with Key
+//                 and Value fields, as KeyValue marshals to.
+//   KVInput    -- the KeyValue records of files in the format DoReduce
+//                 writes (see kvfile.go), such as another job's
+//                 MergeName() files; a Pipeline's stages read the
+//                 stage before's output with it.
+
+type InputFormat interface {
+	// Cut the input into about n splits.
+	Splits(n int) ([]Split, error)
+	// Call emit for each record in s.
+	Read(s Split, emit func(key string, value string)) error
+}
+
+// The input of one map task. Formats that cut files by byte range
+// use Start and End; the others use just Files.
+type Split struct {
+	Format string // the name the InputFormat is registered under
+	Files  []string
+	Start  int64
+	End    int64
+}
+
+var formats = struct {
+	sync.Mutex
+	m map[string]InputFormat
+}{m: map[string]InputFormat{
+	"text": TextInput{},
+	"file": FileInput{},
+	"json": JSONInput{},
+	"kv":   KVInput{},
+}}
+
+func init() {
+	for _, f := range formats.m {
+		gob.Register(f)
+	}
+}
+
+// Make f available, under name, to workers reading splits.
+func RegisterInputFormat(name string, f InputFormat) {
+	formats.Lock()
+	defer formats.Unlock()
+	formats.m[name] = f
+	gob.Register(f)
+}
+
+// Call emit for each record of split s.
+func readSplit(s Split, emit func(key string, value string)) error {
+	formats.Lock()
+	f, ok := formats.m[s.Format]
+	formats.Unlock()
+	if !ok {
+		return fmt.Errorf("mapreduce: unknown input format %q", s.Format)
+	}
+	return f.Read(s, emit)
+}
+
+// Lines of text.
+type TextInput struct {
+	Files []string
+}
+
+func (in TextInput) Splits(n int) ([]Split, error) {
+	return byteRanges("text", in.Files, n)
+}
+
+func (TextInput) Read(s Split, emit func(key string, value string)) error {
+	return readLines(s, func(off int64, line string) error {
+		emit(strconv.FormatInt(off, 10), line)
+		return nil
+	})
+}
+
+// Whole files.
+type FileInput struct {
+	Files []string
+}
+
+// The regular files in dir, in name order.
+func DirInput(dir string) (FileInput, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return FileInput{}, err
+	}
+	var in FileInput
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			in.Files = append(in.Files, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(in.Files)
+	return in, nil
+}
+
+func (in FileInput) Splits(n int) ([]Split, error) {
+	return dealFiles("file", in.Files, n), nil
+}
+
+func (FileInput) Read(s Split, emit func(key string, value string)) error {
+	for _, name := range s.Files {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		emit(name, string(b))
+	}
+	return nil
+}
+
+// KeyValues, as JSON, one per line.
+type JSONInput struct {
+	Files []string
+}
+
+func (in JSONInput) Splits(n int) ([]Split, error) {
+	return byteRanges("json", in.Files, n)
+}
+
+func (JSONInput) Read(s Split, emit func(key string, value string)) error {
+	return readLines(s, func(off int64, line string) error {
+		if strings.TrimSpace(line) == "" {
+			return nil
+		}
+		var kv KeyValue
+		if err := json.Unmarshal([]byte(line), &kv); err != nil {
+			return fmt.Errorf("%s: offset %d: %v", s.Files[0], off, err)
+		}
+		emit(kv.Key, kv.Value)
+		return nil
+	})
+}
+
+// KeyValue files, which can't be cut, so there are no more
+// splits than files.
+type KVInput struct {
+	Files []string
+}
+
+func (in KVInput) Splits(n int) ([]Split, error) {
+	return dealFiles("kv", in.Files, n), nil
+}
+
+func (KVInput) Read(s Split, emit func(key string, value string)) error {
+	for _, name := range s.Files {
+		r, err := openKV(name)
+		if err != nil {
+			return err
+		}
+		for kv, ok := r.Next(); ok; kv, ok = r.Next() {
+			emit(kv.Key, kv.Value)
+		}
+		err = r.Err()
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deal files out into at most n splits of consecutive files.
+func dealFiles(format string, files []string, n int) []Split {
+	if n > len(files) {
+		n = len(files)
+	}
+	splits := make([]Split, n)
+	for i := range splits {
+		lo := i * len(files) / n
+		hi := (i + 1) * len(files) / n
+		splits[i] = Split{Format: format, Files: files[lo:hi]}
+	}
+	return splits
+}
+
+// Cut files into byte ranges of about 1/n of their total size.
+// A range never spans two files, so there can be a few more than n.
+func byteRanges(format string, files []string, n int) ([]Split, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("%d splits asked for", n)
+	}
+	var total int64
+	sizes := make([]int64, len(files))
+	for i, name := range files {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = fi.Size()
+		total += fi.Size()
+	}
+	chunk := total/int64(n) + 1
+
+	var splits []Split
+	for i, name := range files {
+		for off := int64(0); off < sizes[i]; off += chunk {
+			end := off + chunk
+			if end > sizes[i] {
+				end = sizes[i]
+			}
+			splits = append(splits, Split{format, []string{name}, off, end})
+		}
+	}
+	return splits, nil
+}
+
+// Call fn for each line that starts in s's byte range, with the
+// line's offset and without its newline. A range that starts in
+// the middle of a line leaves that line to the range before it.
+func readLines(s Split, fn func(off int64, line string) error) error {
+	file, err := os.Open(s.Files[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	pos := s.Start
+	if pos > 0 {
+		// back up a byte, so that a line starting
+		// exactly at Start isn't skipped.
+		pos--
+	}
+	if _, err := file.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(file)
+	if s.Start > 0 {
+		skipped, err := r.ReadString('\n')
+		pos += int64(len(skipped))
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	for pos < s.End {
+		line, err := r.ReadString('\n')
+		if len(line) > 0 {
+			if err := fn(pos, strings.TrimSuffix(line, "\n")); err != nil {
+				return err
+			}
+			pos += int64(len(line))
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package mapreduce
+
+import "os"
+import "fmt"
+import "io"
+import "bufio"
+import "bytes"
+import "reflect"
+import "encoding/json"
+import "sync"
+
+// The job journal, so that a master that dies doesn't lose its job.
+//
+// Run() records each task's state, and which worker each attempt is
+// on, in JournalName(file) as the job goes: in-progress when an
+// attempt starts, completed (with the task's counters) when one
+// succeeds, and idle when there's no attempt in flight any more and
+// the task isn't done, or when a completed map task's output is lost.
+// The first entry describes the job: its file, master address, tasks
+// and splits.
+//
+// A master started for the same job, with the same MasterAddress,
+// picks up where the journal left off: tasks that were completed,
+// and whose committed output files are all still there, aren't run
+// again, and their counters count towards the job's. Everything else
+// is run as usual. The workers of the master that died find the new
+// one by heartbeating, and register again. Once the job is done, its
+// journal is removed.
+//
+// Each entry is one line of JSON, synced to disk before the master
+// goes on; a partial last line, from a master that died while
+// writing it, is ignored, and cut off before the next entry is
+// appended.
+
+type TaskState string
+
+const (
+	TaskIdle       TaskState = "idle"
+	TaskInProgress TaskState = "in-progress"
+	TaskCompleted  TaskState = "completed"
+)
+
+func JournalName(fileName string) string {
+	return "mrtmp." + fileName + ".journal"
+}
+
+// A line of the journal: the job, or a task's new state.
+type journalEntry struct {
+	Job      *journalJob `json:",omitempty"` // only in the first entry
+	Op       JobType     `json:",omitempty"`
+	Task     int
+	State    TaskState `json:",omitempty"`
+	Worker   string    `json:",omitempty"` // running or completed the task
+	Host     string    `json:",omitempty"` // has a map task's output, if not shared
+	Counters Counters  `json:",omitempty"` // of a completed task
+}
+
+// What a journal must say about its job for a master to resume it.
+type journalJob struct {
+	File      string
+	Master    string
+	NMap      int
+	NReduce   int
+	Splits    []Split
+	Partition string // as printed by %#v
+	Encoding  Encoding
+}
+
+type journal struct {
+	mu   sync.Mutex
+	name string
+	file *os.File
+	last map[JobType]map[int]journalEntry // each task's state when opened
+}
+
+// What mr's journal should say about the job,
+// once makeSplits() has been called.
+func (mr *MapReduce) journalJob() *journalJob {
+	return &journalJob{File: mr.file, Master: mr.MasterAddress,
+		NMap: mr.nMap, NReduce: mr.nReduce, Splits: mr.splits,
+		Partition: fmt.Sprintf("%#v", mr.partition), Encoding: mr.encoding}
+}
+
+// Open the journal called name, for job. If it is a journal of the
+// same job, keep it, to resume from; if not, or it doesn't exist,
+// start a new one.
+func openJournal(name string, job *journalJob) (*journal, error) {
+	j := &journal{name: name}
+	j.last = map[JobType]map[int]journalEntry{Map: {}, Reduce: {}}
+	old, entries, good, err := readJournal(name)
+	if err == nil && reflect.DeepEqual(old, job) {
+		for _, e := range entries {
+			j.last[e.Op][e.Task] = e
+		}
+		j.file, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, err
+		}
+		if err := j.file.Truncate(good); err != nil {
+			j.file.Close()
+			return nil, err
+		}
+		return j, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Journal: starting over: %v\n", err)
+	}
+	j.file, err = os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := j.write(journalEntry{Job: job}); err != nil {
+		j.file.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// The job and task entries of the journal called name, and the
+// length of its complete lines.
+func readJournal(name string) (*journalJob, []journalEntry, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var job *journalJob
+	var entries []journalEntry
+	var good int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break // nothing, or a partial entry
+		}
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		var e journalEntry
+		if err := json.Unmarshal(bytes.TrimSpace(line), &e); err != nil {
+			return nil, nil, 0, &CorruptError{name, err.Error()}
+		}
+		switch {
+		case job == nil && e.Job == nil:
+			return nil, nil, 0, &CorruptError{name, "doesn't start with the job"}
+		case job == nil:
+			job = e.Job
+		case e.Op != Map && e.Op != Reduce:
+			return nil, nil, 0, &CorruptError{name, fmt.Sprintf("bad entry %s", line)}
+		default:
+			entries = append(entries, e)
+		}
+		good += int64(len(line))
+	}
+	if job == nil {
+		return nil, nil, 0, &CorruptError{name, "empty"}
+	}
+	return job, entries, good, nil
+}
+
+// Append e to the journal, and sync it to disk.
+func (j *journal) write(e journalEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Record a task's new state. A journal that can't be written is
+// only a warning: the job can still finish, it just can't be
+// resumed. j may be nil, for a job without a journal.
+func (j *journal) record(e journalEntry) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.write(e); err != nil {
+		fmt.Printf("Journal: %v\n", err)
+	}
+}
+
+// Close and remove the journal, once the job is done.
+func (j *journal) Remove() {
+	if j == nil {
+		return
+	}
+	j.file.Close()
+	os.Remove(j.name)
+}
+
+// Mark the tasks the journal says were completed done, if their
+// outputs are still there. Map outputs in a worker's local directory
+// are assumed to be: if they aren't, the reduce tasks will find out.
+// Called with mr.mu held, before the phases start.
+func (mr *MapReduce) resume() {
+	j := mr.journal
+	if j == nil {
+		return
+	}
+	for _, p := range []*phase{mr.maps, mr.reduces} {
+		for i, e := range j.last[p.op] {
+			if e.State != TaskCompleted || i >= len(p.done) ||
+				(e.Host == "" && !mr.committed(p.op, i)) {
+				continue
+			}
+			p.done[i] = true
+			p.ndone++
+			p.hosts[i] = e.Host
+			p.replies[i] = DoJobReply{OK: true, Counters: e.Counters}
+		}
+	}
+	if mr.maps.ndone > 0 || mr.reduces.ndone > 0 {
+		fmt.Printf("Resume %s: %d of %d map and %d of %d reduce tasks done\n",
+			mr.file, mr.maps.ndone, mr.nMap, mr.reduces.ndone, mr.nReduce)
+	}
+}
+
+// Whether all of the output files of task i of op exist.
+func (mr *MapReduce) committed(op JobType, i int) bool {
+	var names []string
+	if op == Map {
+		for r := 0; r < mr.nReduce; r++ {
+			names = append(names, ReduceName(mr.file, i, r))
+		}
+	} else {
+		names = append(names, MergeName(mr.file, i))
+	}
+	for _, name := range names {
+		if _, err := os.Stat(name); err != nil {
+			return false
+		}
+	}
+	return true
+}
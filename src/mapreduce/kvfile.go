@@ -0,0 +1,492 @@
+package mapreduce
+
+import "os"
+import "io"
+import "fmt"
+import "bufio"
+import "errors"
+import "path/filepath"
+import "encoding/json"
+import "encoding/binary"
+import "hash/crc32"
+import "compress/flate"
+import "compress/gzip"
+
+// The files DoMap and DoReduce write, ReduceName() and MergeName(),
+// hold a sequence of KeyValue records followed by a footer with the
+// number of records and a CRC-32 over their keys and values. A
+// reader that reaches the end of a file without seeing a footer that
+// matches knows the file was truncated or damaged, and says so with
+// a *CorruptError rather than quietly returning fewer records.
+//
+// The records are in one of the Encodings below, the job's choice.
+// A Binary file starts with a header, the magic bytes "MRKV", a
+// format version and the compression used for the rest of the file;
+// each record is then a tag byte, 'r', and the key and value, each
+// a uvarint length followed by the bytes; and the footer is a tag
+// byte, 'f', the number of records as a uvarint, and the CRC as 4
+// big-endian bytes. A JSON file starts with a header line with the
+// format version, and holds one JSON-encoded KeyValue per line, then
+// a footer line. Readers tell the two apart by the header, so either
+// can be read whatever the job's Encoding.
+//
+// A JSON file without a header is in the format from before there
+// were footers: just the KeyValue lines. It is read to its end, with
+// nothing to check it against.
+//
+// Every file is written under a temporary name and renamed into
+// place once complete, so a reader never sees a partly written file,
+// and two attempts at the same task can't interleave their writes.
+
+// How intermediate files are encoded.
+type Encoding int
+
+const (
+	Binary      Encoding = iota // length-prefixed records; the default
+	BinaryFlate                 // Binary, compressed with compress/flate
+	BinaryGzip                  // Binary, compressed with compress/gzip
+	JSON                        // one KeyValue per line, easy to read
+)
+
+const kvMagic = "MRKV"
+const kvVersion = 1
+
+// The Binary header's compression byte.
+const (
+	compressNone  = 0
+	compressFlate = 1
+	compressGzip  = 2
+)
+
+// Longest key or value a Binary reader will believe a length prefix
+// for, rather than suspect damage.
+const maxField = 1 << 30
+
+type kvFooter struct {
+	Records int
+	CRC32   uint32
+}
+
+// A file that is missing its footer or doesn't match it.
+type CorruptError struct {
+	File   string
+	Reason string
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("mapreduce: %s is corrupt: %s", e.File, e.Reason)
+}
+
+// Create a temporary file to write name's contents into.
+// commit() renames it to name once it is complete.
+func createTemp(name string) (*os.File, error) {
+	return os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp-*")
+}
+
+func commit(file *os.File, name string) error {
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), name)
+}
+
+// Throw away a temporary file that won't be committed.
+func discard(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
+// Add kv to the running CRC-32 crc.
+func sum(crc uint32, kv *KeyValue) uint32 {
+	var n [8]byte
+	binary.BigEndian.PutUint32(n[:4], uint32(len(kv.Key)))
+	binary.BigEndian.PutUint32(n[4:], uint32(len(kv.Value)))
+	crc = crc32.Update(crc, crc32.IEEETable, n[:])
+	crc = crc32.Update(crc, crc32.IEEETable, []byte(kv.Key))
+	return crc32.Update(crc, crc32.IEEETable, []byte(kv.Value))
+}
+
+// Writes KeyValues to a temporary file, and commits it
+// under its real name, footer and all, on Close().
+type kvWriter struct {
+	name    string
+	file    *os.File
+	enc     recordWriter
+	crc     uint32
+	records int
+	size    int64 // of the file, once closed
+}
+
+func createKV(name string, encoding Encoding) (*kvWriter, error) {
+	file, err := createTemp(name)
+	if err != nil {
+		return nil, err
+	}
+	w := &kvWriter{name: name, file: file}
+	if encoding == JSON {
+		w.enc, err = newJSONWriter(file)
+		if err != nil {
+			discard(file)
+			return nil, err
+		}
+		return w, nil
+	}
+	w.enc, err = newBinaryWriter(file, encoding)
+	if err != nil {
+		discard(file)
+		return nil, err
+	}
+	return w, nil
+}
+
+// A kvWriter for a file that only this process will read, such as
+// a sorted run. Close() leaves it under its unique temporary name.
+func createRun(name string, encoding Encoding) (*kvWriter, error) {
+	w, err := createKV(name, encoding)
+	if err == nil {
+		w.name = w.file.Name()
+	}
+	return w, err
+}
+
+func (w *kvWriter) Write(kv KeyValue) error {
+	w.crc = sum(w.crc, &kv)
+	w.records++
+	return w.enc.Write(&kv)
+}
+
+// Write the footer and commit the file.
+func (w *kvWriter) Close() error {
+	if err := w.enc.Close(kvFooter{w.records, w.crc}); err != nil {
+		discard(w.file)
+		return err
+	}
+	if fi, err := w.file.Stat(); err == nil {
+		w.size = fi.Size()
+	}
+	return commit(w.file, w.name)
+}
+
+// Give up on the file; nothing is committed.
+func (w *kvWriter) Abort() {
+	discard(w.file)
+}
+
+// Reads the KeyValues of a file that a kvWriter wrote.
+type kvReader struct {
+	name    string
+	file    *os.File
+	dec     recordReader
+	crc     uint32
+	records int
+	err     error
+}
+
+func openKV(name string) (*kvReader, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r := &kvReader{name: name, file: file}
+	b := bufio.NewReader(file)
+	magic, _ := b.Peek(len(kvMagic))
+	if string(magic) != kvMagic {
+		// too short to be Binary, or JSON.
+		r.dec = &jsonReader{dec: json.NewDecoder(b)}
+		return r, nil
+	}
+	r.dec, err = newBinaryReader(b)
+	if err != nil {
+		file.Close()
+		return nil, &CorruptError{name, err.Error()}
+	}
+	return r, nil
+}
+
+// The next KeyValue. false at the end of the file, or if the file
+// turns out to be damaged, in which case Err() says so.
+func (r *kvReader) Next() (KeyValue, bool) {
+	if r.err != nil {
+		return KeyValue{}, false
+	}
+	kv, f, err := r.dec.Next()
+	if err != nil {
+		if j, ok := r.dec.(*jsonReader); ok && err == io.EOF && !j.header {
+			r.err = io.EOF // an old file, which had no footer
+		} else if err == io.EOF {
+			r.err = &CorruptError{r.name, "no footer"}
+		} else {
+			r.err = &CorruptError{r.name, err.Error()}
+		}
+		return KeyValue{}, false
+	}
+	if f == nil {
+		r.crc = sum(r.crc, &kv)
+		r.records++
+		return kv, true
+	}
+
+	if f.Records != r.records || f.CRC32 != r.crc {
+		r.err = &CorruptError{r.name, fmt.Sprintf(
+			"read %d records with CRC %x, footer says %d with CRC %x",
+			r.records, r.crc, f.Records, f.CRC32)}
+	} else if r.dec.More() {
+		r.err = &CorruptError{r.name, "data after footer"}
+	} else {
+		r.err = io.EOF
+	}
+	return KeyValue{}, false
+}
+
+// nil if every record has been read and the footer matched them;
+// otherwise a *CorruptError, or an I/O error.
+func (r *kvReader) Err() error {
+	if r.err == io.EOF {
+		return nil
+	}
+	if r.err == nil {
+		return fmt.Errorf("mapreduce: %s not read to the end", r.name)
+	}
+	return r.err
+}
+
+func (r *kvReader) Close() error {
+	return r.file.Close()
+}
+
+// An Encoding's records, for kvWriter and kvReader,
+// which keep count and check the footer.
+type recordWriter interface {
+	Write(kv *KeyValue) error
+	// Write the footer, and flush.
+	Close(f kvFooter) error
+}
+
+type recordReader interface {
+	// The next record, or the footer if f isn't nil.
+	// io.EOF if the file ends first.
+	Next() (kv KeyValue, f *kvFooter, err error)
+	// Whether anything follows the footer.
+	More() bool
+}
+
+type jsonWriter struct {
+	enc *json.Encoder
+}
+
+// The first line of a JSON file, which tells it from an old one.
+type jsonHeader struct {
+	Version int
+}
+
+// Write the header, and get ready to write records.
+func newJSONWriter(w io.Writer) (*jsonWriter, error) {
+	enc := json.NewEncoder(w)
+	err := enc.Encode(struct{ Header jsonHeader }{jsonHeader{kvVersion}})
+	return &jsonWriter{enc}, err
+}
+
+func (w *jsonWriter) Write(kv *KeyValue) error {
+	return w.enc.Encode(kv)
+}
+
+func (w *jsonWriter) Close(f kvFooter) error {
+	return w.enc.Encode(struct{ Footer kvFooter }{f})
+}
+
+type jsonReader struct {
+	dec    *json.Decoder
+	header bool // the file started with one; it must have a footer
+	first  bool // past the first line
+}
+
+func (r *jsonReader) Next() (KeyValue, *kvFooter, error) {
+	var rec struct {
+		Key    string
+		Value  string
+		Header *jsonHeader
+		Footer *kvFooter
+	}
+	if err := r.dec.Decode(&rec); err != nil {
+		return KeyValue{}, nil, err
+	}
+	if rec.Header != nil {
+		if r.first {
+			return KeyValue{}, nil, errors.New("header in the middle")
+		}
+		if rec.Header.Version != kvVersion {
+			return KeyValue{}, nil, fmt.Errorf("version %d", rec.Header.Version)
+		}
+		r.header, r.first = true, true
+		return r.Next()
+	}
+	r.first = true
+	return KeyValue{rec.Key, rec.Value}, rec.Footer, nil
+}
+
+func (r *jsonReader) More() bool {
+	return r.dec.More()
+}
+
+type binaryWriter struct {
+	buf *bufio.Writer  // onto the file
+	z   io.WriteCloser // compressing onto buf; nil if none
+	w   io.Writer      // z, or buf
+	n   [binary.MaxVarintLen64]byte
+}
+
+// Write the header, and get ready to write records.
+func newBinaryWriter(file io.Writer, encoding Encoding) (*binaryWriter, error) {
+	w := &binaryWriter{buf: bufio.NewWriter(file)}
+	w.w = w.buf
+	var compress byte
+	switch encoding {
+	case Binary:
+		compress = compressNone
+	case BinaryFlate:
+		compress = compressFlate
+		w.z, _ = flate.NewWriter(w.buf, flate.DefaultCompression)
+	case BinaryGzip:
+		compress = compressGzip
+		w.z = gzip.NewWriter(w.buf)
+	default:
+		return nil, fmt.Errorf("mapreduce: unknown encoding %d", encoding)
+	}
+	if w.z != nil {
+		w.w = w.z
+	}
+	w.buf.WriteString(kvMagic)
+	w.buf.Write([]byte{kvVersion, compress})
+	return w, nil
+}
+
+func (w *binaryWriter) uvarint(x uint64) error {
+	_, err := w.w.Write(w.n[:binary.PutUvarint(w.n[:], x)])
+	return err
+}
+
+func (w *binaryWriter) bytes(s string) error {
+	if err := w.uvarint(uint64(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w.w, s)
+	return err
+}
+
+func (w *binaryWriter) Write(kv *KeyValue) error {
+	if _, err := w.w.Write([]byte{'r'}); err != nil {
+		return err
+	}
+	if err := w.bytes(kv.Key); err != nil {
+		return err
+	}
+	return w.bytes(kv.Value)
+}
+
+func (w *binaryWriter) Close(f kvFooter) error {
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], f.CRC32)
+	w.w.Write([]byte{'f'})
+	w.uvarint(uint64(f.Records))
+	if _, err := w.w.Write(crc[:]); err != nil {
+		return err
+	}
+	if w.z != nil {
+		if err := w.z.Close(); err != nil {
+			return err
+		}
+	}
+	return w.buf.Flush()
+}
+
+type binaryReader struct {
+	r    *bufio.Reader // decompressing, if need be
+	file *bufio.Reader // the file under any decompression
+}
+
+// Read the header, and get ready to read records.
+func newBinaryReader(b *bufio.Reader) (*binaryReader, error) {
+	var h [len(kvMagic) + 2]byte
+	if _, err := io.ReadFull(b, h[:]); err != nil {
+		return nil, errors.New("short header")
+	}
+	if h[len(kvMagic)] != kvVersion {
+		return nil, fmt.Errorf("unknown format version %d", h[len(kvMagic)])
+	}
+	switch h[len(kvMagic)+1] {
+	case compressNone:
+		return &binaryReader{b, b}, nil
+	case compressFlate:
+		return &binaryReader{bufio.NewReader(flate.NewReader(b)), b}, nil
+	case compressGzip:
+		z, err := gzip.NewReader(b)
+		if err != nil {
+			return nil, err
+		}
+		z.Multistream(false)
+		return &binaryReader{bufio.NewReader(z), b}, nil
+	}
+	return nil, fmt.Errorf("unknown compression %d", h[len(kvMagic)+1])
+}
+
+// A truncated record is io.ErrUnexpectedEOF, not io.EOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (r *binaryReader) bytes() (string, error) {
+	n, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return "", unexpected(err)
+	}
+	if n > maxField {
+		return "", fmt.Errorf("field of %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return "", unexpected(err)
+	}
+	return string(b), nil
+}
+
+func (r *binaryReader) Next() (KeyValue, *kvFooter, error) {
+	tag, err := r.r.ReadByte()
+	if err != nil {
+		return KeyValue{}, nil, err
+	}
+	switch tag {
+	case 'r':
+		var kv KeyValue
+		if kv.Key, err = r.bytes(); err != nil {
+			return KeyValue{}, nil, err
+		}
+		if kv.Value, err = r.bytes(); err != nil {
+			return KeyValue{}, nil, err
+		}
+		return kv, nil, nil
+	case 'f':
+		n, err := binary.ReadUvarint(r.r)
+		if err != nil {
+			return KeyValue{}, nil, unexpected(err)
+		}
+		var crc [4]byte
+		if _, err := io.ReadFull(r.r, crc[:]); err != nil {
+			return KeyValue{}, nil, unexpected(err)
+		}
+		f := &kvFooter{int(n), binary.BigEndian.Uint32(crc[:])}
+		return KeyValue{}, f, nil
+	}
+	return KeyValue{}, nil, fmt.Errorf("bad record tag %#x", tag)
+}
+
+func (r *binaryReader) More() bool {
+	if _, err := r.r.ReadByte(); err != io.EOF {
+		return true
+	}
+	_, err := r.file.ReadByte()
+	return err != io.EOF
+}
@@ -4,13 +4,18 @@ import "fmt"
 import "os"
 import "log"
 import "strconv"
-import "encoding/json"
 import "sort"
 import "container/list"
+import "context"
+import "errors"
 import "net/rpc"
 import "net"
 import "bufio"
 import "hash/fnv"
+import "path/filepath"
+import "sync"
+import "time"
+import "transport"
 
 // import "os/exec"
 
@@ -32,12 +37,15 @@ import "hash/fnv"
 // DoReduce() collects <nReduce> reduce files from each map (f-*-<reduce>),
 // and runs Reduce on those files.  This produces <nReduce> result files,
 // which Merge() merges into a single output.
+//
+// A Job (RunSingleJob(), MakeMapReduceJob() and RunJobWorker()) instead
+// has an InputFormat (see input.go) cut its input into splits and read
+// them as (key, value) records, and Map is called with each record, as
+// in the paper. The Job's Name stands in for f in the file names.
 
 // Debugging
 const Debug = 0
 
-const MaxWorkerNumber = 100
-
 func DPrintf(format string, a ...interface{}) (n int, err error) {
 	if Debug > 0 {
 		n, err = fmt.Printf(format, a...)
@@ -51,23 +59,112 @@ type KeyValue struct {
 	Value string
 }
 
+// Map for a Job: called once per input record, returns a list of
+// KeyValues, and perhaps Counters (see counters.go).
+type Mapper func(key string, value string) *list.List
+
+// Reduce: called once per intermediate key, with a list of the
+// values (strings) emitted for it.
+type Reducer func(key string, values *list.List) string
+
+// A job for the key/value API.
+type Job struct {
+	Name    string      // output goes to "mrtmp." + Name
+	Input   InputFormat // what Map reads
+	NMap    int         // how many splits to ask Input for
+	NReduce int
+	Map     Mapper
+	Reduce  Reducer
+	Combine Reducer // optional; see below
+
+	// Which reduce task gets each key (see partition.go);
+	// nil for hash(key) % NReduce.
+	Partition Partitioner
+
+	// How the intermediate files are encoded (see kvfile.go).
+	Encoding Encoding
+
+	// Run the job's tasks only on workers with all of these
+	// labels (see RegisterArgs).
+	Labels []string
+
+	// The name of registered Funcs (see registry.go) to use instead
+	// of Map, Reduce and Combine, and their argument, if they take one.
+	Funcs    string
+	FuncsArg string
+}
+
+// Why job can't run, if it can't.
+func (job *Job) check() error {
+	if job.NMap <= 0 || job.NReduce <= 0 {
+		return errors.New("NMap and NReduce must be positive")
+	}
+	_, err := job.funcs()
+	return err
+}
+
+// The job's functions: its own, or the registered ones it names.
+func (job *Job) funcs() (Funcs, error) {
+	if job.Funcs == "" {
+		return Funcs{job.Map, job.Reduce, job.Combine}, nil
+	}
+	return LookupFuncs(job.Funcs, job.FuncsArg)
+}
+
+// The functions of a job, which a Service's workers (and the
+// Service itself) are started with, by name; see service.go.
+type Funcs struct {
+	Map     Mapper
+	Reduce  Reducer
+	Combine Reducer // optional
+}
+
+// A Combiner does part of Reduce's work in each map task, to shrink
+// what the task writes: the values emitted for a key are replaced by
+// the single value Combine returns for them, which Reduce (or Combine
+// again) later sees in their place. For word counts, Combine can be
+// Reduce itself. It must not matter how a key's values are divided
+// among calls to Combine, nor how many times they are combined.
+
 type MapReduce struct {
-	nMap            int    // Number of Map jobs
-	nReduce         int    // Number of Reduce jobs
-	file            string // Name of input file
+	nMap            int         // Number of Map jobs
+	nReduce         int         // Number of Reduce jobs
+	file            string      // Name of input file
+	input           InputFormat // nil for a file that Split() cuts up
+	partition       Partitioner // nil to partition by hash
+	mapper          Mapper      // the Job's Map, to sample keys with
+	encoding        Encoding    // of the intermediate files
+	splits          []Split
 	MasterAddress   string
 	registerChannel chan string
-	idleChannel     chan string
 	DoneChannel     chan bool
 	alive           bool
 	l               net.Listener
 	stats           *list.List
+	transport       transport.Transport
 
 	nWorker int //Number of Workers
 	// Map of registered workers that you need to keep up to date
 	Workers map[string]*WorkerInfo
 
-	JobDoneChannel chan int
+	TaskTimeout time.Duration // give up on a task that runs longer
+	mu          *sync.Mutex   // protects Workers and the phases
+	cond        *sync.Cond    // signalled when a task completes
+	maps        *phase        // the map tasks, in case outputs are lost
+	reduces     *phase
+	funcs       string   // the name of the job's Funcs, if it has one
+	funcsArg    string   // their argument, if they take one
+	labels      []string // that a worker must have to run the job's tasks
+	journal     *journal // Run()'s (see journal.go); nil otherwise
+
+	// The job's totals (see counters.go), once it is done.
+	Counters Counters
+
+	// A Pipeline's (see pipeline.go), once it is done: each stage's
+	// counters. Err says why a Pipeline, or a Job that couldn't run,
+	// failed, if it did.
+	StageCounters []Counters
+	Err           error
 }
 
 func InitMapReduce(nmap int, nreduce int,
@@ -77,20 +174,53 @@ func InitMapReduce(nmap int, nreduce int,
 	mr.nReduce = nreduce
 	mr.file = file
 	mr.MasterAddress = master
+	mr.transport = transport.Unix
 	mr.alive = true
 	mr.registerChannel = make(chan string)
-	mr.idleChannel = make(chan string, MaxWorkerNumber)
 	mr.DoneChannel = make(chan bool)
 	mr.nWorker = 0
 	mr.Workers = make(map[string]*WorkerInfo)
+	mr.TaskTimeout = DefaultTaskTimeout
+	mr.mu = new(sync.Mutex)
+	mr.cond = sync.NewCond(mr.mu)
+	mr.Counters = make(Counters)
 
 	// initialize any additional state here
 	return mr
 }
 
 func MakeMapReduce(nmap int, nreduce int,
+	file string, master string) *MapReduce {
+	return MakeMapReduceOn(transport.Unix, nmap, nreduce, file, master)
+}
+
+// Like MakeMapReduce, but listen for workers and reach them through t.
+func MakeMapReduceOn(t transport.Transport, nmap int, nreduce int,
 	file string, master string) *MapReduce {
 	mr := InitMapReduce(nmap, nreduce, file, master)
+	mr.transport = t
+	mr.StartRegistrationServer()
+	go mr.Run()
+	return mr
+}
+
+// Start a master for job; workers must be started with
+// RunJobWorker(), with the same job's functions. A job that can't
+// run is done at once, with mr.Err saying why.
+func MakeMapReduceJob(job *Job, master string) *MapReduce {
+	return MakeMapReduceJobOn(transport.Unix, job, master)
+}
+
+func MakeMapReduceJobOn(t transport.Transport, job *Job,
+	master string) *MapReduce {
+	mr := InitMapReduce(job.NMap, job.NReduce, job.Name, master)
+	if err := job.check(); err != nil {
+		mr.Err = fmt.Errorf("Job: %v", err)
+		go func() { mr.DoneChannel <- true }()
+		return mr
+	}
+	mr.setJob(job)
+	mr.transport = t
 	mr.StartRegistrationServer()
 	go mr.Run()
 	return mr
@@ -98,10 +228,24 @@ func MakeMapReduce(nmap int, nreduce int,
 
 func (mr *MapReduce) Register(args *RegisterArgs, res *RegisterReply) error {
 	DPrintf("Register: worker %s\n", args.Worker)
-	mr.idleChannel <- args.Worker
+	mr.mu.Lock()
+	wi, ok := mr.Workers[args.Worker]
+	if !ok {
+		wi = &WorkerInfo{address: args.Worker}
+		wi.ctx, wi.cancel = context.WithCancel(context.Background())
+		mr.Workers[args.Worker] = wi
+		mr.nWorker++
+	}
+	wi.lastHeartbeat = time.Now()
+	wi.slots = args.Slots
+	if wi.slots <= 0 {
+		wi.slots = 1
+	}
+	wi.labels = args.Labels
+	wi.draining = false
+	mr.cond.Broadcast()
+	mr.mu.Unlock()
 	//mr.registerChannel <- args.Worker
-	mr.Workers[args.Worker] = &WorkerInfo{args.Worker}
-	mr.nWorker++
 	res.OK = true
 	return nil
 }
@@ -114,10 +258,17 @@ func (mr *MapReduce) Shutdown(args *ShutdownArgs, res *ShutdownReply) error {
 }
 
 func (mr *MapReduce) StartRegistrationServer() {
+	mr.startServer()
+}
+
+// Serve the master's RPCs, and those of any other receivers.
+func (mr *MapReduce) startServer(rcvrs ...interface{}) {
 	rpcs := rpc.NewServer()
 	rpcs.Register(mr)
-	os.Remove(mr.MasterAddress) // only needed for "unix"
-	l, e := net.Listen("unix", mr.MasterAddress)
+	for _, rcvr := range rcvrs {
+		rpcs.Register(rcvr)
+	}
+	l, e := mr.transport.Listen(mr.MasterAddress)
 	if e != nil {
 		log.Fatal("RegstrationServer", mr.MasterAddress, " error: ", e)
 	}
@@ -163,7 +314,7 @@ func (mr *MapReduce) Split(fileName string) {
 	nchunk := size / int64(mr.nMap)
 	nchunk += 1
 
-	outfile, err := os.Create(MapName(fileName, 0))
+	outfile, err := createTemp(MapName(fileName, 0))
 	if err != nil {
 		log.Fatal("Split: ", err)
 	}
@@ -175,8 +326,13 @@ func (mr *MapReduce) Split(fileName string) {
 	for scanner.Scan() {
 		if int64(i) > nchunk*int64(m) {
 			writer.Flush()
-			outfile.Close()
-			outfile, err = os.Create(MapName(fileName, m))
+			if err := commit(outfile, MapName(fileName, m-1)); err != nil {
+				log.Fatal("Split: ", err)
+			}
+			outfile, err = createTemp(MapName(fileName, m))
+			if err != nil {
+				log.Fatal("Split: ", err)
+			}
 			writer = bufio.NewWriter(outfile)
 			m += 1
 		}
@@ -184,8 +340,15 @@ func (mr *MapReduce) Split(fileName string) {
 		writer.WriteString(line)
 		i += len(line)
 	}
-	writer.Flush()
-	outfile.Close()
+	if err := scanner.Err(); err != nil {
+		log.Fatal("Split: ", err)
+	}
+	if err := writer.Flush(); err != nil {
+		log.Fatal("Split: ", err)
+	}
+	if err := commit(outfile, MapName(fileName, m-1)); err != nil {
+		log.Fatal("Split: ", err)
+	}
 }
 
 func ReduceName(fileName string, MapJob int, ReduceJob int) string {
@@ -202,42 +365,62 @@ func hash(s string) uint32 {
 // partitions.
 func DoMap(JobNumber int, fileName string,
 	nreduce int, Map func(string) *list.List) {
-	name := MapName(fileName, JobNumber)
-	file, err := os.Open(name)
-	if err != nil {
-		log.Fatal("DoMap: ", err)
-	}
-	fi, err := file.Stat()
-	if err != nil {
-		log.Fatal("DoMap: ", err)
-	}
-	size := fi.Size()
-	fmt.Printf("DoMap: read split %s %d\n", name, size)
-	b := make([]byte, size)
-	_, err = file.Read(b)
-	if err != nil {
-		log.Fatal("DoMap: ", err)
+	args := &DoJobArgs{File: fileName, JobNumber: JobNumber,
+		NumOtherPhase: nreduce, Split: splitName(fileName, JobNumber)}
+	doMap(args, "", wholeSplit(Map), nil)
+}
+
+// The split that Split() wrote for map job, as one record.
+func splitName(fileName string, MapJob int) Split {
+	return Split{Format: "file", Files: []string{MapName(fileName, MapJob)}}
+}
+
+// A Mapper that passes the whole of a split made by
+// Split() to an old-style Map.
+func wholeSplit(Map func(string) *list.List) Mapper {
+	return func(key string, value string) *list.List {
+		return Map(value)
 	}
-	file.Close()
-	res := Map(string(b))
-	// XXX a bit inefficient. could open r files and run over list once
-	for r := 0; r < nreduce; r++ {
-		file, err = os.Create(ReduceName(fileName, JobNumber, r))
-		if err != nil {
-			log.Fatal("DoMap: create ", err)
-		}
-		enc := json.NewEncoder(file)
+}
+
+// Run map job args: call Map for each record of its split, and
+// create its partitions in dir ("" for the current directory), each
+// sorted by key and combined if Combine isn't nil. Returns the
+// task's counters.
+func doMap(args *DoJobArgs, dir string, Map Mapper, Combine Reducer) Counters {
+	fmt.Printf("DoMap: read split %v\n", args.Split.Files)
+	start := time.Now()
+	c := make(Counters)
+	nreduce := args.NumOtherPhase
+	Combine = counted(Combine, c, CombineInputRecords, CombineOutputRecords)
+	s := newSorter(nreduce, func(r int) string {
+		return filepath.Join(dir, ReduceName(args.File, args.JobNumber, r))
+	}, Combine, args.Encoding, c)
+	err := readSplit(args.Split, func(key string, value string) {
+		c.Add(MapInputRecords, 1)
+		c.Add(MapInputBytes, int64(len(value)))
+		res := Map(key, value)
 		for e := res.Front(); e != nil; e = e.Next() {
-			kv := e.Value.(KeyValue)
-			if hash(kv.Key)%uint32(nreduce) == uint32(r) {
-				err := enc.Encode(&kv)
-				if err != nil {
-					log.Fatal("DoMap: marshall ", err)
+			switch x := e.Value.(type) {
+			case Counter:
+				c.Add(x.Name, x.N)
+			case KeyValue:
+				c.Add(MapOutputRecords, 1)
+				r := partition(args.Partition, x.Key, nreduce)
+				if err := s.Add(r, x); err != nil {
+					log.Fatal("DoMap: spill ", err)
 				}
 			}
 		}
-		file.Close()
+	})
+	if err != nil {
+		log.Fatal("DoMap: ", err)
+	}
+	if err := s.Close(); err != nil {
+		log.Fatal("DoMap: commit ", err)
 	}
+	c.Add(MapMillis, time.Since(start).Milliseconds())
+	return c
 }
 
 func MergeName(fileName string, ReduceJob int) string {
@@ -248,86 +431,113 @@ func MergeName(fileName string, ReduceJob int) string {
 // key
 func DoReduce(job int, fileName string, nmap int,
 	Reduce func(string, *list.List) string) {
-	kvs := make(map[string]*list.List)
+	args := &DoJobArgs{File: fileName, JobNumber: job,
+		NumOtherPhase: nmap}
+	if _, bad := doReduce(args, nil, Reduce); len(bad) > 0 {
+		log.Fatalf("DoReduce: output of map jobs %v missing or corrupt", bad)
+	}
+}
+
+// Run reduce job args, like DoReduce, and return its counters; but
+// if the outputs of some map jobs are missing or corrupt, return
+// their numbers instead, and commit nothing. The output of map job
+// i is read from inputs[i], or its ReduceName() if inputs is nil.
+func doReduce(args *DoJobArgs, inputs []string, Reduce Reducer) (Counters, []int) {
+	start := time.Now()
+	var bad []int
+	nmap := args.NumOtherPhase
+	in := make([]*kvReader, 0, nmap)
 	for i := 0; i < nmap; i++ {
-		name := ReduceName(fileName, i, job)
+		name := ReduceName(args.File, i, args.JobNumber)
+		if inputs != nil {
+			name = inputs[i]
+		}
 		fmt.Printf("DoReduce: read %s\n", name)
-		file, err := os.Open(name)
+		r, err := openKV(name)
 		if err != nil {
-			log.Fatal("DoReduce: ", err)
-		}
-		dec := json.NewDecoder(file)
-		for {
-			var kv KeyValue
-			err = dec.Decode(&kv)
-			if err != nil {
-				break
-			}
-			_, ok := kvs[kv.Key]
-			if !ok {
-				kvs[kv.Key] = list.New()
-			}
-			kvs[kv.Key].PushBack(kv.Value)
+			fmt.Printf("DoReduce: %v\n", err)
+			bad = append(bad, i)
+			continue
 		}
-		file.Close()
+		in = append(in, r)
 	}
-	var keys []string
-	for k := range kvs {
-		keys = append(keys, k)
+	defer closeAll(in)
+	if len(bad) > 0 {
+		return nil, bad
 	}
-	sort.Strings(keys)
-	p := MergeName(fileName, job)
-	file, err := os.Create(p)
+
+	p := MergeName(args.File, args.JobNumber)
+	out, err := createKV(p, args.Encoding)
 	if err != nil {
 		log.Fatal("DoReduce: create ", err)
 	}
-	enc := json.NewEncoder(file)
-	for _, k := range keys {
-		res := Reduce(k, kvs[k])
-		enc.Encode(KeyValue{k, res})
+	c := make(Counters)
+	Reduce = counted(Reduce, c, ReduceInputRecords, ReduceInputGroups)
+	m := newMerger(in)
+	if err := group(m.Next, Reduce, out.Write); err != nil {
+		log.Fatal("DoReduce: marshall ", err)
 	}
-	file.Close()
+	for _, i := range m.Failed() {
+		// in[i] is map job i's output, since none was missing.
+		fmt.Printf("DoReduce: %v\n", in[i].Err())
+		bad = append(bad, i)
+	}
+	if len(bad) > 0 {
+		out.Abort()
+		sort.Ints(bad)
+		return nil, bad
+	}
+	if err := out.Close(); err != nil {
+		log.Fatal("DoReduce: commit ", err)
+	}
+	c.Add(ReduceOutputRecords, int64(out.records))
+	c.Add(ReduceOutputBytes, out.size)
+	c.Add(ReduceMillis, time.Since(start).Milliseconds())
+	return c, nil
 }
 
-// Merge the results of the reduce jobs
-// XXX use merge sort
+// Merge the results of the reduce jobs, each sorted by key. If they
+// were partitioned by key range, that's just concatenating them.
 func (mr *MapReduce) Merge() {
 	DPrintf("Merge phase")
-	kvs := make(map[string]string)
-	for i := 0; i < mr.nReduce; i++ {
-		p := MergeName(mr.file, i)
-		fmt.Printf("Merge: read %s\n", p)
-		file, err := os.Open(p)
-		if err != nil {
-			log.Fatal("Merge: ", err)
-		}
-		dec := json.NewDecoder(file)
-		for {
-			var kv KeyValue
-			err = dec.Decode(&kv)
-			if err != nil {
-				break
-			}
-			kvs[kv.Key] = kv.Value
-		}
-		file.Close()
+	names := make([]string, mr.nReduce)
+	for i := range names {
+		names[i] = MergeName(mr.file, i)
+		fmt.Printf("Merge: read %s\n", names[i])
 	}
-	var keys []string
-	for k := range kvs {
-		keys = append(keys, k)
+	in, err := openAll(names)
+	if err != nil {
+		log.Fatal("Merge: ", err)
 	}
-	sort.Strings(keys)
+	defer closeAll(in)
 
-	file, err := os.Create("mrtmp." + mr.file)
+	file, err := createTemp("mrtmp." + mr.file)
 	if err != nil {
 		log.Fatal("Merge: create ", err)
 	}
 	w := bufio.NewWriter(file)
-	for _, k := range keys {
-		fmt.Fprintf(w, "%s: %s\n", k, kvs[k])
+	var next func() (KeyValue, bool)
+	if ordered(mr.partition) {
+		next = concat(in)
+	} else {
+		next = newMerger(in).Next
+	}
+	for kv, ok := next(); ok; kv, ok = next() {
+		fmt.Fprintf(w, "%s: %s\n", kv.Key, kv.Value)
+	}
+	for _, r := range in {
+		if err := r.Err(); err != nil {
+			discard(file)
+			log.Fatal("Merge: ", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		discard(file)
+		log.Fatal("Merge: ", err)
+	}
+	if err := commit(file, "mrtmp."+mr.file); err != nil {
+		log.Fatal("Merge: ", err)
 	}
-	w.Flush()
-	file.Close()
 }
 
 func RemoveFile(n string) {
@@ -337,17 +547,40 @@ func RemoveFile(n string) {
 	}
 }
 
+// Like RemoveFile, but it's fine if n doesn't exist: a job whose
+// master died part way through may never have written it.
+func removeIfExists(n string) {
+	err := os.Remove(n)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal("CleanupFiles ", err)
+	}
+}
+
 func (mr *MapReduce) CleanupFiles() {
+	mr.removeIntermediate(removeIfExists)
+	removeIfExists(JournalName(mr.file))
+	removeIfExists("mrtmp." + mr.file)
+}
+
+// Remove the files of the job other than its output, with remove.
+func (mr *MapReduce) removeIntermediate(remove func(name string)) {
 	for i := 0; i < mr.nMap; i++ {
-		RemoveFile(MapName(mr.file, i))
+		if mr.input == nil {
+			remove(MapName(mr.file, i))
+		}
 		for j := 0; j < mr.nReduce; j++ {
-			RemoveFile(ReduceName(mr.file, i, j))
+			remove(ReduceName(mr.file, i, j))
 		}
 	}
 	for i := 0; i < mr.nReduce; i++ {
-		RemoveFile(MergeName(mr.file, i))
+		remove(MergeName(mr.file, i))
+	}
+
+	// temporary files of attempts that never finished.
+	temps, _ := filepath.Glob("mrtmp." + mr.file + "*.tmp-*")
+	for _, name := range temps {
+		os.Remove(name)
 	}
-	RemoveFile("mrtmp." + mr.file)
 }
 
 // Run jobs sequentially.
@@ -365,23 +598,117 @@ func RunSingle(nMap int, nReduce int, file string,
 	mr.Merge()
 }
 
+// Run job sequentially, and return its MapReduce for the counters,
+// or, if it can't run, with Err saying why.
+func RunSingleJob(job *Job) *MapReduce {
+	mr := InitMapReduce(job.NMap, job.NReduce, job.Name, "")
+	if err := job.check(); err != nil {
+		mr.Err = fmt.Errorf("Job: %v", err)
+		return mr
+	}
+	mr.setJob(job)
+	f, _ := job.funcs() // setJob() checked
+	if err := mr.makeSplits(); err != nil {
+		log.Fatal("Split: ", err)
+	}
+	for i := 0; i < mr.nMap; i++ {
+		mr.Counters.Merge(doMap(mr.jobArgs(Map, i), "", f.Map, f.Combine))
+	}
+	for i := 0; i < mr.nReduce; i++ {
+		c, bad := doReduce(mr.jobArgs(Reduce, i), nil, f.Reduce)
+		if len(bad) > 0 {
+			log.Fatalf("DoReduce: output of map jobs %v missing or corrupt", bad)
+		}
+		mr.Counters.Merge(c)
+	}
+	mr.Merge()
+	return mr
+}
+
+// What the master needs of job; the workers have its functions.
+func (mr *MapReduce) setJob(job *Job) {
+	f, err := job.funcs()
+	if err != nil {
+		log.Fatal("Job: ", err)
+	}
+	mr.input = job.Input
+	mr.partition = job.Partition
+	mr.mapper = f.Map
+	mr.encoding = job.Encoding
+	mr.labels = job.Labels
+	mr.funcs = job.Funcs
+	mr.funcsArg = job.FuncsArg
+}
+
+// The arguments for task i of phase op. Called with mr.mu held,
+// once the job has phases.
+func (mr *MapReduce) jobArgs(op JobType, i int) *DoJobArgs {
+	args := &DoJobArgs{File: mr.file, Operation: op, JobNumber: i,
+		Encoding: mr.encoding, Funcs: mr.funcs, FuncsArg: mr.funcsArg}
+	if op == Map {
+		args.NumOtherPhase = mr.nReduce
+		args.Split = mr.splits[i]
+		args.Partition = mr.partition
+	} else {
+		args.NumOtherPhase = mr.nMap
+		if mr.maps != nil {
+			args.Locations = append([]string(nil), mr.maps.hosts...)
+		}
+	}
+	return args
+}
+
+// Cut the input into one split per map job: with the
+// InputFormat if there is one, otherwise with Split().
+// Then sample the keys, if the Partitioner needs to.
+func (mr *MapReduce) makeSplits() error {
+	if mr.input == nil {
+		mr.Split(mr.file)
+		mr.splits = make([]Split, mr.nMap)
+		for i := range mr.splits {
+			mr.splits[i] = splitName(mr.file, i)
+		}
+		return nil
+	}
+	splits, err := mr.input.Splits(mr.nMap)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Split %s: %d splits\n", mr.file, len(splits))
+	mr.splits = splits
+	mr.nMap = len(splits)
+
+	mr.partition, err = sampleBounds(mr.partition, splits, mr.mapper, mr.nReduce)
+	return err
+}
+
 func (mr *MapReduce) CleanupRegistration() {
 	args := &ShutdownArgs{}
 	var reply ShutdownReply
-	ok := call(mr.MasterAddress, "MapReduce.Shutdown", args, &reply)
+	ok := transport.Call(mr.transport, mr.MasterAddress, "MapReduce.Shutdown", args, &reply)
 	if ok == false {
 		fmt.Printf("Cleanup: RPC %s error\n", mr.MasterAddress)
 	}
 	DPrintf("CleanupRegistration: done\n")
 }
 
-// Run jobs in parallel, assuming a shared file system
+// Run jobs in parallel, assuming a shared file system. Resume the
+// job from its journal, if a master at the same address died while
+// running it.
 func (mr *MapReduce) Run() {
 	fmt.Printf("Run mapreduce job %s %s\n", mr.MasterAddress, mr.file)
 
-	mr.Split(mr.file)
+	if err := mr.makeSplits(); err != nil {
+		log.Fatal("Split: ", err)
+	}
+	j, err := openJournal(JournalName(mr.file), mr.journalJob())
+	if err != nil {
+		log.Fatal("Journal: ", err)
+	}
+	mr.journal = j
 	mr.stats = mr.RunMaster()
 	mr.Merge()
+	mr.journal.Remove()
 	mr.CleanupRegistration()
 
 	fmt.Printf("%s: MapReduce done\n", mr.MasterAddress)
@@ -1,26 +1,115 @@
 package mapreduce
 
 import "container/list"
+import "context"
 import "fmt"
+import "log"
+import "sync"
+import "time"
+import "transport"
 
 //import "math"
 
+// Workers send the master a Heartbeat RPC every HeartbeatInterval.
+// A worker the master hasn't heard from for DeadHeartbeats intervals
+// is considered dead, and whatever it was running is re-executed.
+const HeartbeatInterval = 250 * time.Millisecond
+const DeadHeartbeats = 4
+
+// How long a task may run on a worker before the master gives up on
+// it and runs it elsewhere; MapReduce.TaskTimeout starts out as this.
+const DefaultTaskTimeout = 10 * time.Second
+
+// A worker runs up to as many tasks at once as it said it has slots
+// when it registered, and only tasks of jobs whose Labels it has.
 type WorkerInfo struct {
 	address string
 	// You can add definitions here.
+	lastHeartbeat time.Time
+	running       int // tasks the worker last said it was running
+	slots         int
+	labels        []string
+	inflight      int             // attempts whose DoJob RPC hasn't returned
+	hung          int             // attempts that timed out, but may still be running
+	draining      bool            // finishing its tasks, to leave; give it no more
+	ctx           context.Context // cancelled if it dies, to abandon its tasks
+	cancel        context.CancelFunc
+}
+
+// The tasks of one phase, and which of them have completed.
+// Protected by mr.mu.
+type phase struct {
+	op      JobType
+	nother  int // number of tasks in the other phase
+	done    []bool
+	ndone   int
+	running []int            // attempts in flight, per task
+	started []time.Time      // when the oldest attempt in flight started
+	replies []DoJobReply     // from the attempt that completed each task
+	hosts   []string         // the worker with each completed map task's output, or ""
+	spares  map[string][]int // map tasks whose losing attempts left outputs, by worker
+	err     error            // why the phase can't complete, if it can't
+}
+
+func newPhase(op JobType, ntask int, nother int) *phase {
+	p := &phase{op: op, nother: nother}
+	p.done = make([]bool, ntask)
+	p.running = make([]int, ntask)
+	p.started = make([]time.Time, ntask)
+	p.replies = make([]DoJobReply, ntask)
+	p.hosts = make([]string, ntask)
+	p.spares = make(map[string][]int)
+	return p
+}
+
+// The task to run a backup attempt of: the one whose attempt has
+// been running longest, among those with only one attempt in
+// flight. -1 if there is none, or if the phase isn't near its end
+// yet, i.e. some task that isn't done isn't running either.
+func (p *phase) straggler() int {
+	best := -1
+	for i := range p.done {
+		if p.done[i] {
+			continue
+		}
+		if p.running[i] == 0 {
+			return -1
+		}
+		if p.running[i] == 1 &&
+			(best < 0 || p.started[i].Before(p.started[best])) {
+			best = i
+		}
+	}
+	return best
+}
+
+// How many attempts at p's tasks are in flight.
+func (p *phase) inflight() int {
+	n := 0
+	for _, r := range p.running {
+		n += r
+	}
+	return n
 }
 
 // Clean up all workers by sending a Shutdown RPC to each one of them Collect
 // the number of jobs each work has performed.
 func (mr *MapReduce) KillWorkers() *list.List {
-	l := list.New()
+	mr.mu.Lock()
+	var workers []string
 	for _, w := range mr.Workers {
-		DPrintf("DoWork: shutdown %s\n", w.address)
+		workers = append(workers, w.address)
+	}
+	mr.mu.Unlock()
+
+	l := list.New()
+	for _, w := range workers {
+		DPrintf("DoWork: shutdown %s\n", w)
 		args := &ShutdownArgs{}
 		var reply ShutdownReply
-		ok := call(w.address, "Worker.Shutdown", args, &reply)
+		ok := transport.Call(mr.transport, w, "Worker.Shutdown", args, &reply)
 		if ok == false {
-			fmt.Printf("DoWork: RPC %s shutdown error\n", w.address)
+			fmt.Printf("DoWork: RPC %s shutdown error\n", w)
 		} else {
 			l.PushBack(reply.Njobs)
 		}
@@ -29,47 +118,395 @@ func (mr *MapReduce) KillWorkers() *list.List {
 }
 
 func (mr *MapReduce) RunMaster() *list.List {
-	mr.JobDoneChannel = make(chan int)
-
-	for i := 0; i < mr.nMap; i++ {
-		go func(JobNumber int) {
-			for {
-				w := <-mr.idleChannel
-				args := &DoJobArgs{mr.file, "Map", JobNumber, mr.nReduce}
-				var reply = &DoJobReply{}
-				ok := call(w, "Worker.DoJob", args, reply)
-				if ok == true {
-					mr.idleChannel <- w
-					mr.JobDoneChannel <- args.JobNumber
-					return
+	done := make(chan bool)
+	go mr.reap(done)
+	if err := mr.runJob(); err != nil {
+		log.Fatal("RunMaster: ", err)
+	}
+	close(done)
+	mr.removeOutputs()
+	return mr.KillWorkers()
+}
+
+// Run the map phase and then the reduce phase on the workers,
+// and add up the tasks' counters.
+func (mr *MapReduce) runJob() error {
+	mr.mu.Lock()
+	mr.maps = newPhase(Map, mr.nMap, mr.nReduce)
+	mr.reduces = newPhase(Reduce, mr.nReduce, mr.nMap)
+	mr.resume()
+	mr.mu.Unlock()
+	for _, p := range []*phase{mr.maps, mr.reduces} {
+		if err := mr.runPhase(p); err != nil {
+			return err
+		}
+	}
+
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	for _, p := range []*phase{mr.maps, mr.reduces} {
+		for _, reply := range p.replies {
+			mr.Counters.Merge(reply.Counters)
+		}
+	}
+	return nil
+}
+
+// Tell the workers holding map outputs in their local directories
+// that they can remove them, now that the reduce tasks are done.
+// First wait for any attempts still in flight, which may yet write
+// or fetch outputs.
+func (mr *MapReduce) removeOutputs() {
+	if mr.maps == nil {
+		return // the job never got that far
+	}
+	mr.mu.Lock()
+	local := len(mr.maps.spares) > 0
+	for _, h := range mr.maps.hosts {
+		local = local || h != ""
+	}
+	mr.mu.Unlock()
+	if !local {
+		return
+	}
+	mr.waitAttempts()
+
+	mr.mu.Lock()
+	maps := make(map[string][]int)
+	for h, ms := range mr.maps.spares {
+		maps[h] = append(maps[h], ms...)
+	}
+	for i, h := range mr.maps.hosts {
+		if h != "" {
+			maps[h] = append(maps[h], i)
+		}
+	}
+	mr.mu.Unlock()
+	for h, ms := range maps {
+		args := &RemoveOutputsArgs{mr.file, ms, mr.nReduce}
+		var reply RemoveOutputsReply
+		transport.Call(mr.transport, h, "Worker.RemoveOutputs", args, &reply)
+	}
+}
+
+// Wait for the attempts still in flight once the job is over, such
+// as backup attempts that lost, to return.
+func (mr *MapReduce) waitAttempts() {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	for _, p := range []*phase{mr.maps, mr.reduces} {
+		for p != nil && p.inflight() > 0 {
+			mr.cond.Wait()
+		}
+	}
+}
+
+// Run every task of p, and wait for them all to complete,
+// or for one to fail in a way that re-running it can't fix.
+func (mr *MapReduce) runPhase(p *phase) error {
+	mr.mu.Lock()
+	for i := range p.done {
+		if !p.done[i] { // resumed from the journal if it is
+			go mr.runTask(p, i)
+		}
+	}
+	mr.mu.Unlock()
+	go mr.speculate(p)
+	mr.mu.Lock()
+	for p.ndone < len(p.done) && p.err == nil {
+		mr.cond.Wait()
+	}
+	err := p.err
+	mr.mu.Unlock()
+	return err
+}
+
+// Run task i of phase p, on one worker after another,
+// until an attempt at it succeeds.
+func (mr *MapReduce) runTask(p *phase, i int) {
+	for {
+		mr.mu.Lock()
+		w := ""
+		for !p.done[i] && p.err == nil {
+			if w = mr.claim(); w != "" {
+				break
+			}
+			mr.cond.Wait()
+		}
+		if w == "" {
+			// a backup attempt finished it, or the phase failed.
+			mr.mu.Unlock()
+			return
+		}
+		args, wctx := mr.begin(p, i, w)
+		mr.mu.Unlock()
+		mr.attempt(p, i, w, args, wctx)
+	}
+}
+
+// Near the end of phase p, once every task that isn't done is
+// running, give idle workers backup attempts of the tasks that
+// have been running longest, as in the MapReduce paper. The first
+// attempt to finish completes the task and the others' results
+// are ignored; since DoMap and DoReduce commit their output files
+// atomically, the losers can't corrupt them.
+func (mr *MapReduce) speculate(p *phase) {
+	for {
+		mr.mu.Lock()
+		i, w := -1, ""
+		for p.ndone < len(p.done) && p.err == nil {
+			if i = p.straggler(); i >= 0 {
+				if w = mr.claim(); w != "" {
+					break
 				}
 			}
-		}(i)
+			mr.cond.Wait()
+		}
+		if w == "" {
+			// the phase is over.
+			mr.mu.Unlock()
+			return
+		}
+		args, wctx := mr.begin(p, i, w)
+		mr.mu.Unlock()
+		fmt.Printf("RunMaster: backup attempt of %v %v on %s\n", p.op, i, w)
+		go mr.attempt(p, i, w, args, wctx)
 	}
+}
 
-	for i := 0; i < mr.nMap; i++ {
-		<-mr.JobDoneChannel
+// A worker with a free slot that may run the job's tasks, which is
+// given the slot; the one with the most free slots, to spread the
+// load. "" if there's none. Called with mr.mu held.
+func (mr *MapReduce) claim() string {
+	best := ""
+	free := 0
+	for w, wi := range mr.Workers {
+		n := wi.slots - wi.inflight - wi.hung
+		if wi.draining || n <= 0 || !hasLabels(wi.labels, mr.labels) {
+			continue
+		}
+		if n > free || (n == free && w < best) {
+			best, free = w, n
+		}
 	}
+	if best != "" {
+		mr.Workers[best].inflight++
+	}
+	return best
+}
 
-	for i := 0; i < mr.nReduce; i++ {
-		go func(JobNumber int) {
-			for {
-				w := <-mr.idleChannel
-				args := &DoJobArgs{mr.file, "Reduce", JobNumber, mr.nMap}
-				var reply = &DoJobReply{}
-				ok := call(w, "Worker.DoJob", args, reply)
-				if ok == true {
-					mr.idleChannel <- w
-					mr.JobDoneChannel <- args.JobNumber
-					return
-				}
+// Whether have includes all of want.
+func hasLabels(have []string, want []string) bool {
+	for _, l := range want {
+		found := false
+		for _, h := range have {
+			found = found || h == l
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Give back the slot w was given by claim(). Called with mr.mu held.
+func (mr *MapReduce) release(w string) {
+	if wi, ok := mr.Workers[w]; ok && wi.inflight > 0 {
+		wi.inflight--
+		mr.cond.Broadcast()
+	}
+}
+
+// Start an attempt at task i of phase p on w, which has a slot for
+// it, and return the attempt's arguments, and a context that is
+// cancelled if w dies. Called with mr.mu held.
+func (mr *MapReduce) begin(p *phase, i int,
+	w string) (*DoJobArgs, context.Context) {
+	if p.running[i] == 0 {
+		p.started[i] = time.Now()
+	}
+	p.running[i]++
+	mr.journal.record(journalEntry{Op: p.op, Task: i, State: TaskInProgress,
+		Worker: w})
+	mr.cond.Broadcast()
+	return mr.jobArgs(p.op, i), mr.Workers[w].ctx
+}
+
+// Run an attempt at task i of phase p on worker w, which begin()
+// started, and give back w's slot.
+func (mr *MapReduce) attempt(p *phase, i int, w string, args *DoJobArgs,
+	wctx context.Context) {
+	ctx, cancel := context.WithTimeout(wctx, mr.TaskTimeout)
+	defer cancel()
+	var reply DoJobReply
+	ok := transport.CallContext(ctx, mr.transport, w, "Worker.DoJob", args, &reply)
+
+	mr.mu.Lock()
+	p.running[i]--
+	if !(ok && reply.OK) && !p.done[i] && p.running[i] == 0 {
+		mr.journal.record(journalEntry{Op: p.op, Task: i, State: TaskIdle})
+	}
+	mr.cond.Broadcast()
+	wi, alive := mr.Workers[w]
+	switch {
+	case ok && reply.Draining:
+		// the task is run elsewhere.
+		if alive {
+			wi.draining = true
+		}
+		mr.release(w)
+		mr.mu.Unlock()
+	case ok && reply.Err != "":
+		// w can't run the task, and no worker will be able to.
+		fmt.Printf("RunMaster: %v %v failed: %s\n", p.op, i, reply.Err)
+		if p.err == nil {
+			p.err = fmt.Errorf("%v %v: %s", p.op, i, reply.Err)
+			mr.cond.Broadcast()
+		}
+		mr.release(w)
+		mr.mu.Unlock()
+	case ok && reply.OK:
+		if !p.done[i] {
+			p.done[i] = true
+			p.ndone++
+			p.replies[i] = reply
+			p.hosts[i] = reply.Host
+			mr.journal.record(journalEntry{Op: p.op, Task: i,
+				State: TaskCompleted, Worker: w, Host: reply.Host,
+				Counters: reply.Counters})
+			mr.cond.Broadcast()
+		} else if reply.Host != "" && reply.Host != p.hosts[i] {
+			p.spares[reply.Host] = append(p.spares[reply.Host], i)
+		}
+		mr.release(w)
+		mr.mu.Unlock()
+	case ok && p.done[i]:
+		// a reduce task couldn't find some map outputs, but
+		// another attempt at it already completed it.
+		mr.release(w)
+		mr.mu.Unlock()
+	case ok:
+		// a reduce task couldn't find some map outputs.
+		mr.release(w)
+		mr.mu.Unlock()
+		var wg sync.WaitGroup
+		for _, m := range reply.Missing {
+			wg.Add(1)
+			go func(m int) {
+				mr.remap(m)
+				wg.Done()
+			}(m)
+		}
+		wg.Wait()
+		mr.mu.Lock()
+		if mr.maps.err != nil && p.err == nil {
+			p.err = mr.maps.err
+			mr.cond.Broadcast()
+		}
+		mr.mu.Unlock()
+	case alive && ctx.Err() == context.DeadlineExceeded:
+		// w is still heartbeating, but is stuck or slow. keep
+		// the slot until it finishes the task.
+		fmt.Printf("RunMaster: %v %v timed out on %s\n", p.op, i, w)
+		if wi.inflight > 0 {
+			wi.inflight--
+			wi.hung++
+		}
+		mr.mu.Unlock()
+	default:
+		DPrintf("RunMaster: %v %v failed on %s\n", p.op, i, w)
+		mr.forget(w)
+		mr.mu.Unlock()
+	}
+}
+
+// Run map task m again, because a reduce task
+// couldn't find its output, and wait for it.
+func (mr *MapReduce) remap(m int) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	p := mr.maps
+	if p.done[m] {
+		fmt.Printf("RunMaster: re-running lost Map %v\n", m)
+		p.done[m] = false
+		p.ndone--
+		p.hosts[m] = ""
+		mr.journal.record(journalEntry{Op: Map, Task: m, State: TaskIdle})
+		go mr.runTask(p, m)
+	}
+	for !p.done[m] && p.err == nil {
+		mr.cond.Wait()
+	}
+}
+
+// Forget workers that have stopped sending heartbeats, and abandon
+// the tasks they were running, until done is closed.
+func (mr *MapReduce) reap(done chan bool) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(HeartbeatInterval):
+		}
+		mr.mu.Lock()
+		for w, wi := range mr.Workers {
+			if time.Since(wi.lastHeartbeat) > DeadHeartbeats*HeartbeatInterval {
+				fmt.Printf("RunMaster: worker %s is dead\n", w)
+				wi.cancel()
+				mr.forget(w)
 			}
-		}(i)
+		}
+		mr.mu.Unlock()
 	}
+}
 
-	for i := 0; i < mr.nReduce; i++ {
-		<-mr.JobDoneChannel
+// Stop using worker w, which has failed. If it held the outputs of
+// map tasks in its local directory, and some reduce task may still
+// need them, run those map tasks again. Called with mr.mu held.
+//
+// A Service's jobs don't hear of the workers its pool forgets, so
+// they only find that outputs are lost when a reduce task can't
+// fetch them.
+func (mr *MapReduce) forget(w string) {
+	delete(mr.Workers, w)
+	p := mr.maps
+	if p == nil || mr.reduces.ndone == len(mr.reduces.done) {
+		return
+	}
+	for m, h := range p.hosts {
+		if h == w && p.done[m] {
+			fmt.Printf("RunMaster: re-running Map %v, whose output was on %s\n", m, w)
+			p.done[m] = false
+			p.ndone--
+			p.hosts[m] = ""
+			mr.journal.record(journalEntry{Op: Map, Task: m, State: TaskIdle})
+			go mr.runTask(p, m)
+		}
 	}
+	mr.cond.Broadcast()
+}
 
-	return mr.KillWorkers()
+// A worker says it is alive.
+func (mr *MapReduce) Heartbeat(args *HeartbeatArgs, res *HeartbeatReply) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	wi, ok := mr.Workers[args.Worker]
+	if ok {
+		wi.lastHeartbeat = time.Now()
+		wi.running = args.Running
+		if args.Draining && !wi.draining {
+			fmt.Printf("RunMaster: worker %s is draining\n", args.Worker)
+			wi.draining = true
+		}
+		// any of the tasks it's running may be a hung attempt,
+		// rather than one in flight it has already been sent,
+		// so only the hung attempts beyond those have surely
+		// finished, and given back their slots.
+		if n := wi.hung - wi.running; n > 0 {
+			wi.hung -= n
+			mr.cond.Broadcast()
+		}
+	}
+	res.OK = ok
+	return nil
 }
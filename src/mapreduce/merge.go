@@ -0,0 +1,306 @@
+package mapreduce
+
+import "fmt"
+import "sort"
+import "container/heap"
+import "container/list"
+
+// External sorting, so that neither side of a job has to hold a
+// whole partition in memory.
+//
+// DoMap buffers Map's output for each partition until SortBuffer
+// bytes have accumulated, then sorts each partition's buffer by key
+// and spills it to a run file. When the split is done, each
+// partition's runs are merged into its ReduceName() file, which is
+// therefore sorted by key. (A map task whose output fits in the
+// buffer writes its partitions directly, without any runs.)
+//
+// DoReduce merges its nMap sorted inputs, and so sees the keys in
+// order and needs only one key's values in memory at a time; its
+// MergeName() output is sorted too, and Merge() merges those.
+//
+// Records with equal keys come out of a merge in the order of the
+// inputs they came from, and of their order within an input, so a
+// key's values reach Reduce in the order Map emitted them within a
+// map task.
+//
+// A job's Combiner, if it has one, is applied wherever DoMap writes
+// sorted records, to each run of equal keys: when it spills a run,
+// and when it writes a partition file. So Combine may see a key more
+// than once per map task, and must accept its own output as input.
+
+// Bytes of map output DoMap buffers before it spills sorted runs.
+var SortBuffer = 64 << 20
+
+// Roughly what a buffered KeyValue costs beyond its strings.
+const kvOverhead = 32
+
+// A map task's output for each partition, buffered and
+// spilled to sorted runs.
+type sorter struct {
+	name     func(r int) string // the file partition r ends up in
+	combine  Reducer            // nil if the job has no Combiner
+	encoding Encoding           // of the runs and partition files
+	parts    [][]KeyValue
+	runs     [][]string // run files, per partition
+	size     int
+	counters Counters // of the partition files written
+}
+
+func newSorter(nreduce int, name func(r int) string, combine Reducer,
+	encoding Encoding, counters Counters) *sorter {
+	s := &sorter{name: name, combine: combine, encoding: encoding,
+		counters: counters}
+	s.parts = make([][]KeyValue, nreduce)
+	s.runs = make([][]string, nreduce)
+	return s
+}
+
+func (s *sorter) Add(r int, kv KeyValue) error {
+	s.parts[r] = append(s.parts[r], kv)
+	s.size += len(kv.Key) + len(kv.Value) + kvOverhead
+	if s.size >= SortBuffer {
+		return s.spill()
+	}
+	return nil
+}
+
+func sortKVs(kvs []KeyValue) {
+	sort.SliceStable(kvs, func(i, j int) bool {
+		return kvs[i].Key < kvs[j].Key
+	})
+}
+
+// Write each partition's buffer to a new sorted run.
+func (s *sorter) spill() error {
+	for r, kvs := range s.parts {
+		if len(kvs) == 0 {
+			continue
+		}
+		sortKVs(kvs)
+		w, err := createRun(s.name(r), s.encoding)
+		if err != nil {
+			return err
+		}
+		if err := group(each(kvs), s.combine, w.Write); err != nil {
+			w.Abort()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		s.runs[r] = append(s.runs[r], w.name)
+		s.parts[r] = nil
+	}
+	s.size = 0
+	return nil
+}
+
+// Write each partition's sorted output to its file,
+// and remove the runs.
+func (s *sorter) Close() error {
+	defer s.removeRuns()
+	spilled := false
+	for _, runs := range s.runs {
+		spilled = spilled || len(runs) > 0
+	}
+	if spilled {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+
+	for r := range s.parts {
+		w, err := createKV(s.name(r), s.encoding)
+		if err != nil {
+			return err
+		}
+		if spilled {
+			err = mergeRuns(s.runs[r], s.combine, w)
+		} else {
+			sortKVs(s.parts[r])
+			err = group(each(s.parts[r]), s.combine, w.Write)
+		}
+		if err != nil {
+			w.Abort()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		s.counters.Add(PartitionRecords, int64(w.records))
+		s.counters.Add(PartitionBytes(r), w.size)
+	}
+	return nil
+}
+
+func (s *sorter) removeRuns() {
+	for _, runs := range s.runs {
+		for _, name := range runs {
+			RemoveFile(name)
+		}
+	}
+}
+
+// Merge the sorted runs into w, combining if combine isn't nil.
+func mergeRuns(runs []string, combine Reducer, w *kvWriter) error {
+	in, err := openAll(runs)
+	if err != nil {
+		return err
+	}
+	defer closeAll(in)
+	m := newMerger(in)
+	if err := group(m.Next, combine, w.Write); err != nil {
+		return err
+	}
+	if failed := m.Failed(); len(failed) > 0 {
+		return in[failed[0]].Err()
+	}
+	return nil
+}
+
+// Pass the records next returns, which are sorted by key, to emit;
+// but if f isn't nil, replace each run of records with equal keys
+// by a single record, whose value is f of the key and their values.
+func group(next func() (KeyValue, bool), f Reducer,
+	emit func(KeyValue) error) error {
+	kv, more := next()
+	for more {
+		if f == nil {
+			if err := emit(kv); err != nil {
+				return err
+			}
+			kv, more = next()
+			continue
+		}
+		key := kv.Key
+		values := list.New()
+		for more && kv.Key == key {
+			values.PushBack(kv.Value)
+			kv, more = next()
+		}
+		if err := emit(KeyValue{key, f(key, values)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// An iterator over kvs, for group().
+func each(kvs []KeyValue) func() (KeyValue, bool) {
+	i := 0
+	return func() (KeyValue, bool) {
+		if i == len(kvs) {
+			return KeyValue{}, false
+		}
+		i++
+		return kvs[i-1], true
+	}
+}
+
+// An iterator over the records of in, one input after another.
+func concat(in []*kvReader) func() (KeyValue, bool) {
+	i := 0
+	return func() (KeyValue, bool) {
+		for ; i < len(in); i++ {
+			if kv, ok := in[i].Next(); ok {
+				return kv, true
+			}
+		}
+		return KeyValue{}, false
+	}
+}
+
+func openAll(names []string) ([]*kvReader, error) {
+	in := make([]*kvReader, len(names))
+	for i, name := range names {
+		r, err := openKV(name)
+		if err != nil {
+			closeAll(in[:i])
+			return nil, err
+		}
+		in[i] = r
+	}
+	return in, nil
+}
+
+func closeAll(in []*kvReader) {
+	for _, r := range in {
+		r.Close()
+	}
+}
+
+// A k-way merge of sorted kvReaders.
+type merger struct {
+	in     []*kvReader
+	last   []string // the last key read from each input
+	h      mergeHeap
+	failed []int
+}
+
+type mergeItem struct {
+	kv  KeyValue
+	src int
+}
+
+// a min-heap by key, then by input.
+type mergeHeap []mergeItem
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].kv.Key != h[j].kv.Key {
+		return h[i].kv.Key < h[j].kv.Key
+	}
+	return h[i].src < h[j].src
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergeItem)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func newMerger(in []*kvReader) *merger {
+	m := &merger{in: in, last: make([]string, len(in))}
+	for i := range in {
+		m.advance(i)
+	}
+	return m
+}
+
+// Put input i's next record on the heap, if it has one.
+func (m *merger) advance(i int) {
+	kv, ok := m.in[i].Next()
+	if !ok {
+		if m.in[i].Err() != nil {
+			m.failed = append(m.failed, i)
+		}
+		return
+	}
+	if kv.Key < m.last[i] {
+		m.in[i].err = &CorruptError{m.in[i].name, fmt.Sprintf(
+			"key %q after %q; not sorted", kv.Key, m.last[i])}
+		m.failed = append(m.failed, i)
+		return
+	}
+	m.last[i] = kv.Key
+	heap.Push(&m.h, mergeItem{kv, i})
+}
+
+// The smallest record not yet returned, from any input.
+func (m *merger) Next() (KeyValue, bool) {
+	if len(m.h) == 0 {
+		return KeyValue{}, false
+	}
+	x := heap.Pop(&m.h).(mergeItem)
+	m.advance(x.src)
+	return x.kv, true
+}
+
+// The inputs that turned out to be damaged; their Err() says how.
+// Only complete once Next() has returned false.
+func (m *merger) Failed() []int {
+	return m.failed
+}
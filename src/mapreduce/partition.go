@@ -0,0 +1,142 @@
+package mapreduce
+
+import "fmt"
+import "sort"
+import "math/rand"
+import "encoding/gob"
+
+// Partitioners for the key/value job API (see Job).
+//
+// A Partitioner decides which reduce task each key Map emits goes
+// to. The master sends the job's Partitioner to the workers with
+// each map task, as part of DoJobArgs, so it must be a type that gob
+// can encode, and a custom one must be registered with
+// RegisterPartitioner() in the worker's binary as well as the
+// master's. A job without one partitions by hash(key) % NReduce.
+//
+// RangePartitioner partitions by key range instead, so that every
+// key in reduce partition r sorts before every key in partition r+1;
+// the MergeName() files, read in order, are then one sorted result,
+// and Merge() just concatenates them.
+
+type Partitioner interface {
+	// Which of nreduce partitions key belongs in.
+	Partition(key string, nreduce int) int
+}
+
+func init() {
+	RegisterPartitioner(RangePartitioner{})
+}
+
+// Make p's type available to workers decoding DoJobArgs.
+func RegisterPartitioner(p Partitioner) {
+	gob.Register(p)
+}
+
+func partition(p Partitioner, key string, nreduce int) int {
+	if p == nil {
+		return int(hash(key) % uint32(nreduce))
+	}
+	return p.Partition(key, nreduce)
+}
+
+// Keys below Bounds[0] go to partition 0, keys from Bounds[0] up
+// to Bounds[1] to partition 1, and so on; there should be NReduce-1
+// bounds, in order. A job whose RangePartitioner has no Bounds gets
+// them by sampling: the master runs Map over a few splits, spread
+// over the input, and picks bounds that divide about Samples of the
+// keys evenly. That only balances the reduce tasks if those splits'
+// keys are representative of the whole input's.
+type RangePartitioner struct {
+	Bounds  []string
+	Samples int // how many keys to sample; DefaultSamples if 0
+}
+
+const DefaultSamples = 10000
+
+// Map is run over at most this many splits' records to sample keys.
+const sampleSplits = 10
+
+func (p RangePartitioner) Partition(key string, nreduce int) int {
+	r := sort.Search(len(p.Bounds), func(i int) bool {
+		return p.Bounds[i] > key
+	})
+	if r >= nreduce {
+		r = nreduce - 1
+	}
+	return r
+}
+
+// p as a RangePartitioner, if it is one or points to one.
+func asRange(p Partitioner) (RangePartitioner, bool) {
+	switch rp := p.(type) {
+	case RangePartitioner:
+		return rp, true
+	case *RangePartitioner:
+		if rp != nil {
+			return *rp, true
+		}
+	}
+	return RangePartitioner{}, false
+}
+
+// Whether the partitions of p are in key order.
+func ordered(p Partitioner) bool {
+	_, ok := asRange(p)
+	return ok
+}
+
+// Pick p's bounds for nreduce partitions, if it is a RangePartitioner
+// without any, from a sample of the keys Map emits for splits. A
+// *RangePartitioner comes back as a RangePartitioner, the type the
+// workers have registered.
+func sampleBounds(p Partitioner, splits []Split, Map Mapper,
+	nreduce int) (Partitioner, error) {
+	rp, ok := asRange(p)
+	if !ok {
+		return p, nil
+	}
+	if rp.Bounds != nil {
+		return rp, nil
+	}
+	n := rp.Samples
+	if n == 0 {
+		n = DefaultSamples
+	}
+
+	// a reservoir sample of the keys, from splits
+	// spread evenly over the input.
+	rnd := rand.New(rand.NewSource(1))
+	var keys []string
+	seen := 0
+	step := (len(splits) + sampleSplits - 1) / sampleSplits
+	for i := 0; i < len(splits); i += step {
+		err := readSplit(splits[i], func(key string, value string) {
+			res := Map(key, value)
+			for e := res.Front(); e != nil; e = e.Next() {
+				kv, ok := e.Value.(KeyValue)
+				if !ok {
+					continue // a Counter
+				}
+				seen++
+				k := kv.Key
+				if len(keys) < n {
+					keys = append(keys, k)
+				} else if j := rnd.Intn(seen); j < n {
+					keys[j] = k
+				}
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("sample: %v", err)
+		}
+	}
+	sort.Strings(keys)
+
+	rp.Bounds = make([]string, 0, nreduce-1)
+	for r := 1; r < nreduce && len(keys) > 0; r++ {
+		rp.Bounds = append(rp.Bounds, keys[r*len(keys)/nreduce])
+	}
+	DPrintf("Sample: %d of %d keys\n", len(keys), seen)
+	return rp, nil
+}
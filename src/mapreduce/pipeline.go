@@ -0,0 +1,181 @@
+package mapreduce
+
+import "os"
+import "fmt"
+import "errors"
+import "strconv"
+import "transport"
+
+// Jobs of several rounds, such as a word count and then the top
+// words by count.
+//
+// A Pipeline is a list of Jobs, its stages, that MakePipeline() runs
+// one after another on one master and one set of workers, which are
+// started with RunPipelineWorker() and so have every stage's
+// functions. The first stage reads its Input as usual; each stage
+// after it reads the KeyValues the stage before it reduced to,
+// straight from that stage's MergeName() files, through KVInput; so
+// its Map is called once per key, with the value Reduce returned for
+// it. A stage can name registered Funcs (see registry.go) instead of
+// having its own, as any Job can. A stage's Name is ignored: only
+// the last stage's output is merged, into "mrtmp." + the Pipeline's
+// Name, and each stage's files are removed once the stage after it
+// is done with them.
+//
+// If a stage fails, the ones after it don't run, and the MapReduce's
+// Err says which stage it was with a *StageError. Pipelines don't
+// keep a journal; a master that dies has to start over.
+
+type Pipeline struct {
+	Name   string
+	Stages []*Job
+}
+
+// Why a Pipeline failed: stage Stage, counting from 0, couldn't
+// complete.
+type StageError struct {
+	Stage int
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("stage %d: %v", e.Stage, e.Err)
+}
+
+// What stage k of p is called in the names of its files.
+func (p *Pipeline) stageName(k int) string {
+	if k == len(p.Stages)-1 {
+		return p.Name
+	}
+	return p.Name + "-stage-" + strconv.Itoa(k)
+}
+
+// Which of the workers' Funcs stage k's are.
+func stageFuncs(k int) string {
+	return "stage-" + strconv.Itoa(k)
+}
+
+// Every stage's own functions, for the workers; they look up the
+// registered ones.
+func (p *Pipeline) funcs() map[string]Funcs {
+	m := make(map[string]Funcs)
+	for k, job := range p.Stages {
+		if job.Funcs == "" {
+			m[stageFuncs(k)] = Funcs{job.Map, job.Reduce, job.Combine}
+		}
+	}
+	return m
+}
+
+// Why p can't run, if it can't.
+func (p *Pipeline) check() error {
+	if len(p.Stages) == 0 {
+		return errors.New("mapreduce: pipeline has no stages")
+	}
+	for k, job := range p.Stages {
+		var err error
+		switch {
+		case k == 0 && job.Input == nil:
+			err = errors.New("no Input")
+		case k > 0 && job.Input != nil:
+			err = errors.New("has an Input; it reads the stage before's output")
+		case job.NMap <= 0 || job.NReduce <= 0:
+			err = errors.New("NMap and NReduce must be positive")
+		default:
+			_, err = job.funcs()
+		}
+		if err != nil {
+			return &StageError{k, err}
+		}
+	}
+	return nil
+}
+
+// Start a master for p; workers must be started with
+// RunPipelineWorker(), with the same p.
+func MakePipeline(p *Pipeline, master string) *MapReduce {
+	return MakePipelineOn(transport.Unix, p, master)
+}
+
+func MakePipelineOn(t transport.Transport, p *Pipeline,
+	master string) *MapReduce {
+	mr := InitMapReduce(0, 0, p.Name, master)
+	mr.transport = t
+	mr.StartRegistrationServer()
+	go mr.RunPipeline(p)
+	return mr
+}
+
+// Run p's stages in order on mr's workers, then shut them down.
+func (mr *MapReduce) RunPipeline(p *Pipeline) {
+	fmt.Printf("Run pipeline %s %s: %d stages\n", mr.MasterAddress,
+		p.Name, len(p.Stages))
+	done := make(chan bool)
+	go mr.reap(done)
+	mr.Err = mr.runStages(p)
+	if mr.Err != nil {
+		fmt.Printf("Pipeline %s: %v\n", p.Name, mr.Err)
+	}
+	close(done)
+	mr.stats = mr.KillWorkers()
+	mr.CleanupRegistration()
+
+	fmt.Printf("%s: Pipeline done\n", mr.MasterAddress)
+	mr.DoneChannel <- true
+}
+
+// Run each stage of p, reading the output of the one before, and
+// merge the last one's output.
+func (mr *MapReduce) runStages(p *Pipeline) error {
+	if err := p.check(); err != nil {
+		return err
+	}
+	remove := func(name string) { os.Remove(name) }
+	var prev *MapReduce
+	for k, job := range p.Stages {
+		args := &SubmitJobArgs{Name: p.stageName(k), Input: job.Input,
+			NMap: job.NMap, NReduce: job.NReduce, Funcs: stageFuncs(k),
+			Partition: job.Partition, Encoding: job.Encoding,
+			Labels: job.Labels}
+		if job.Funcs != "" {
+			args.Funcs = job.Funcs
+			args.FuncsArg = job.FuncsArg
+		}
+		if prev != nil {
+			var in KVInput
+			for i := 0; i < prev.nReduce; i++ {
+				in.Files = append(in.Files, MergeName(prev.file, i))
+			}
+			args.Input = in
+		}
+		f, _ := job.funcs() // check() checked
+		stage := mr.newJob(args, f)
+		fmt.Printf("Pipeline %s: stage %d\n", p.Name, k)
+		err := mr.runStage(stage)
+		if prev != nil {
+			prev.removeIntermediate(remove)
+		}
+		if err != nil {
+			stage.removeIntermediate(remove)
+			return &StageError{k, err}
+		}
+		mr.StageCounters = append(mr.StageCounters, stage.Counters)
+		mr.Counters.Merge(stage.Counters)
+		prev = stage
+	}
+	prev.Merge()
+	prev.removeIntermediate(remove)
+	return nil
+}
+
+// Run one stage's job, and leave its output in its MergeName() files.
+func (mr *MapReduce) runStage(stage *MapReduce) error {
+	defer func() {
+		stage.waitAttempts()
+		stage.removeOutputs()
+	}()
+	if err := stage.makeSplits(); err != nil {
+		return err
+	}
+	return stage.runJob()
+}
@@ -0,0 +1,54 @@
+package mapreduce
+
+import "fmt"
+import "sync"
+
+// Named Funcs, so that one worker binary can run many kinds of jobs.
+//
+// Applications register their map, reduce and combine functions in
+// init() with RegisterFuncs(), under a name; a Job (or a Service's
+// job, or a Pipeline's stage) then names them in its Funcs, instead
+// of having its own, and the master sends the name to the workers in
+// DoJobArgs. Any worker whose binary registered them can run the job:
+// MakeRegistryWorker() makes a worker that runs nothing else, and the
+// other workers look names up here when they weren't given Funcs of
+// that name themselves.
+//
+// Some function sets take an argument, such as grep's pattern; those
+// are registered with RegisterFuncsWith(), and get the job's FuncsArg
+// each time a task needs them. The built-in sets are in builtin.go.
+
+var registry = struct {
+	sync.Mutex
+	m map[string]func(arg string) (Funcs, error)
+}{m: map[string]func(arg string) (Funcs, error){}}
+
+// Make f available to jobs as name.
+func RegisterFuncs(name string, f Funcs) {
+	RegisterFuncsWith(name, func(arg string) (Funcs, error) {
+		return f, nil
+	})
+}
+
+// Make the Funcs that maker returns for a job's FuncsArg available to
+// jobs as name. maker should return an error if arg won't do.
+func RegisterFuncsWith(name string, maker func(arg string) (Funcs, error)) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.m[name] = maker
+}
+
+// The Funcs registered as name, for FuncsArg arg.
+func LookupFuncs(name string, arg string) (Funcs, error) {
+	registry.Lock()
+	maker, ok := registry.m[name]
+	registry.Unlock()
+	if !ok {
+		return Funcs{}, fmt.Errorf("no Funcs %q", name)
+	}
+	f, err := maker(arg)
+	if err != nil {
+		return Funcs{}, fmt.Errorf("Funcs %s: %v", name, err)
+	}
+	return f, nil
+}
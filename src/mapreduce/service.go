@@ -0,0 +1,289 @@
+package mapreduce
+
+import "os"
+import "fmt"
+import "errors"
+import "sync"
+import "container/list"
+import "transport"
+
+// A long-lived master that runs many jobs on one pool of workers.
+//
+// StartService() starts a master that workers join with
+// RunServiceWorker(), and that runs the jobs clients submit with
+// SubmitJob(), until Kill(). Up to MaxRunningJobs jobs run at once,
+// sharing the workers; the rest wait their turn, in the order they
+// were submitted. Workers aren't shut down between jobs.
+//
+// Jobs are described by SubmitJobArgs, which has to get to the
+// master over RPC, so instead of functions a job names its Funcs,
+// which the Service and all its workers must have been started with
+// under that name, or which are registered under it (see
+// registry.go). (The Service uses the job's Map too, to sample keys
+// for a RangePartitioner.) JobStatus() tells how a job is
+// doing; once it is Done, its output is in "mrtmp." + Name, as for
+// MakeMapReduceJob(), and its intermediate files have been removed.
+
+type JobState string
+
+const (
+	Queued  JobState = "Queued"
+	Running JobState = "Running"
+	Done    JobState = "Done"
+	Failed  JobState = "Failed"
+)
+
+const MaxRunningJobs = 4
+
+type Service struct {
+	mr      *MapReduce // the pool of workers; also serves the RPCs
+	funcs   map[string]Funcs
+	mu      sync.Mutex
+	cond    *sync.Cond    // signalled when a job is queued, or on Kill()
+	jobs    []*serviceJob // by ID
+	queue   []*serviceJob
+	dead    bool
+	done    chan bool // closed by Kill(), to stop reaping workers
+	runners sync.WaitGroup
+}
+
+type serviceJob struct {
+	args  SubmitJobArgs
+	state JobState
+	err   error
+	mr    *MapReduce // once it's Running
+}
+
+func StartService(master string, funcs map[string]Funcs) *Service {
+	return StartServiceOn(transport.Unix, master, funcs)
+}
+
+// Like StartService, but listen for workers and clients,
+// and reach the workers, through t.
+func StartServiceOn(t transport.Transport, master string,
+	funcs map[string]Funcs) *Service {
+	s := &Service{funcs: funcs, done: make(chan bool)}
+	s.cond = sync.NewCond(&s.mu)
+	s.mr = InitMapReduce(0, 0, "", master)
+	s.mr.transport = t
+	s.mr.startServer(s)
+	go s.mr.reap(s.done)
+	for i := 0; i < MaxRunningJobs; i++ {
+		s.runners.Add(1)
+		go s.runner()
+	}
+	return s
+}
+
+// Stop taking jobs, wait for the running ones to finish, and shut
+// down the workers and the RPC server. Jobs still waiting to run
+// fail. Returns what KillWorkers() does.
+func (s *Service) Kill() *list.List {
+	s.mu.Lock()
+	s.dead = true
+	for _, j := range s.queue {
+		j.state = Failed
+		j.err = errors.New("service killed")
+	}
+	s.queue = nil
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.runners.Wait()
+	close(s.done)
+	l := s.mr.KillWorkers()
+	s.mr.CleanupRegistration()
+	return l
+}
+
+// Queue a job.
+func (s *Service) SubmitJob(args *SubmitJobArgs, reply *SubmitJobReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(args); err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
+	j := &serviceJob{args: *args, state: Queued}
+	reply.OK = true
+	reply.ID = len(s.jobs)
+	s.jobs = append(s.jobs, j)
+	s.queue = append(s.queue, j)
+	s.cond.Signal()
+	fmt.Printf("Service: job %d, %s, queued\n", reply.ID, args.Name)
+	return nil
+}
+
+// Why the Service can't take the job args, if it can't.
+func (s *Service) check(args *SubmitJobArgs) error {
+	switch {
+	case s.dead:
+		return errors.New("service killed")
+	case args.Name == "":
+		return errors.New("no Name")
+	case args.Input == nil:
+		return errors.New("no Input")
+	case args.NMap <= 0 || args.NReduce <= 0:
+		return errors.New("NMap and NReduce must be positive")
+	}
+	if _, err := s.lookup(args.Funcs, args.FuncsArg); err != nil {
+		return err
+	}
+	for _, j := range s.jobs {
+		if j.args.Name == args.Name && (j.state == Queued || j.state == Running) {
+			// they'd write the same files.
+			return fmt.Errorf("job %s is already %s", args.Name, j.state)
+		}
+	}
+	return nil
+}
+
+// The Funcs a job names: the Service's own, or registered ones.
+func (s *Service) lookup(name string, arg string) (Funcs, error) {
+	if f, ok := s.funcs[name]; ok {
+		return f, nil
+	}
+	return LookupFuncs(name, arg)
+}
+
+// How job args.ID is doing.
+func (s *Service) JobStatus(args *JobStatusArgs, reply *JobStatusReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if args.ID < 0 || args.ID >= len(s.jobs) {
+		return nil
+	}
+	j := s.jobs[args.ID]
+	reply.OK = true
+	reply.Name = j.args.Name
+	reply.State = j.state
+	if j.err != nil {
+		reply.Err = j.err.Error()
+	}
+	reply.NMap = j.args.NMap
+	reply.NReduce = j.args.NReduce
+	if mr := j.mr; mr != nil {
+		mr.mu.Lock()
+		if mr.maps != nil {
+			reply.NMap = len(mr.maps.done)
+			reply.MapsDone = mr.maps.ndone
+			reply.ReducesDone = mr.reduces.ndone
+		}
+		mr.mu.Unlock()
+	}
+	if j.state == Done {
+		reply.Counters = j.mr.Counters
+	}
+	return nil
+}
+
+// Run queued jobs, one after another, until Kill().
+func (s *Service) runner() {
+	defer s.runners.Done()
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.dead {
+			s.cond.Wait()
+		}
+		if s.dead {
+			s.mu.Unlock()
+			return
+		}
+		j := s.queue[0]
+		s.queue = s.queue[1:]
+		j.state = Running
+		f, _ := s.lookup(j.args.Funcs, j.args.FuncsArg) // check() checked
+		j.mr = s.mr.newJob(&j.args, f)
+		s.mu.Unlock()
+
+		err := s.run(j.mr)
+
+		s.mu.Lock()
+		if err != nil {
+			j.state = Failed
+			j.err = err
+		} else {
+			j.state = Done
+		}
+		s.mu.Unlock()
+		fmt.Printf("Service: job %s %s %v\n", j.args.Name, j.state, err)
+	}
+}
+
+func (s *Service) run(mr *MapReduce) error {
+	defer func() {
+		// don't pull the files out from under attempts
+		// that are still running.
+		mr.waitAttempts()
+		mr.removeIntermediate(func(name string) { os.Remove(name) })
+		mr.removeOutputs()
+	}()
+	if err := mr.makeSplits(); err != nil {
+		return err
+	}
+	if err := mr.runJob(); err != nil {
+		return err
+	}
+	mr.Merge()
+	return nil
+}
+
+// A MapReduce for one of a Service's jobs,
+// which shares mr's workers.
+func (mr *MapReduce) newJob(args *SubmitJobArgs, f Funcs) *MapReduce {
+	job := new(MapReduce)
+	job.nMap = args.NMap
+	job.nReduce = args.NReduce
+	job.file = args.Name
+	job.input = args.Input
+	job.partition = args.Partition
+	job.mapper = f.Map
+	job.encoding = args.Encoding
+	job.funcs = args.Funcs
+	job.funcsArg = args.FuncsArg
+	job.labels = args.Labels
+	job.Counters = make(Counters)
+
+	job.MasterAddress = mr.MasterAddress
+	job.transport = mr.transport
+	job.Workers = mr.Workers
+	job.TaskTimeout = mr.TaskTimeout
+	job.mu = mr.mu
+	job.cond = mr.cond
+	return job
+}
+
+// Submit a job to the Service at master, and return its ID.
+func SubmitJob(master string, args *SubmitJobArgs) (int, error) {
+	return SubmitJobOn(transport.Unix, master, args)
+}
+
+func SubmitJobOn(t transport.Transport, master string,
+	args *SubmitJobArgs) (int, error) {
+	var reply SubmitJobReply
+	if !transport.Call(t, master, "Service.SubmitJob", args, &reply) {
+		return 0, fmt.Errorf("mapreduce: can't reach %s", master)
+	}
+	if !reply.OK {
+		return 0, fmt.Errorf("mapreduce: job %s: %s", args.Name, reply.Err)
+	}
+	return reply.ID, nil
+}
+
+// Ask the Service at master how job id is doing.
+func JobStatus(master string, id int) (*JobStatusReply, error) {
+	return JobStatusOn(transport.Unix, master, id)
+}
+
+func JobStatusOn(t transport.Transport, master string,
+	id int) (*JobStatusReply, error) {
+	reply := new(JobStatusReply)
+	args := &JobStatusArgs{id}
+	if !transport.Call(t, master, "Service.JobStatus", args, reply) {
+		return nil, fmt.Errorf("mapreduce: can't reach %s", master)
+	}
+	if !reply.OK {
+		return nil, fmt.Errorf("mapreduce: no job %d", id)
+	}
+	return reply, nil
+}
@@ -9,6 +9,12 @@ import "bufio"
 import "log"
 import "sort"
 import "strconv"
+import "sync"
+import "sync/atomic"
+import "path/filepath"
+import "os/exec"
+import "encoding/json"
+import "transport"
 
 const (
   nNumber= 100000
@@ -189,3 +195,1368 @@ func TestManyFailures(t *testing.T) {
   fmt.Printf("  ... Many Failures Passed\n")
 }
 
+
+func TestTimeout(t *testing.T) {
+  fmt.Printf("Test: Hung worker mapreduce ...\n")
+  file := makeInput()
+  mr := InitMapReduce(nMap, nReduce, file, port("master"))
+  mr.TaskTimeout = 2 * time.Second
+  mr.StartRegistrationServer()
+  go mr.Run()
+
+  // worker 0 hangs forever in its first Map, but keeps
+  // sending heartbeats.
+  var calls int32
+  hang := func(value string) *list.List {
+    if atomic.AddInt32(&calls, 1) == 1 {
+      select {}
+    }
+    return MapFunc(value)
+  }
+  go RunWorker(mr.MasterAddress, port("worker" + strconv.Itoa(0)),
+               hang, ReduceFunc, -1)
+  go RunWorker(mr.MasterAddress, port("worker" + strconv.Itoa(1)),
+               MapFunc, ReduceFunc, -1)
+  // Wait until MR is done
+  <- mr.DoneChannel
+  check(t, mr.file)
+  cleanup(mr)
+  fmt.Printf("  ... Hung worker Passed\n")
+}
+
+func TestLostOutput(t *testing.T) {
+  fmt.Printf("Test: Lost map output mapreduce ...\n")
+  mr := setup()
+
+  // part way through the map phase, lose every map
+  // output for reduce 0 that has been written so far.
+  var calls int32
+  lose := func(value string) *list.List {
+    if atomic.AddInt32(&calls, 1) == nMap / 2 {
+      for i := 0; i < nMap; i++ {
+        os.Remove(ReduceName(mr.file, i, 0))
+      }
+    }
+    return MapFunc(value)
+  }
+  for i := 0; i < 2; i++ {
+    go RunWorker(mr.MasterAddress, port("worker" + strconv.Itoa(i)),
+                 lose, ReduceFunc, -1)
+  }
+  // Wait until MR is done
+  <- mr.DoneChannel
+  check(t, mr.file)
+  checkWorker(t, mr.stats)
+  cleanup(mr)
+  fmt.Printf("  ... Lost map output Passed\n")
+}
+
+func TestSpeculation(t *testing.T) {
+  fmt.Printf("Test: Straggler mapreduce ...\n")
+  t0 := time.Now()
+  mr := setup()
+
+  // worker 0 takes 8 seconds over each Map.
+  const delay = 8 * time.Second
+  var slow sync.WaitGroup
+  straggle := func(value string) *list.List {
+    slow.Add(1)
+    defer slow.Done()
+    time.Sleep(delay)
+    return MapFunc(value)
+  }
+  go RunWorker(mr.MasterAddress, port("worker" + strconv.Itoa(0)),
+               straggle, ReduceFunc, -1)
+  for i := 1; i < 3; i++ {
+    go RunWorker(mr.MasterAddress, port("worker" + strconv.Itoa(i)),
+                 MapFunc, ReduceFunc, -1)
+  }
+  // Wait until MR is done
+  <- mr.DoneChannel
+  if d := time.Since(t0); d > delay - 2 * time.Second {
+    t.Fatalf("job took %v; backup tasks should have finished it sooner", d)
+  }
+  check(t, mr.file)
+
+  // let the straggler's attempt finish before cleaning up.
+  slow.Wait()
+  time.Sleep(500 * time.Millisecond)
+  check(t, mr.file)
+  cleanup(mr)
+  fmt.Printf("  ... Straggler Passed\n")
+}
+
+func TestCorruptOutput(t *testing.T) {
+  fmt.Printf("Test: Truncated map output mapreduce ...\n")
+  mr := setup()
+
+  // part way through the map phase, cut every map output
+  // for reduce 0 written so far in half.
+  var calls int32
+  truncate := func(value string) *list.List {
+    if atomic.AddInt32(&calls, 1) == nMap / 2 {
+      for i := 0; i < nMap; i++ {
+        name := ReduceName(mr.file, i, 0)
+        if fi, err := os.Stat(name); err == nil {
+          os.Truncate(name, fi.Size() / 2)
+        }
+      }
+    }
+    return MapFunc(value)
+  }
+  for i := 0; i < 2; i++ {
+    go RunWorker(mr.MasterAddress, port("worker" + strconv.Itoa(i)),
+                 truncate, ReduceFunc, -1)
+  }
+  // Wait until MR is done
+  <- mr.DoneChannel
+  check(t, mr.file)
+  checkWorker(t, mr.stats)
+  cleanup(mr)
+  fmt.Printf("  ... Truncated map output Passed\n")
+}
+
+func TestFooter(t *testing.T) {
+  fmt.Printf("Test: Partition files detect damage ...\n")
+  name := "mrtmp.footer-test"
+  defer os.Remove(name)
+
+  write := func() {
+    w, err := createKV(name, JSON)
+    if err != nil {
+      t.Fatalf("createKV: %v", err)
+    }
+    for i := 0; i < 100; i++ {
+      w.Write(KeyValue{strconv.Itoa(i), "x"})
+    }
+    if err := w.Close(); err != nil {
+      t.Fatalf("Close: %v", err)
+    }
+  }
+  read := func() (int, error) {
+    r, err := openKV(name)
+    if err != nil {
+      t.Fatalf("openKV: %v", err)
+    }
+    defer r.Close()
+    n := 0
+    for _, ok := r.Next(); ok; _, ok = r.Next() {
+      n++
+    }
+    return n, r.Err()
+  }
+
+  write()
+  if n, err := read(); n != 100 || err != nil {
+    t.Fatalf("read %v records, err %v; expected 100", n, err)
+  }
+
+  // cut off in the middle of a record, or at a record boundary.
+  fi, _ := os.Stat(name)
+  for _, size := range []int64{fi.Size() / 2, 0} {
+    write()
+    if size == 0 {
+      data, _ := os.ReadFile(name)
+      size = int64(strings.LastIndex(strings.TrimRight(string(data), "\n"), "\n") + 1)
+    }
+    os.Truncate(name, size)
+    if _, err := read(); err == nil {
+      t.Fatalf("truncated to %v bytes, but no error", size)
+    } else if _, ok := err.(*CorruptError); !ok {
+      t.Fatalf("expected a *CorruptError, got %v", err)
+    }
+  }
+
+  // a flipped byte in a value.
+  write()
+  data, _ := os.ReadFile(name)
+  i := strings.Index(string(data), `"x"`)
+  data[i+1] = 'y'
+  os.WriteFile(name, data, 0666)
+  if _, err := read(); err == nil {
+    t.Fatalf("damaged value, but no error")
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Partition files from before footers ...\n")
+  // one JSON KeyValue per line, as DoMap used to write them.
+  file, _ := os.Create(name)
+  enc := json.NewEncoder(file)
+  for i := 0; i < 100; i++ {
+    enc.Encode(&KeyValue{strconv.Itoa(i), "x"})
+  }
+  file.Close()
+  if n, err := read(); n != 100 || err != nil {
+    t.Fatalf("read %v records, err %v; expected 100", n, err)
+  }
+  os.WriteFile(name, nil, 0666)
+  if n, err := read(); n != 0 || err != nil {
+    t.Fatalf("read %v records, err %v from an empty file", n, err)
+  }
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestEncodings(t *testing.T) {
+  fmt.Printf("Test: Binary partition files ...\n")
+  name := "mrtmp.encoding-test"
+  defer os.Remove(name)
+
+  write := func(e Encoding) int64 {
+    w, err := createKV(name, e)
+    if err != nil {
+      t.Fatalf("createKV: %v", err)
+    }
+    for i := 0; i < 100; i++ {
+      w.Write(KeyValue{strconv.Itoa(i), strings.Repeat("x", i % 7)})
+    }
+    if err := w.Close(); err != nil {
+      t.Fatalf("Close: %v", err)
+    }
+    fi, _ := os.Stat(name)
+    return fi.Size()
+  }
+  read := func() ([]KeyValue, error) {
+    r, err := openKV(name)
+    if err != nil {
+      return nil, err
+    }
+    defer r.Close()
+    var kvs []KeyValue
+    for kv, ok := r.Next(); ok; kv, ok = r.Next() {
+      kvs = append(kvs, kv)
+    }
+    return kvs, r.Err()
+  }
+
+  size := write(JSON)
+  for _, e := range []Encoding{Binary, BinaryFlate, BinaryGzip} {
+    if s := write(e); s >= size {
+      t.Fatalf("encoding %v: %v bytes, JSON only %v", e, s, size)
+    }
+    kvs, err := read()
+    if len(kvs) != 100 || err != nil {
+      t.Fatalf("encoding %v: read %v records, err %v; expected 100",
+               e, len(kvs), err)
+    }
+    for i, kv := range kvs {
+      if kv.Key != strconv.Itoa(i) || kv.Value != strings.Repeat("x", i % 7) {
+        t.Fatalf("encoding %v: record %v is %v", e, i, kv)
+      }
+    }
+
+    // cut off anywhere, but not to nothing: an empty file is
+    // an empty partition from before footers.
+    full := write(e)
+    data, _ := os.ReadFile(name)
+    for size := int64(1); size < full; size++ {
+      os.WriteFile(name, data[:size], 0666)
+      if _, err := read(); err == nil {
+        t.Fatalf("encoding %v: truncated to %v bytes, but no error", e, size)
+      }
+    }
+
+    // a flipped byte in the middle, or junk at the end.
+    damaged := append([]byte{}, data...)
+    damaged[len(damaged) / 2] ^= 0x40
+    os.WriteFile(name, damaged, 0666)
+    if _, err := read(); err == nil {
+      t.Fatalf("encoding %v: damaged, but no error", e)
+    }
+    os.WriteFile(name, append(data, 'r'), 0666)
+    if _, err := read(); err == nil {
+      t.Fatalf("encoding %v: junk at the end, but no error", e)
+    }
+  }
+
+  // a whole job, in each encoding.
+  file := makeInput()
+  for _, e := range []Encoding{JSON, BinaryGzip} {
+    job := &Job{Name: file, Input: TextInput{[]string{file}},
+                NMap: nMap, NReduce: nReduce, Map: lineMap, Reduce: ReduceFunc,
+                Encoding: e}
+    mr := RunSingleJob(job)
+    check(t, mr.file)
+    mr.CleanupFiles()
+  }
+  RemoveFile(file)
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSort(t *testing.T) {
+  fmt.Printf("Test: Map output sorted through spilled runs ...\n")
+  defer func(n int) { SortBuffer = n }(SortBuffer)
+  SortBuffer = 1000
+
+  const nparts = 3
+  name := func(r int) string { return "mrtmp.sort-test-" + strconv.Itoa(r) }
+  s := newSorter(nparts, name, nil, Binary, make(Counters))
+  for i := 0; i < 1000; i++ {
+    k := strconv.Itoa((i * 7919) % 500)
+    if err := s.Add(i % nparts, KeyValue{k, strconv.Itoa(i)}); err != nil {
+      t.Fatalf("Add: %v", err)
+    }
+  }
+  if err := s.Close(); err != nil {
+    t.Fatalf("Close: %v", err)
+  }
+
+  n := 0
+  for r := 0; r < nparts; r++ {
+    in, err := openKV(name(r))
+    if err != nil {
+      t.Fatalf("openKV: %v", err)
+    }
+    last := KeyValue{"", "-1"}
+    for kv, ok := in.Next(); ok; kv, ok = in.Next() {
+      if kv.Key < last.Key {
+        t.Fatalf("partition %v: %q after %q", r, kv.Key, last.Key)
+      }
+      // equal keys keep the order they were added in.
+      v, _ := strconv.Atoi(kv.Value)
+      lv, _ := strconv.Atoi(last.Value)
+      if kv.Key == last.Key && v < lv {
+        t.Fatalf("partition %v: key %q values out of order", r, kv.Key)
+      }
+      last = kv
+      n++
+    }
+    if err := in.Err(); err != nil {
+      t.Fatalf("partition %v: %v", r, err)
+    }
+    in.Close()
+    RemoveFile(name(r))
+  }
+  if n != 1000 {
+    t.Fatalf("read %v records; expected 1000", n)
+  }
+  if runs, _ := filepath.Glob("mrtmp.sort-test-*"); len(runs) > 0 {
+    t.Fatalf("runs left behind: %v", runs)
+  }
+
+  // a whole job, with every map task spilling.
+  SortBuffer = 32 << 10
+  mr := setup()
+  for i := 0; i < 2; i++ {
+    go RunWorker(mr.MasterAddress, port("worker" + strconv.Itoa(i)),
+                 MapFunc, ReduceFunc, -1)
+  }
+  <- mr.DoneChannel
+  check(t, mr.file)
+  checkWorker(t, mr.stats)
+  cleanup(mr)
+  fmt.Printf("  ... Sort Passed\n")
+}
+
+func TestTextInput(t *testing.T) {
+  fmt.Printf("Test: TextInput splits ...\n")
+  name := "mrtmp.text-test"
+  defer os.Remove(name)
+  var lines []string
+  data := ""
+  for i := 0; i < 200; i++ {
+    line := strings.Repeat("x", i % 13) + strconv.Itoa(i)
+    lines = append(lines, line)
+    data += line + "\n"
+  }
+  data += "no newline"
+  lines = append(lines, "no newline")
+  os.WriteFile(name, []byte(data), 0666)
+
+  for n := 1; n < 40; n += 3 {
+    in := TextInput{[]string{name}}
+    splits, err := in.Splits(n)
+    if err != nil {
+      t.Fatalf("Splits: %v", err)
+    }
+    var got []string
+    for _, s := range splits {
+      err := in.Read(s, func(key string, value string) {
+        off, _ := strconv.Atoi(key)
+        if !strings.HasPrefix(data[off:], value) {
+          t.Fatalf("line %q is not at offset %v", value, off)
+        }
+        got = append(got, value)
+      })
+      if err != nil {
+        t.Fatalf("Read: %v", err)
+      }
+    }
+    if strings.Join(got, "\n") != strings.Join(lines, "\n") {
+      t.Fatalf("%v splits: lines lost or repeated", n)
+    }
+  }
+  if _, err := (TextInput{[]string{name}}).Splits(0); err == nil {
+    t.Fatalf("Splits(0) succeeded")
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Jobs without map or reduce tasks are rejected ...\n")
+  job := &Job{Name: "mrtmp.text-test", Input: TextInput{[]string{name}},
+              NMap: 0, NReduce: 2, Map: lineMap, Reduce: ReduceFunc}
+  if mr := RunSingleJob(job); mr.Err == nil {
+    t.Fatalf("RunSingleJob() with NMap 0 succeeded")
+  }
+  job.NMap, job.NReduce = 2, 0
+  mr := MakeMapReduceJob(job, port("master"))
+  <- mr.DoneChannel
+  if mr.Err == nil {
+    t.Fatalf("MakeMapReduceJob() with NReduce 0 succeeded")
+  }
+  fmt.Printf("  ... Passed\n")
+}
+
+// Map for the key/value API: each line is a key.
+func lineMap(key string, value string) *list.List {
+  res := list.New()
+  res.PushBack(KeyValue{value, key})
+  return res
+}
+
+func TestJob(t *testing.T) {
+  fmt.Printf("Test: Job with TextInput mapreduce ...\n")
+  file := makeInput()
+  job := &Job{Name: file, Input: TextInput{[]string{file}},
+              NMap: nMap, NReduce: nReduce, Map: lineMap, Reduce: ReduceFunc}
+  mr := MakeMapReduceJob(job, port("master"))
+  for i := 0; i < 2; i++ {
+    go RunJobWorker(mr.MasterAddress, port("worker" + strconv.Itoa(i)),
+                    job, -1)
+  }
+  // Wait until MR is done
+  <- mr.DoneChannel
+  check(t, mr.file)
+  checkWorker(t, mr.stats)
+  cleanup(mr)
+  fmt.Printf("  ... Job Passed\n")
+}
+
+// read the "key: value" lines of a job's output.
+func output(t *testing.T, name string) map[string]string {
+  b, err := os.ReadFile("mrtmp." + name)
+  if err != nil {
+    t.Fatalf("output: %v", err)
+  }
+  m := make(map[string]string)
+  for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+    kv := strings.SplitN(line, ": ", 2)
+    m[kv[0]] = kv[1]
+  }
+  return m
+}
+
+// count the values for each key.
+func countReduce(key string, values *list.List) string {
+  return strconv.Itoa(values.Len())
+}
+
+func TestInputFormats(t *testing.T) {
+  fmt.Printf("Test: FileInput and JSONInput ...\n")
+  dir, err := os.MkdirTemp(".", "mrtmp.dir-")
+  if err != nil {
+    t.Fatalf("MkdirTemp: %v", err)
+  }
+  defer os.RemoveAll(dir)
+
+  // each file's name and contents become one record.
+  for i := 0; i < 5; i++ {
+    os.WriteFile(fmt.Sprintf("%s/f%d", dir, i),
+                 []byte(strings.Repeat("a b\n", i + 1)), 0666)
+  }
+  in, err := DirInput(dir)
+  if err != nil || len(in.Files) != 5 {
+    t.Fatalf("DirInput: %v %v", in.Files, err)
+  }
+  files := func(key string, value string) *list.List {
+    res := list.New()
+    res.PushBack(KeyValue{"files", key})
+    for _, w := range strings.Fields(value) {
+      res.PushBack(KeyValue{w, ""})
+    }
+    return res
+  }
+  job := &Job{Name: "dir-test", Input: in, NMap: 3, NReduce: 2,
+              Map: files, Reduce: countReduce}
+  RunSingleJob(job)
+  out := output(t, job.Name)
+  if out["files"] != "5" || out["a"] != "15" || out["b"] != "15" {
+    t.Fatalf("wrong output %v", out)
+  }
+  mr := InitMapReduce(3, 2, job.Name, "")
+  mr.input = in
+  mr.makeSplits()
+  mr.CleanupFiles()
+
+  // JSON lines become KeyValues.
+  name := dir + "/kvs.json"
+  var b strings.Builder
+  for i := 0; i < 100; i++ {
+    fmt.Fprintf(&b, "{\"Key\": \"k%d\", \"Value\": \"v\"}\n", i % 10)
+  }
+  os.WriteFile(name, []byte(b.String()), 0666)
+  same := func(key string, value string) *list.List {
+    res := list.New()
+    res.PushBack(KeyValue{key, value})
+    return res
+  }
+  job = &Job{Name: "json-test", Input: JSONInput{[]string{name}},
+             NMap: 4, NReduce: 3, Map: same, Reduce: countReduce}
+  RunSingleJob(job)
+  out = output(t, job.Name)
+  if len(out) != 10 || out["k3"] != "10" {
+    t.Fatalf("wrong output %v", out)
+  }
+  mr = InitMapReduce(4, 3, job.Name, "")
+  mr.input = JSONInput{[]string{name}}
+  mr.makeSplits()
+  mr.CleanupFiles()
+  fmt.Printf("  ... Passed\n")
+}
+
+// sum the values for each key.
+func sumReduce(key string, values *list.List) string {
+  total := 0
+  for e := values.Front(); e != nil; e = e.Next() {
+    n, _ := strconv.Atoi(e.Value.(string))
+    total += n
+  }
+  return strconv.Itoa(total)
+}
+
+func TestCombine(t *testing.T) {
+  fmt.Printf("Test: Combiner ...\n")
+  // count the numbers ending in each digit.
+  digits := func(key string, value string) *list.List {
+    res := list.New()
+    res.PushBack(KeyValue{value[len(value)-1:], "1"})
+    return res
+  }
+  checkCounts := func(mr *MapReduce, combined bool) {
+    out := output(t, mr.file)
+    if len(out) != 10 || out["7"] != strconv.Itoa(nNumber / 10) {
+      t.Fatalf("wrong output %v", out)
+    }
+    c := mr.Counters
+    if c[MapOutputRecords] != nNumber {
+      t.Fatalf("%v records before combining; expected %v",
+               c[MapOutputRecords], nNumber)
+    }
+    // at most one record per digit per map task.
+    if combined && c[PartitionRecords] > int64(10 * mr.nMap) {
+      t.Fatalf("%v records after combining; expected at most %v",
+               c[PartitionRecords], 10 * mr.nMap)
+    }
+    if combined && c[CombineInputRecords] < nNumber {
+      t.Fatalf("Combine saw %v records; expected at least %v",
+               c[CombineInputRecords], nNumber)
+    }
+    if !combined && c[PartitionRecords] != nNumber {
+      t.Fatalf("%v records written without a Combiner; expected %v",
+               c[PartitionRecords], nNumber)
+    }
+  }
+
+  file := makeInput()
+  job := &Job{Name: file, Input: TextInput{[]string{file}},
+              NMap: nMap, NReduce: nReduce, Map: digits, Reduce: sumReduce}
+  mr := RunSingleJob(job)
+  checkCounts(mr, false)
+  mr.CleanupFiles()
+
+  job.Combine = sumReduce
+  mr = RunSingleJob(job)
+  checkCounts(mr, true)
+  mr.CleanupFiles()
+
+  // with spilled runs, a key can be combined more than once.
+  defer func(n int) { SortBuffer = n }(SortBuffer)
+  SortBuffer = 4 << 10
+  mr = MakeMapReduceJob(job, port("master"))
+  for i := 0; i < 2; i++ {
+    go RunJobWorker(mr.MasterAddress, port("worker" + strconv.Itoa(i)),
+                    job, -1)
+  }
+  <- mr.DoneChannel
+  checkCounts(mr, true)
+  checkWorker(t, mr.stats)
+  cleanup(mr)
+  fmt.Printf("  ... Combiner Passed\n")
+}
+
+// the keys of reduce job r's output.
+func reduceKeys(t *testing.T, file string, r int) []string {
+  in, err := openKV(MergeName(file, r))
+  if err != nil {
+    t.Fatalf("openKV: %v", err)
+  }
+  defer in.Close()
+  var keys []string
+  for kv, ok := in.Next(); ok; kv, ok = in.Next() {
+    keys = append(keys, kv.Key)
+  }
+  if err := in.Err(); err != nil {
+    t.Fatalf("%v", err)
+  }
+  return keys
+}
+
+// partitions "group:rest" keys by group.
+type groupPartitioner struct {
+  Sep string
+}
+
+func (p groupPartitioner) Partition(key string, nreduce int) int {
+  group := strings.SplitN(key, p.Sep, 2)[0]
+  return int(hash(group) % uint32(nreduce))
+}
+
+func TestPartition(t *testing.T) {
+  fmt.Printf("Test: RangePartitioner gives sorted reduce outputs ...\n")
+  file := makeInput()
+  // keys spread evenly over the key space, whichever splits
+  // are sampled, unlike the numbers themselves.
+  hashMap := func(key string, value string) *list.List {
+    res := list.New()
+    res.PushBack(KeyValue{fmt.Sprintf("%08x", hash(value)), value})
+    return res
+  }
+  job := &Job{Name: file, Input: TextInput{[]string{file}},
+              NMap: nMap, NReduce: nReduce, Map: hashMap, Reduce: ReduceFunc,
+              Partition: RangePartitioner{Samples: 1000}}
+  mr := MakeMapReduceJob(job, port("master"))
+  for i := 0; i < 2; i++ {
+    go RunJobWorker(mr.MasterAddress, port("worker" + strconv.Itoa(i)),
+                    job, -1)
+  }
+  <- mr.DoneChannel
+  checkWorker(t, mr.stats)
+  out, _ := os.ReadFile("mrtmp." + file)
+  lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+  if len(lines) != nNumber || !sort.StringsAreSorted(lines) {
+    t.Fatalf("expected %v lines in order, got %v", nNumber, len(lines))
+  }
+  last := ""
+  for r := 0; r < nReduce; r++ {
+    keys := reduceKeys(t, mr.file, r)
+    // sampling should keep the partitions roughly even.
+    if n := len(keys); n < nNumber / nReduce / 3 || n > nNumber / nReduce * 3 {
+      t.Fatalf("partition %v has %v keys; expected about %v",
+               r, n, nNumber / nReduce)
+    }
+    if keys[0] <= last {
+      t.Fatalf("partition %v starts with %q, after %q", r, keys[0], last)
+    }
+    last = keys[len(keys) - 1]
+  }
+  cleanup(mr)
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: *RangePartitioner is ordered too ...\n")
+  file = makeInput()
+  job.Name = file
+  job.Input = TextInput{[]string{file}}
+  job.Partition = &RangePartitioner{Samples: 1000}
+  mr = MakeMapReduceJob(job, port("master"))
+  for i := 0; i < 2; i++ {
+    go RunJobWorker(mr.MasterAddress, port("worker" + strconv.Itoa(i)),
+                    job, -1)
+  }
+  <- mr.DoneChannel
+  checkWorker(t, mr.stats)
+  if !ordered(job.Partition) || !ordered(mr.partition) {
+    t.Fatalf("%#v not ordered", mr.partition)
+  }
+  out, _ = os.ReadFile("mrtmp." + file)
+  lines = strings.Split(strings.TrimSpace(string(out)), "\n")
+  if len(lines) != nNumber || !sort.StringsAreSorted(lines) {
+    t.Fatalf("expected %v lines in order, got %v", nNumber, len(lines))
+  }
+  cleanup(mr)
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: custom Partitioner ...\n")
+  RegisterPartitioner(groupPartitioner{})
+  file = makeInput()
+  // group the numbers by their last digit.
+  job = &Job{Name: file, Input: TextInput{[]string{file}},
+             NMap: 10, NReduce: 7, Reduce: ReduceFunc,
+             Partition: groupPartitioner{":"}}
+  job.Map = func(key string, value string) *list.List {
+    res := list.New()
+    res.PushBack(KeyValue{value[len(value)-1:] + ":" + value, key})
+    return res
+  }
+  mr = RunSingleJob(job)
+  where := make(map[string]int)
+  for r := 0; r < job.NReduce; r++ {
+    for _, k := range reduceKeys(t, mr.file, r) {
+      group := k[:1]
+      if w, ok := where[group]; ok && w != r {
+        t.Fatalf("group %v in partitions %v and %v", group, w, r)
+      }
+      where[group] = r
+    }
+  }
+  if len(where) != 10 {
+    t.Fatalf("expected 10 groups, got %v", where)
+  }
+  cleanup(mr)
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestCounters(t *testing.T) {
+  fmt.Printf("Test: Counters ...\n")
+  // count the odd numbers, and emit the even ones.
+  evens := func(key string, value string) *list.List {
+    res := list.New()
+    n, _ := strconv.Atoi(value)
+    if n % 2 == 1 {
+      res.PushBack(Counter{"odd", 1})
+    } else {
+      res.PushBack(KeyValue{value, ""})
+    }
+    return res
+  }
+  file := makeInput()
+  job := &Job{Name: file, Input: TextInput{[]string{file}},
+              NMap: nMap, NReduce: nReduce, Map: evens, Reduce: ReduceFunc}
+  mr := MakeMapReduceJob(job, port("master"))
+  // one worker fails part way, so some tasks run twice.
+  go RunJobWorker(mr.MasterAddress, port("worker0"), job, 10)
+  go RunJobWorker(mr.MasterAddress, port("worker1"), job, -1)
+  <- mr.DoneChannel
+
+  c := mr.Counters
+  expect := map[string]int64{
+    "odd": nNumber / 2,
+    MapInputRecords: nNumber,
+    MapOutputRecords: nNumber / 2,
+    PartitionRecords: nNumber / 2,
+    ReduceInputRecords: nNumber / 2,
+    ReduceInputGroups: nNumber / 2,
+    ReduceOutputRecords: nNumber / 2,
+  }
+  for name, n := range expect {
+    if c[name] != n {
+      t.Fatalf("counter %v is %v; expected %v\n%v", name, c[name], n, c)
+    }
+  }
+  fi, _ := os.Stat(file)
+  // the input bytes don't count newlines.
+  if c[MapInputBytes] != fi.Size() - nNumber {
+    t.Fatalf("%v input bytes; expected %v", c[MapInputBytes], fi.Size() - nNumber)
+  }
+  var size int64
+  for r := 0; r < nReduce; r++ {
+    var psize int64
+    for m := 0; m < mr.nMap; m++ {
+      fi, _ := os.Stat(ReduceName(file, m, r))
+      psize += fi.Size()
+    }
+    if c[PartitionBytes(r)] != psize {
+      t.Fatalf("partition %v: %v bytes; expected %v", r, c[PartitionBytes(r)], psize)
+    }
+    fi, _ := os.Stat(MergeName(file, r))
+    size += fi.Size()
+  }
+  if c[ReduceOutputBytes] != size {
+    t.Fatalf("%v reduce output bytes; expected %v", c[ReduceOutputBytes], size)
+  }
+  for _, name := range []string{MapMillis, ReduceMillis} {
+    if _, ok := c[name]; !ok {
+      t.Fatalf("no %v counter", name)
+    }
+  }
+  cleanup(mr)
+  fmt.Printf("  ... Counters Passed\n")
+}
+
+// wait for a Service's job to finish, and return its status.
+func waitJob(t *testing.T, master string, id int) *JobStatusReply {
+  for i := 0; i < 300; i++ {
+    st, err := JobStatus(master, id)
+    if err != nil {
+      t.Fatalf("JobStatus: %v", err)
+    }
+    if st.State == Done || st.State == Failed {
+      return st
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+  t.Fatalf("job %v never finished", id)
+  return nil
+}
+
+func TestService(t *testing.T) {
+  fmt.Printf("Test: Service runs several jobs ...\n")
+  digits := func(key string, value string) *list.List {
+    res := list.New()
+    res.PushBack(KeyValue{value[len(value)-1:], "1"})
+    return res
+  }
+  funcs := map[string]Funcs{
+    "lines": {Map: lineMap, Reduce: ReduceFunc},
+    "digits": {Map: digits, Reduce: sumReduce, Combine: sumReduce},
+  }
+  master := port("master")
+  // only the service has "count".
+  sfuncs := map[string]Funcs{"count": {Map: digits, Reduce: countReduce}}
+  for name, f := range funcs {
+    sfuncs[name] = f
+  }
+  s := StartService(master, sfuncs)
+  for i := 0; i < 3; i++ {
+    go RunServiceWorker(master, port("worker" + strconv.Itoa(i)), funcs, -1)
+  }
+
+  file := makeInput()
+  defer RemoveFile(file)
+  input := TextInput{[]string{file}}
+  submit := func(name string, f string) int {
+    id, err := SubmitJob(master, &SubmitJobArgs{Name: name, Input: input,
+                         NMap: 20, NReduce: 5, Funcs: f})
+    if err != nil {
+      t.Fatalf("SubmitJob: %v", err)
+    }
+    return id
+  }
+  var ids []int
+  for i := 0; i < 3; i++ {
+    ids = append(ids, submit("svc-lines-" + strconv.Itoa(i), "lines"))
+  }
+  ids = append(ids, submit("svc-digits", "digits"))
+
+  // bad jobs are turned away.
+  if _, err := SubmitJob(master, &SubmitJobArgs{Name: "svc-digits",
+      Input: input, NMap: 1, NReduce: 1, Funcs: "digits"}); err == nil {
+    t.Fatalf("two jobs named svc-digits at once")
+  }
+  if _, err := SubmitJob(master, &SubmitJobArgs{Name: "svc-x",
+      Input: input, NMap: 1, NReduce: 1, Funcs: "nonesuch"}); err == nil {
+    t.Fatalf("job with unknown Funcs accepted")
+  }
+  if _, err := JobStatus(master, 100); err == nil {
+    t.Fatalf("status of a job that doesn't exist")
+  }
+
+  for _, id := range ids {
+    st := waitJob(t, master, id)
+    if st.State != Done || st.MapsDone != st.NMap || st.ReducesDone != st.NReduce {
+      t.Fatalf("job %v: %+v", id, st)
+    }
+    if st.Name == "svc-digits" {
+      if out := output(t, st.Name); out["3"] != strconv.Itoa(nNumber / 10) {
+        t.Fatalf("job %v: wrong output %v", st.Name, out)
+      }
+    } else {
+      b, _ := os.ReadFile("mrtmp." + st.Name)
+      if n := strings.Count(string(b), "\n"); n != nNumber {
+        t.Fatalf("job %v: %v output lines; expected %v", st.Name, n, nNumber)
+      }
+    }
+    if st.Counters[MapInputRecords] != nNumber {
+      t.Fatalf("job %v: counters %v", st.Name, st.Counters)
+    }
+    if left, _ := filepath.Glob("mrtmp." + st.Name + "-*"); len(left) > 0 {
+      t.Fatalf("job %v: intermediate files left: %v", st.Name, left[0])
+    }
+    RemoveFile("mrtmp." + st.Name)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Service job fails if workers lack its Funcs ...\n")
+  id := submit("svc-count", "count")
+  if st := waitJob(t, master, id); st.State != Failed || st.Err == "" {
+    t.Fatalf("job with Funcs the workers lack: %+v", st)
+  }
+  // the workers are still there for the next job.
+  id = submit("svc-digits", "digits")
+  if st := waitJob(t, master, id); st.State != Done {
+    t.Fatalf("job after a failed one: %+v", st)
+  }
+  RemoveFile("mrtmp.svc-digits")
+
+  l := s.Kill()
+  if l.Len() != 3 {
+    t.Fatalf("%v workers shut down; expected 3", l.Len())
+  }
+  checkWorker(t, l)
+  fmt.Printf("  ... Passed\n")
+}
+
+// the job TestRestart's masters run.
+func restartJob(file string) *Job {
+  return &Job{Name: file, Input: TextInput{[]string{file}},
+              NMap: nMap, NReduce: nReduce, Map: lineMap, Reduce: ReduceFunc}
+}
+
+func TestRestart(t *testing.T) {
+  if master := os.Getenv("MR_TEST_MASTER"); master != "" {
+    // the master the test kills, in a process of its own.
+    MakeMapReduceJob(restartJob("824-mrinput.txt"), master)
+    select {}
+  }
+
+  fmt.Printf("Test: Restarted master resumes from its journal ...\n")
+  file := makeInput()
+  master := port("master")
+  cmd := exec.Command(os.Args[0], "-test.run=^TestRestart$")
+  cmd.Env = append(os.Environ(), "MR_TEST_MASTER=" + master)
+  if err := cmd.Start(); err != nil {
+    t.Fatalf("start master: %v", err)
+  }
+  job := restartJob(file)
+  for i := 0; i < 2; i++ {
+    go RunJobWorker(master, port("worker" + strconv.Itoa(i)), job, -1)
+  }
+
+  // kill the master once some map tasks are done.
+  completed := map[int]bool{}
+  for i := 0; len(completed) < 10; i++ {
+    if i > 300 {
+      cmd.Process.Kill()
+      t.Fatalf("map tasks never completed")
+    }
+    time.Sleep(100 * time.Millisecond)
+    _, entries, _, _ := readJournal(JournalName(file))
+    for _, e := range entries {
+      if e.Op == Map {
+        completed[e.Task] = e.State == TaskCompleted
+        if !completed[e.Task] {
+          delete(completed, e.Task)
+        }
+      }
+    }
+  }
+  cmd.Process.Kill()
+  cmd.Wait()
+  outputs := map[string]os.FileInfo{}
+  for m := range completed {
+    for r := 0; r < nReduce; r++ {
+      name := ReduceName(file, m, r)
+      fi, err := os.Stat(name)
+      if err != nil {
+        t.Fatalf("output of completed map %v: %v", m, err)
+      }
+      outputs[name] = fi
+    }
+  }
+
+  // the same workers finish the job for a new master.
+  mr := MakeMapReduceJob(job, master)
+  <- mr.DoneChannel
+  check(t, mr.file)
+  if n := mr.stats.Len(); n != 2 {
+    t.Fatalf("%v workers shut down; expected 2", n)
+  }
+  for name, fi := range outputs {
+    if now, err := os.Stat(name); err != nil || !os.SameFile(fi, now) {
+      t.Fatalf("completed map task re-run: %v rewritten", name)
+    }
+  }
+  if c := mr.Counters[MapInputRecords]; c != nNumber {
+    t.Fatalf("%v map input records; expected %v", c, nNumber)
+  }
+  if _, err := os.Stat(JournalName(file)); err == nil {
+    t.Fatalf("journal not removed")
+  }
+  cleanup(mr)
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Journal with a torn last entry ...\n")
+  name := JournalName("torn-test")
+  jj := &journalJob{File: "torn-test", NMap: 3, NReduce: 1}
+  j, err := openJournal(name, jj)
+  if err != nil {
+    t.Fatalf("openJournal: %v", err)
+  }
+  j.record(journalEntry{Op: Map, Task: 0, State: TaskCompleted})
+  // the master dies halfway through writing an entry.
+  j.file.Write([]byte(`{"Op":"Map","Task":1,"St`))
+  j.file.Close()
+  for restart := 0; restart < 2; restart++ {
+    j, err = openJournal(name, jj)
+    if err != nil {
+      t.Fatalf("openJournal after restart %v: %v", restart, err)
+    }
+    if e := j.last[Map][0]; e.State != TaskCompleted {
+      t.Fatalf("restart %v: map 0 %q; expected completed", restart, e.State)
+    }
+    j.record(journalEntry{Op: Map, Task: 2 - restart, State: TaskInProgress})
+    j.file.Close()
+  }
+  if _, entries, _, err := readJournal(name); err != nil || len(entries) != 3 {
+    t.Fatalf("journal has %v entries, %v; expected 3", len(entries), err)
+  }
+  os.Remove(name)
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: CleanupFiles after a master died ...\n")
+  // only some of the job's files were ever written.
+  mr = InitMapReduce(nMap, nReduce, "restart-test", "")
+  os.WriteFile(ReduceName(mr.file, 0, 0), nil, 0666)
+  os.WriteFile(JournalName(mr.file), nil, 0666)
+  mr.input = TextInput{}
+  mr.CleanupFiles()
+  if left, _ := filepath.Glob("mrtmp.restart-test*"); len(left) > 0 {
+    t.Fatalf("files left: %v", left)
+  }
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestLocalStorage(t *testing.T) {
+  fmt.Printf("Test: Workers keep map outputs in local directories ...\n")
+  file := makeInput()
+  job := &Job{Name: file, Input: TextInput{[]string{file}},
+              NMap: 20, NReduce: 5, Map: lineMap, Reduce: ReduceFunc}
+  mr := MakeMapReduceJob(job, port("master"))
+  var dirs []string
+  for i := 0; i < 3; i++ {
+    dir, err := os.MkdirTemp(".", "mrtmp.local-")
+    if err != nil {
+      t.Fatalf("MkdirTemp: %v", err)
+    }
+    defer os.RemoveAll(dir)
+    dirs = append(dirs, dir)
+    wk := MakeJobWorker(job)
+    wk.Dir = dir
+    go wk.Run(transport.Unix, mr.MasterAddress,
+              port("worker" + strconv.Itoa(i)), -1)
+  }
+  // one worker shares the current directory.
+  go RunJobWorker(mr.MasterAddress, port("worker3"), job, -1)
+  <- mr.DoneChannel
+  check(t, mr.file)
+  local := 0
+  for m, h := range mr.maps.hosts {
+    if h != "" {
+      local++
+      continue
+    }
+    for r := 0; r < job.NReduce; r++ {
+      if _, err := os.Stat(ReduceName(file, m, r)); err != nil {
+        t.Fatalf("map %v's output not in the shared directory: %v", m, err)
+      }
+    }
+  }
+  if local == 0 {
+    t.Fatalf("no map outputs kept locally")
+  }
+  for _, dir := range dirs {
+    if left, _ := filepath.Glob(dir + "/*"); len(left) > 0 {
+      t.Fatalf("map outputs not removed: %v", left)
+    }
+  }
+  cleanup(mr)
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Map tasks re-run when their outputs' worker fails ...\n")
+  file = makeInput()
+  mr = MakeMapReduceJob(job, port("master"))
+  dead := port("worker0")
+  for i := 0; i < 3; i++ {
+    wk := MakeJobWorker(job)
+    wk.Dir = dirs[i]
+    nRPC := -1
+    if i == 0 {
+      // fails once it has run some map tasks; fetches
+      // from the others don't count.
+      nRPC = 5
+    }
+    go wk.Run(transport.Unix, mr.MasterAddress,
+              port("worker" + strconv.Itoa(i)), nRPC)
+  }
+  <- mr.DoneChannel
+  check(t, mr.file)
+  for m, h := range mr.maps.hosts {
+    if h == dead || h == "" {
+      t.Fatalf("map %v's output on %q", m, h)
+    }
+  }
+  cleanup(mr)
+  fmt.Printf("  ... Passed\n")
+}
+
+// A job over a file of n lines, whose Map takes a while per line,
+// and counts the calls running at once in running and the most
+// there have been in max.
+func slowJob(name string, n int, running *int32, max *int32) *Job {
+  data := ""
+  for i := 0; i < n; i++ {
+    data += strconv.Itoa(i) + "\n"
+  }
+  os.WriteFile(name, []byte(data), 0666)
+  slowMap := func(key string, value string) *list.List {
+    r := atomic.AddInt32(running, 1)
+    for m := atomic.LoadInt32(max); r > m; m = atomic.LoadInt32(max) {
+      if atomic.CompareAndSwapInt32(max, m, r) {
+        break
+      }
+    }
+    time.Sleep(50 * time.Millisecond)
+    atomic.AddInt32(running, -1)
+    return lineMap(key, value)
+  }
+  return &Job{Name: name, Input: TextInput{[]string{name}},
+              NMap: n, NReduce: 2, Map: slowMap, Reduce: countReduce}
+}
+
+func TestSlots(t *testing.T) {
+  fmt.Printf("Test: A worker runs tasks in its slots ...\n")
+  var running, max int32
+  job := slowJob("mrtmp.slots-test", 40, &running, &max)
+  mr := MakeMapReduceJob(job, port("master"))
+  wk := MakeJobWorker(job)
+  wk.Slots = 4
+  go wk.Run(transport.Unix, mr.MasterAddress, port("worker0"), -1)
+  <- mr.DoneChannel
+  if m := atomic.LoadInt32(&max); m < 2 || m > 4 {
+    t.Fatalf("%v map tasks at once on a worker with 4 slots", m)
+  }
+  if out := output(t, job.Name); len(out) != 40 {
+    t.Fatalf("%v keys in the output, not 40", len(out))
+  }
+  cleanup(mr)
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestLabels(t *testing.T) {
+  fmt.Printf("Test: Tasks run only on workers with the job's labels ...\n")
+  file := makeInput()
+  job := &Job{Name: file, Input: TextInput{[]string{file}},
+              NMap: nMap, NReduce: nReduce, Map: lineMap, Reduce: ReduceFunc,
+              Labels: []string{"ssd"}}
+  mr := MakeMapReduceJob(job, port("master"))
+  var calls int32
+  unlabeled := &Job{
+    Map: func(key string, value string) *list.List {
+      atomic.AddInt32(&calls, 1)
+      return lineMap(key, value)
+    },
+    Reduce: func(key string, values *list.List) string {
+      atomic.AddInt32(&calls, 1)
+      return ReduceFunc(key, values)
+    },
+  }
+  go MakeJobWorker(unlabeled).Run(transport.Unix, mr.MasterAddress,
+                                  port("worker0"), -1)
+  for i := 1; i < 3; i++ {
+    wk := MakeJobWorker(job)
+    wk.Labels = []string{"hdd", "ssd"}
+    go wk.Run(transport.Unix, mr.MasterAddress,
+              port("worker" + strconv.Itoa(i)), -1)
+  }
+  <- mr.DoneChannel
+  check(t, mr.file)
+  if n := atomic.LoadInt32(&calls); n != 0 {
+    t.Fatalf("%v calls on the worker without the job's labels", n)
+  }
+  cleanup(mr)
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestDrain(t *testing.T) {
+  fmt.Printf("Test: Drain a worker in the middle of a job ...\n")
+  var running, max int32
+  job := slowJob("mrtmp.drain-test", 40, &running, &max)
+  mr := MakeMapReduceJob(job, port("master"))
+  var calls int32
+  drained := &Job{
+    Map: func(key string, value string) *list.List {
+      atomic.AddInt32(&calls, 1)
+      return job.Map(key, value)
+    },
+    Reduce: job.Reduce,
+  }
+  w0 := port("worker0")
+  exited := make(chan bool)
+  go func() {
+    wk := MakeJobWorker(drained)
+    wk.Slots = 2
+    wk.Run(transport.Unix, mr.MasterAddress, w0, -1)
+    exited <- true
+  }()
+  go RunJobWorker(mr.MasterAddress, port("worker1"), job, -1)
+  // a split can hold two lines, so it takes five
+  // calls to be sure of three jobs.
+  for atomic.LoadInt32(&calls) < 5 {
+    time.Sleep(10 * time.Millisecond)
+  }
+  n, err := DrainWorker(w0)
+  if err != nil || n < 3 {
+    t.Fatalf("DrainWorker: %v jobs, %v", n, err)
+  }
+  select {
+  case <-exited:
+  case <-time.After(2 * time.Second):
+    t.Fatalf("drained worker still running")
+  }
+  after := atomic.LoadInt32(&calls)
+  <- mr.DoneChannel
+  if n := atomic.LoadInt32(&calls); n != after {
+    t.Fatalf("%v map calls on the worker after it was drained", n - after)
+  }
+  if out := output(t, job.Name); len(out) != 40 {
+    t.Fatalf("%v keys in the output, not 40", len(out))
+  }
+  cleanup(mr)
+  fmt.Printf("  ... Passed\n")
+}
+
+// Map for a word count: each word of the line, with a count of 1.
+func wordMap(key string, value string) *list.List {
+  res := list.New()
+  for _, w := range strings.Fields(value) {
+    res.PushBack(KeyValue{w, "1"})
+  }
+  return res
+}
+
+// Map for the second stage of a top-K: every word and its count go
+// to the same key.
+func topMap(key string, value string) *list.List {
+  n, _ := strconv.Atoi(value)
+  res := list.New()
+  res.PushBack(KeyValue{"top", fmt.Sprintf("%08d %s", n, key)})
+  return res
+}
+
+// The words of the 3 values that sort last.
+func topReduce(key string, values *list.List) string {
+  var all []string
+  for e := values.Front(); e != nil; e = e.Next() {
+    all = append(all, e.Value.(string))
+  }
+  sort.Sort(sort.Reverse(sort.StringSlice(all)))
+  var top []string
+  for _, v := range all[:3] {
+    top = append(top, strings.Fields(v)[1])
+  }
+  return strings.Join(top, " ")
+}
+
+func TestPipeline(t *testing.T) {
+  fmt.Printf("Test: Pipeline of a word count and a top-K ...\n")
+  name := "mrtmp.pipeline-test"
+  defer os.Remove(name)
+  // word w<i> appears i times.
+  data := ""
+  for i := 1; i <= 50; i++ {
+    for j := 0; j < i; j++ {
+      data += "w" + strconv.Itoa(i) + " "
+    }
+    data += "\n"
+  }
+  os.WriteFile(name, []byte(data), 0666)
+
+  p := &Pipeline{Name: "pipeline-out", Stages: []*Job{
+    {Input: TextInput{[]string{name}}, NMap: 10, NReduce: 5,
+     Map: wordMap, Reduce: sumReduce, Combine: sumReduce},
+    {NMap: 5, NReduce: 1, Map: topMap, Reduce: topReduce,
+     Encoding: JSON},
+  }}
+  mr := MakePipeline(p, port("master"))
+  for i := 0; i < 2; i++ {
+    go RunPipelineWorker(mr.MasterAddress, port("worker" + strconv.Itoa(i)),
+                         p, -1)
+  }
+  <- mr.DoneChannel
+  if mr.Err != nil {
+    t.Fatalf("pipeline failed: %v", mr.Err)
+  }
+  checkWorker(t, mr.stats)
+  if out := output(t, p.Name); out["top"] != "w50 w49 w48" {
+    t.Fatalf("top 3 words %q, not \"w50 w49 w48\"", out["top"])
+  }
+  if len(mr.StageCounters) != 2 ||
+     mr.StageCounters[1][MapInputRecords] != 50 {
+    t.Fatalf("stage counters %v", mr.StageCounters)
+  }
+  if left, _ := filepath.Glob("mrtmp." + p.Name + "-*"); len(left) > 0 {
+    t.Fatalf("stages' files not removed: %v", left)
+  }
+  mr.CleanupFiles()
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Pipeline failures say which stage ...\n")
+  p.Stages[0].Input = TextInput{[]string{"mrtmp.no-such-file"}}
+  mr = MakePipeline(p, port("master"))
+  go RunPipelineWorker(mr.MasterAddress, port("worker0"), p, -1)
+  <- mr.DoneChannel
+  if e, ok := mr.Err.(*StageError); !ok || e.Stage != 0 {
+    t.Fatalf("Err %v, not a failure of stage 0", mr.Err)
+  }
+  p.Stages[0].Input = TextInput{[]string{name}}
+  p.Stages[1].Input = TextInput{[]string{name}}
+  mr = MakePipeline(p, port("master"))
+  go RunPipelineWorker(mr.MasterAddress, port("worker0"), p, -1)
+  <- mr.DoneChannel
+  if e, ok := mr.Err.(*StageError); !ok || e.Stage != 1 {
+    t.Fatalf("Err %v, not a failure of stage 1", mr.Err)
+  }
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestRegistry(t *testing.T) {
+  fmt.Printf("Test: Registered wc runs on registry workers ...\n")
+  file := makeInput()
+  job := &Job{Name: file, Input: TextInput{[]string{file}},
+              NMap: nMap, NReduce: nReduce, Funcs: "wc"}
+  mr := MakeMapReduceJob(job, port("master"))
+  for i := 0; i < 2; i++ {
+    go RunRegistryWorker(mr.MasterAddress, port("worker" + strconv.Itoa(i)), -1)
+  }
+  <- mr.DoneChannel
+  checkWorker(t, mr.stats)
+  out := output(t, file)
+  if len(out) != nNumber || out["4711"] != "1" {
+    t.Fatalf("wc: %v words, %q for 4711", len(out), out["4711"])
+  }
+  cleanup(mr)
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Registered index and grep ...\n")
+  var files []string
+  for i, text := range []string{"a b c\n", "b c\nd\n", "c\n"} {
+    name := "mrtmp.registry-" + strconv.Itoa(i)
+    os.WriteFile(name, []byte(text), 0666)
+    defer os.Remove(name)
+    files = append(files, name)
+  }
+  job = &Job{Name: "registry-index", Input: FileInput{files},
+             NMap: 3, NReduce: 2, Funcs: "index"}
+  mr = RunSingleJob(job)
+  out = output(t, job.Name)
+  if out["b"] != "2 " + files[0] + "," + files[1] ||
+     out["d"] != "1 " + files[1] {
+    t.Fatalf("index: %v", out)
+  }
+  mr.CleanupFiles()
+
+  master := port("master")
+  s := StartService(master, nil)
+  go RunServiceWorker(master, port("worker0"), nil, -1)
+  file = makeInput()
+  input := TextInput{[]string{file}}
+  if _, err := SubmitJob(master, &SubmitJobArgs{Name: "registry-grep",
+      Input: input, NMap: 1, NReduce: 1, Funcs: "grep", FuncsArg: "("});
+      err == nil {
+    t.Fatalf("grep with a bad pattern accepted")
+  }
+  id, err := SubmitJob(master, &SubmitJobArgs{Name: "registry-grep",
+                       Input: input, NMap: 5, NReduce: 2, Funcs: "grep",
+                       FuncsArg: "^99"})
+  if err != nil {
+    t.Fatalf("SubmitJob: %v", err)
+  }
+  if st := waitJob(t, master, id); st.State != Done {
+    t.Fatalf("grep: %+v", st)
+  }
+  // 99, 990-999, 9900-9999 and 99000-99999.
+  if out = output(t, "registry-grep"); len(out) != 1111 {
+    t.Fatalf("grep: %v matches, not 1111", len(out))
+  }
+  RemoveFile("mrtmp.registry-grep")
+  s.Kill()
+  RemoveFile(file)
+  fmt.Printf("  ... Passed\n")
+}
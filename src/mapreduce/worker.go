@@ -1,21 +1,55 @@
 package mapreduce
 
 import "fmt"
+import "io"
 import "os"
 import "log"
+import "path/filepath"
 import "net/rpc"
 import "net"
 import "container/list"
+import "context"
+import "errors"
+import "sync"
+import "time"
+import "transport"
 
 // Worker is a server waiting for DoJob or Shutdown RPCs
+//
+// A Worker with a Dir keeps the outputs of the map jobs it runs
+// there, rather than in the current directory, which is otherwise
+// assumed to be shared by the master and all the workers. It serves
+// them to the workers running reduce jobs with its Fetch RPC, until
+// the master tells it to remove them; if it fails before then, the
+// master runs its map jobs again elsewhere. Workers with and without
+// a Dir can work on the same job.
+//
+// A Worker runs up to Slots jobs at once, and tells the master its
+// Labels, so that jobs that need them run on it. It serves until the
+// master shuts it down, or until it is drained (see DrainWorker()):
+// then it turns down new jobs, finishes the ones it's running, and
+// leaves.
 
 type Worker struct {
-	name   string
-	Reduce func(string, *list.List) string
-	Map    func(string) *list.List
-	nRPC   int
-	nJobs  int
-	l      net.Listener
+	name    string
+	Reduce  Reducer
+	Map     Mapper
+	Combine Reducer          // nil if the job has no Combiner
+	Dir     string           // local storage for map outputs; "" if none
+	Slots   int              // how many jobs to run at once; one if 0
+	Labels  []string         // for jobs to ask for (see Job)
+	funcs   map[string]Funcs // a service worker's, by name
+	nRPC    int              // RPCs left before we fail, for tests; -1 if no limit
+	l       net.Listener
+	t       transport.Transport
+	master  string
+
+	mu       sync.Mutex
+	cond     *sync.Cond // signalled when a DoJob call returns
+	nJobs    int
+	running  int  // DoJob calls in progress
+	draining bool // finishing the jobs we're running, to leave
+	shutdown bool // the master has told us to Shutdown, or we've drained
 }
 
 // The master sent us a job
@@ -23,70 +57,438 @@ func (wk *Worker) DoJob(arg *DoJobArgs, res *DoJobReply) error {
 	fmt.Printf("Dojob %s job %d file %s operation %v N %d\n",
 		wk.name, arg.JobNumber, arg.File, arg.Operation,
 		arg.NumOtherPhase)
+	if !wk.count() {
+		return errFailed
+	}
+	wk.mu.Lock()
+	if wk.draining {
+		// the master hasn't heard yet.
+		wk.mu.Unlock()
+		res.Draining = true
+		return nil
+	}
+	wk.running++
+	wk.mu.Unlock()
+	defer func() {
+		wk.mu.Lock()
+		wk.running--
+		wk.cond.Broadcast()
+		wk.mu.Unlock()
+	}()
+
+	f := Funcs{wk.Map, wk.Reduce, wk.Combine}
+	if arg.Funcs != "" {
+		var ok bool
+		if f, ok = wk.funcs[arg.Funcs]; !ok {
+			var err error
+			if f, err = LookupFuncs(arg.Funcs, arg.FuncsArg); err != nil {
+				res.Err = fmt.Sprintf("worker %s: %v", wk.name, err)
+				return nil
+			}
+		}
+	}
+	if f.Map == nil {
+		res.Err = fmt.Sprintf("worker %s only runs jobs that name their Funcs",
+			wk.name)
+		return nil
+	}
+
 	switch arg.Operation {
 	case Map:
-		DoMap(arg.JobNumber, arg.File, arg.NumOtherPhase, wk.Map)
+		res.Counters = doMap(arg, wk.Dir, f.Map, f.Combine)
+		if wk.Dir != "" {
+			res.Host = wk.name
+		}
 	case Reduce:
-		DoReduce(arg.JobNumber, arg.File, arg.NumOtherPhase, wk.Reduce)
+		inputs, fetched, missing := wk.gather(arg)
+		if len(missing) == 0 {
+			res.Counters, res.Missing = doReduce(arg, inputs, f.Reduce)
+		} else {
+			res.Missing = missing
+		}
+		for _, name := range fetched {
+			os.Remove(name)
+		}
+		if len(res.Missing) > 0 {
+			fmt.Printf("DoJob: reduce %d missing map outputs %v\n",
+				arg.JobNumber, res.Missing)
+			return nil
+		}
 	}
 	res.OK = true
 	return nil
 }
 
+// Where to read each map job's output for reduce job arg: in the
+// shared directory, in ours, or fetched from the worker that has it
+// into a temporary file, which the caller must remove. Also returns
+// the fetched files, and the map jobs whose outputs couldn't be
+// fetched.
+func (wk *Worker) gather(arg *DoJobArgs) ([]string, []string, []int) {
+	var fetched []string
+	var missing []int
+	inputs := make([]string, arg.NumOtherPhase)
+	for m := range inputs {
+		name := ReduceName(arg.File, m, arg.JobNumber)
+		host := ""
+		if arg.Locations != nil {
+			host = arg.Locations[m]
+		}
+		switch host {
+		case "":
+			inputs[m] = name
+		case wk.name:
+			inputs[m] = filepath.Join(wk.Dir, name)
+		default:
+			tmp, err := fetch(wk.t, host, name, wk.Dir)
+			if err != nil {
+				fmt.Printf("DoJob: %v\n", err)
+				missing = append(missing, m)
+				continue
+			}
+			inputs[m] = tmp
+			fetched = append(fetched, tmp)
+		}
+	}
+	return inputs, fetched, missing
+}
+
+// Copy the map output called name from worker host into a new
+// temporary file in dir (or the system's temporary directory), and
+// return the file's name. A host that takes longer than FetchTimeout
+// to answer a Fetch fails the fetch, so that the master re-runs the
+// map task elsewhere rather than wait for the reduce task to time out.
+func fetch(t transport.Transport, host string, name string,
+	dir string) (string, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	file, err := createTemp(filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+	args := &FetchArgs{Name: name}
+	for {
+		var reply FetchReply
+		ctx, cancel := context.WithTimeout(context.Background(), FetchTimeout)
+		ok := transport.CallContext(ctx, t, host, "Worker.Fetch", args, &reply)
+		cancel()
+		if !ok || !reply.OK {
+			discard(file)
+			return "", fmt.Errorf("can't fetch %s from %s", name, host)
+		}
+		if _, err := file.Write(reply.Data); err != nil {
+			discard(file)
+			return "", err
+		}
+		args.Offset += int64(len(reply.Data))
+		if reply.EOF {
+			break
+		}
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// The most a Fetch RPC returns at once.
+const FetchChunk = 1 << 20
+
+// How long a worker waits for another to answer a Fetch.
+const FetchTimeout = 5 * time.Second
+
+// Another worker wants some of a map output in our Dir.
+func (wk *Worker) Fetch(args *FetchArgs, reply *FetchReply) error {
+	if wk.Dir == "" {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(wk.Dir, filepath.Base(args.Name)))
+	if err != nil {
+		fmt.Printf("Fetch: %v\n", err)
+		return nil
+	}
+	defer f.Close()
+	buf := make([]byte, FetchChunk)
+	n, err := f.ReadAt(buf, args.Offset)
+	if err != nil && err != io.EOF {
+		fmt.Printf("Fetch: %v\n", err)
+		return nil
+	}
+	reply.OK = true
+	reply.Data = buf[:n]
+	reply.EOF = err == io.EOF
+	return nil
+}
+
+// The master is done with some of the map outputs in our Dir.
+func (wk *Worker) RemoveOutputs(args *RemoveOutputsArgs,
+	reply *RemoveOutputsReply) error {
+	if !wk.count() {
+		return errFailed
+	}
+	for _, m := range args.Maps {
+		for r := 0; r < args.NReduce; r++ {
+			os.Remove(filepath.Join(wk.Dir, ReduceName(args.File, m, r)))
+		}
+	}
+	return nil
+}
+
+// Tell the master every HeartbeatInterval that we're alive,
+// and how many jobs we're running, until done is closed.
+func (wk *Worker) heartbeat(done chan bool) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(HeartbeatInterval):
+		}
+		if !wk.beat() {
+			return
+		}
+	}
+}
+
+// Send the master a heartbeat. If the master doesn't know us, because
+// it gave up on us or because it is a new master that took over the
+// job, register again. false if we're done with the master.
+func (wk *Worker) beat() bool {
+	wk.mu.Lock()
+	args := &HeartbeatArgs{wk.name, wk.running, wk.draining}
+	shutdown := wk.shutdown
+	wk.mu.Unlock()
+	if shutdown {
+		return false
+	}
+	var reply HeartbeatReply
+	ctx, cancel := context.WithTimeout(context.Background(), HeartbeatInterval)
+	ok := transport.CallContext(ctx, wk.t, wk.master, "MapReduce.Heartbeat",
+		args, &reply)
+	cancel()
+	if ok && !reply.OK && !args.Draining {
+		wk.register()
+	}
+	return true
+}
+
 // The master is telling us to shutdown. Report the number of Jobs we
 // have processed.
 func (wk *Worker) Shutdown(args *ShutdownArgs, res *ShutdownReply) error {
 	DPrintf("Shutdown %s\n", wk.name)
-	res.Njobs = wk.nJobs
+	if !wk.count() {
+		return errFailed
+	}
+	wk.mu.Lock()
+	wk.shutdown = true
+	res.Njobs = wk.nJobs - 1 // Don't count the shutdown RPC
+	wk.mu.Unlock()
 	res.OK = true
-	wk.nRPC = 1 // OK, because the same thread reads nRPC
-	wk.nJobs--  // Don't count the shutdown RPC
+	wk.l.Close() // ends Run(); this reply still goes out
 	return nil
 }
 
+// Someone wants us to leave: stop taking jobs, finish the ones we're
+// running, and then reply and stop serving. The master hears that
+// we're draining right away, so it sends us no more jobs.
+func (wk *Worker) Drain(args *DrainArgs, res *DrainReply) error {
+	fmt.Printf("Drain %s\n", wk.name)
+	if !wk.count() {
+		return errFailed
+	}
+	wk.mu.Lock()
+	wk.draining = true
+	wk.mu.Unlock()
+	wk.beat()
+
+	wk.mu.Lock()
+	for wk.running > 0 {
+		wk.cond.Wait()
+	}
+	wk.shutdown = true
+	res.Njobs = wk.nJobs - 1 // Don't count the drain RPC
+	wk.mu.Unlock()
+	res.OK = true
+	wk.l.Close()
+	return nil
+}
+
+// Drain the worker at address worker (see Worker.Drain), and return
+// how many RPCs it handled, once it has finished its jobs. A worker
+// that holds map outputs some job still needs takes them with it, so
+// the master runs those map jobs again.
+func DrainWorker(worker string) (int, error) {
+	return DrainWorkerOn(transport.Unix, worker)
+}
+
+func DrainWorkerOn(t transport.Transport, worker string) (int, error) {
+	var reply DrainReply
+	if !transport.Call(t, worker, "Worker.Drain", &DrainArgs{}, &reply) ||
+		!reply.OK {
+		return 0, fmt.Errorf("mapreduce: can't drain %s", worker)
+	}
+	return reply.Njobs, nil
+}
+
 // Tell the master we exist and ready to work
 func Register(master string, me string) {
+	RegisterOn(transport.Unix, master, me)
+}
+
+func RegisterOn(t transport.Transport, master string, me string) {
 	args := &RegisterArgs{}
 	args.Worker = me
+	registerOn(t, master, args)
+}
+
+func registerOn(t transport.Transport, master string, args *RegisterArgs) {
 	var reply RegisterReply
-	ok := call(master, "MapReduce.Register", args, &reply)
+	ok := transport.Call(t, master, "MapReduce.Register", args, &reply)
 	if ok == false {
 		fmt.Printf("Register: RPC %s register error\n", master)
 	}
 }
 
+// Register with our master, with our slots and labels.
+func (wk *Worker) register() {
+	registerOn(wk.t, wk.master, &RegisterArgs{wk.name, wk.Slots, wk.Labels})
+}
+
 // Set up a connection with the master, register with the master,
 // and wait for jobs from the master
 func RunWorker(MasterAddress string, me string,
 	MapFunc func(string) *list.List,
 	ReduceFunc func(string, *list.List) string, nRPC int) {
-	DPrintf("RunWorker %s\n", me)
+	RunWorkerOn(transport.Unix, MasterAddress, me, MapFunc, ReduceFunc, nRPC)
+}
+
+// Like RunWorker, but listen and reach the master through t.
+func RunWorkerOn(t transport.Transport, MasterAddress string, me string,
+	MapFunc func(string) *list.List,
+	ReduceFunc func(string, *list.List) string, nRPC int) {
+	job := &Job{Map: wholeSplit(MapFunc), Reduce: ReduceFunc}
+	RunJobWorkerOn(t, MasterAddress, me, job, nRPC)
+}
+
+// Like RunWorker, but for a Job: job.Map is called once per record
+// of the job's input, and job.Combine, if set, on the map output.
+// Only job's functions are used; the master has the rest.
+func RunJobWorker(MasterAddress string, me string, job *Job, nRPC int) {
+	RunJobWorkerOn(transport.Unix, MasterAddress, me, job, nRPC)
+}
+
+func RunJobWorkerOn(t transport.Transport, MasterAddress string, me string,
+	job *Job, nRPC int) {
+	MakeJobWorker(job).Run(t, MasterAddress, me, nRPC)
+}
+
+// A Worker for job, to set up (e.g. its Dir) before Run().
+func MakeJobWorker(job *Job) *Worker {
+	wk := new(Worker)
+	wk.Map = job.Map
+	wk.Reduce = job.Reduce
+	wk.Combine = job.Combine
+	return wk
+}
+
+// Like RunWorker, but for a Service, whose jobs can use any of funcs.
+// The worker stays in the Service's pool, from job to job, until it
+// has handled nRPC RPCs or the Service shuts it down.
+func RunServiceWorker(MasterAddress string, me string,
+	funcs map[string]Funcs, nRPC int) {
+	RunServiceWorkerOn(transport.Unix, MasterAddress, me, funcs, nRPC)
+}
+
+func RunServiceWorkerOn(t transport.Transport, MasterAddress string,
+	me string, funcs map[string]Funcs, nRPC int) {
+	MakeServiceWorker(funcs).Run(t, MasterAddress, me, nRPC)
+}
+
+// Like RunWorker, but for a Pipeline: the worker runs the tasks of
+// all of p's stages.
+func RunPipelineWorker(MasterAddress string, me string, p *Pipeline, nRPC int) {
+	RunPipelineWorkerOn(transport.Unix, MasterAddress, me, p, nRPC)
+}
+
+func RunPipelineWorkerOn(t transport.Transport, MasterAddress string,
+	me string, p *Pipeline, nRPC int) {
+	MakeServiceWorker(p.funcs()).Run(t, MasterAddress, me, nRPC)
+}
+
+// Like RunWorker, but for any job that names registered Funcs (see
+// registry.go), and only those.
+func RunRegistryWorker(MasterAddress string, me string, nRPC int) {
+	MakeRegistryWorker().Run(transport.Unix, MasterAddress, me, nRPC)
+}
+
+// A Worker for jobs that name registered Funcs, to set up before Run().
+func MakeRegistryWorker() *Worker {
+	return new(Worker)
+}
+
+// A Worker for a Service, to set up before Run().
+func MakeServiceWorker(funcs map[string]Funcs) *Worker {
 	wk := new(Worker)
+	wk.funcs = funcs
+	return wk
+}
+
+// What a worker that has failed (see count()) answers RPCs with.
+var errFailed = errors.New("mapreduce: worker failed")
+
+// Count an RPC from the master. A worker with an nRPC other than -1
+// fails once it has handled that many, as tests want: it stops
+// listening, and answers any RPC that got in anyway with errFailed.
+// Fetches from other workers don't count, so that failures are only
+// injected where the master sees them.
+func (wk *Worker) count() bool {
+	wk.mu.Lock()
+	defer wk.mu.Unlock()
+	if wk.nRPC == 0 {
+		return false
+	}
+	wk.nJobs++
+	if wk.nRPC > 0 {
+		wk.nRPC--
+		if wk.nRPC == 0 {
+			wk.l.Close() // ends Run(); this reply still goes out
+		}
+	}
+	return true
+}
+
+// Register with the master, and serve it (and the other workers) as
+// me until we've been shut down or drained, or, for tests, have
+// handled nRPC RPCs from the master (see count()).
+func (wk *Worker) Run(t transport.Transport, MasterAddress string,
+	me string, nRPC int) {
+	DPrintf("RunWorker %s\n", me)
 	wk.name = me
-	wk.Map = MapFunc
-	wk.Reduce = ReduceFunc
+	wk.t = t
+	wk.master = MasterAddress
 	wk.nRPC = nRPC
+	wk.cond = sync.NewCond(&wk.mu)
 	rpcs := rpc.NewServer()
 	rpcs.Register(wk)
-	os.Remove(me) // only needed for "unix"
-	l, e := net.Listen("unix", me)
+	l, e := t.Listen(me)
 	if e != nil {
 		log.Fatal("RunWorker: worker ", me, " error: ", e)
 	}
 	wk.l = l
-	Register(MasterAddress, me)
+	wk.register()
+	done := make(chan bool)
+	go wk.heartbeat(done)
 
-	// DON'T MODIFY CODE BELOW
-	for wk.nRPC != 0 {
+	// Shutdown, Drain and count() close the listener.
+	for {
 		conn, err := wk.l.Accept()
-		if err == nil {
-			wk.nRPC -= 1
-			go rpcs.ServeConn(conn)
-			wk.nJobs += 1
-		} else {
+		if err != nil {
 			break
 		}
+		go rpcs.ServeConn(conn)
 	}
 	wk.l.Close()
+	close(done)
 	DPrintf("RunWorker %s exit\n", me)
 }
@@ -0,0 +1,153 @@
+package paxos
+
+//
+// log-style proposals: Append(v) puts v into the next free
+// instance and returns that instance's seq, so applications
+// don't have to pick seqs and retry when another peer wins
+// the slot.
+//
+// values appended on one peer at about the same time are
+// batched into a single instance, whose decided value is a
+// Batch. up to window batches are in flight at once, each in
+// its own instance.
+//
+
+import "sync"
+import "time"
+import "crypto/rand"
+import "math/big"
+
+const (
+  DefaultWindow = 8
+  DefaultBatch = 32
+)
+
+//
+// the value of an instance filled by Append(). Id tells
+// the appending peer whether the instance it proposed
+// in was won by its own batch.
+//
+type Batch struct {
+  Id int64
+  Values []interface{}
+}
+
+type appendState struct {
+  mu sync.Mutex
+  queue []*appended
+  inflight int
+  window int
+  batch int
+  next int // lowest seq this peer may still append at
+}
+
+type appended struct {
+  v interface{}
+  seq chan int // gets the instance v landed in, or -1
+}
+
+func nrand() int64 {
+  max := big.NewInt(int64(1) << 62)
+  bigx, _ := rand.Int(rand.Reader, max)
+  return bigx.Int64()
+}
+
+//
+// set how many Append() batches may be in flight at
+// once, and the most values to put in one batch.
+//
+func (px *Paxos) SetPipeline(window int, batch int) {
+  px.app.mu.Lock()
+  defer px.app.mu.Unlock()
+  if window > 0 {
+    px.app.window = window
+  }
+  if batch > 0 {
+    px.app.batch = batch
+  }
+  px.pump()
+}
+
+//
+// agree on v in the next free instance. blocks until an
+// instance holding v is decided, and returns its seq;
+// that instance's value is a Batch with v among its
+// Values. returns false if the peer is killed first.
+//
+func (px *Paxos) Append(v interface{}) (int, bool) {
+  a := &appended{v, make(chan int, 1)}
+  px.app.mu.Lock()
+  px.app.queue = append(px.app.queue, a)
+  px.pump()
+  px.app.mu.Unlock()
+
+  seq := <-a.seq
+  return seq, seq >= 0
+}
+
+//
+// start proposing queued values while the window
+// has room. caller must hold px.app.mu.
+//
+func (px *Paxos) pump() {
+  for px.app.inflight < px.app.window && len(px.app.queue) > 0 {
+    n := len(px.app.queue)
+    if n > px.app.batch {
+      n = px.app.batch
+    }
+    items := px.app.queue[:n]
+    px.app.queue = px.app.queue[n:]
+    px.app.inflight++
+    go px.runBatch(items)
+  }
+}
+
+//
+// propose items as one Batch in successive free
+// instances until one of them is won.
+//
+func (px *Paxos) runBatch(items []*appended) {
+  b := Batch{Id: nrand()}
+  for _, a := range items {
+    b.Values = append(b.Values, a.v)
+  }
+
+  seq := -1
+  for px.dead == false && seq < 0 {
+    px.mu.Lock()
+    px.app.mu.Lock()
+    s := px.maxSeq + 1
+    if s < px.min() {
+      s = px.min()
+    }
+    if s < px.app.next {
+      s = px.app.next
+    }
+    px.app.next = s + 1
+    px.app.mu.Unlock()
+    px.mu.Unlock()
+
+    px.Start(s, b)
+    for px.dead == false {
+      decided, v := px.Wait(s, time.Second)
+      if decided {
+        if won, ok := v.(Batch); ok && won.Id == b.Id {
+          seq = s
+        }
+        break
+      }
+      if s < px.Min() {
+        break
+      }
+    }
+  }
+
+  for _, a := range items {
+    a.seq <- seq
+  }
+
+  px.app.mu.Lock()
+  px.app.inflight--
+  px.pump()
+  px.app.mu.Unlock()
+}
@@ -0,0 +1,329 @@
+package paxos
+
+//
+// group membership changes, committed through the log.
+//
+// a peer's id is its index in px.peers[], which lists every
+// peer that has ever been in the group, in the order the log
+// added them, so ids agree across peers. ids are what
+// ballots and Done() values are keyed by.
+//
+// a Reconfig value decided in instance s sets the voters and
+// learners for every instance from s+Alpha on. until then the
+// previous configuration stays in force, so instances already
+// in flight keep their quorums. voters answer Prepare and
+// Accept and make up quorums; learners are only told about
+// decisions, and catch up with Learn RPCs.
+//
+// once EnableReconfig() is called, a proposer won't run
+// instance seq until it knows every decision up to seq-Alpha,
+// since one of those might change who the voters for seq
+// are. it asks the other peers about instances it hasn't seen
+// decided, and fills any still-open ones with a nil proposal.
+// every peer must call EnableReconfig() before the first
+// Reconfigure().
+//
+// a new peer is started with Join() after Reconfigure() has
+// added it as a learner, and is made a voter with Promote()
+// once it has caught up.
+//
+
+import "net/rpc"
+import "time"
+import "encoding/gob"
+import "transport"
+
+// a Reconfig decided in instance s takes effect at s+Alpha.
+const Alpha = 16
+
+// ballots are n*maxPeers + id, so proposal numbers stay
+// unique as long as no more than maxPeers peers ever join.
+const maxPeers = 1 << 16
+
+//
+// the voters and learners, by id, for instances >= Start.
+//
+type Config struct {
+  Start int
+  Voters []int
+  Learners []int
+}
+
+//
+// the value that changes membership. applications propose
+// it with Reconfigure() and will see it in the decided
+// Batch, and should skip it.
+//
+type Reconfig struct {
+  Voters []string
+  Learners []string
+}
+
+type MembershipArgs struct {
+}
+
+type MembershipReply struct {
+  Peers []string
+  Configs []Config
+  Min int
+  Contiguous int // every instance up to here is decided at this peer
+}
+
+//
+// turn on the checks that make Reconfigure() safe.
+// every peer in the group must call it.
+//
+func (px *Paxos) EnableReconfig() {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  if px.reconfig {
+    return
+  }
+  px.reconfig = true
+
+  // keep contiguous moving even if nobody asks
+  // for old instances, so that learners catch up.
+  go func() {
+    for px.dead == false {
+      px.mu.Lock()
+      next := px.contiguous + 1
+      px.mu.Unlock()
+      px.catchUp(next)
+      time.Sleep(CatchUpInterval)
+    }
+  }()
+}
+
+//
+// propose a new set of voters and learners, by address.
+// returns the seq of the instance that holds the change;
+// it takes effect at seq+Alpha.
+//
+func (px *Paxos) Reconfigure(voters []string, learners []string) (int, bool) {
+  return px.Append(Reconfig{voters, learners})
+}
+
+//
+// the voters and learners of the newest configuration
+// this peer knows about.
+//
+func (px *Paxos) Members() ([]string, []string) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  c := px.configs[len(px.configs) - 1]
+  return px.addrs(c.Voters), px.addrs(c.Learners)
+}
+
+//
+// make learner addr a voter, once it has caught up to
+// within Alpha instances of this peer.
+//
+func (px *Paxos) Promote(addr string) (int, bool) {
+  for px.dead == false {
+    var reply MembershipReply
+    if px.call(addr, "Paxos.Membership", &MembershipArgs{}, &reply) {
+      px.mu.Lock()
+      caught := reply.Contiguous >= px.contiguous - Alpha
+      px.mu.Unlock()
+      if caught {
+        voters, learners := px.Members()
+        var rest []string
+        for _, a := range learners {
+          if a != addr {
+            rest = append(rest, a)
+          }
+        }
+        return px.Reconfigure(append(voters, addr), rest)
+      }
+    }
+    time.Sleep(CatchUpInterval)
+  }
+  return -1, false
+}
+
+//
+// the voters and learners, by id, for instance seq.
+// caller must hold px.mu.
+//
+func (px *Paxos) members(seq int) ([]int, []int) {
+  for i := len(px.configs) - 1; i > 0; i-- {
+    if px.configs[i].Start <= seq {
+      return px.configs[i].Voters, px.configs[i].Learners
+    }
+  }
+  return px.configs[0].Voters, px.configs[0].Learners
+}
+
+//
+// does instance seq have the same voters as instance seq0?
+// caller must hold px.mu.
+//
+func (px *Paxos) sameVoters(seq int, seq0 int) bool {
+  v, _ := px.members(seq)
+  v0, _ := px.members(seq0)
+  if len(v) != len(v0) {
+    return false
+  }
+  for i := range v {
+    if v[i] != v0[i] {
+      return false
+    }
+  }
+  return true
+}
+
+func (px *Paxos) addrs(ids []int) []string {
+  a := make([]string, len(ids))
+  for i, id := range ids {
+    a[i] = px.peers[id]
+  }
+  return a
+}
+
+//
+// the id for addr, adding it if it's new.
+// caller must hold px.mu.
+//
+func (px *Paxos) peerId(addr string) int {
+  for i, a := range px.peers {
+    if a == addr {
+      return i
+    }
+  }
+  px.peers = append(px.peers, addr)
+  px.dones = append(px.dones, -1)
+  return len(px.peers) - 1
+}
+
+//
+// move contiguous past every instance now known to be
+// decided, applying any membership changes in seq order.
+// caller must hold px.mu.
+//
+func (px *Paxos) advance() {
+  for {
+    inst, ok := px.instances[px.contiguous + 1]
+    if !ok || !inst.decided {
+      return
+    }
+    px.contiguous++
+    px.apply(px.contiguous, inst.va)
+  }
+}
+
+//
+// if the value decided in seq changes membership,
+// record the new configuration.
+// caller must hold px.mu.
+//
+func (px *Paxos) apply(seq int, v interface{}) {
+  var rc *Reconfig
+  switch x := v.(type) {
+  case Reconfig:
+    rc = &x
+  case Batch:
+    for _, y := range x.Values {
+      if r, ok := y.(Reconfig); ok {
+        rc = &r
+      }
+    }
+  }
+  if rc == nil || len(rc.Voters) == 0 {
+    return
+  }
+
+  c := Config{Start: seq + Alpha}
+  for _, old := range px.configs {
+    if old.Start == c.Start {
+      // already applied before a restart.
+      return
+    }
+  }
+  for _, a := range rc.Voters {
+    c.Voters = append(c.Voters, px.peerId(a))
+  }
+  for _, a := range rc.Learners {
+    c.Learners = append(c.Learners, px.peerId(a))
+  }
+  px.configs = append(px.configs, c)
+  px.warn("config", px.persistConfig())
+}
+
+//
+// before proposing in any instance past upto+Alpha, every
+// instance up to upto must be decided here. ask the other
+// peers about the open ones, and start a nil proposal in
+// any that still look open.
+//
+func (px *Paxos) fillTo(upto int) {
+  px.mu.Lock()
+  from := px.contiguous + 1
+  px.mu.Unlock()
+
+  for seq := from; seq <= upto; seq++ {
+    px.catchUp(seq)
+    px.mu.Lock()
+    inst, ok := px.instances[seq]
+    open := seq >= px.min() && (!ok || !inst.decided)
+    if open && !px.filling[seq] {
+      px.filling[seq] = true
+      go func(seq int) {
+        px.propose(seq, nil)
+        px.mu.Lock()
+        delete(px.filling, seq)
+        px.mu.Unlock()
+      }(seq)
+    }
+    px.mu.Unlock()
+  }
+}
+
+//
+// Membership RPC handler: tells a joining peer about
+// the group, and Promote() how far this peer has got.
+//
+func (px *Paxos) Membership(args *MembershipArgs, reply *MembershipReply) error {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  reply.Peers = append([]string{}, px.peers...)
+  reply.Configs = append([]Config{}, px.configs...)
+  reply.Min = px.min()
+  reply.Contiguous = px.contiguous
+  return nil
+}
+
+//
+// start a peer that has been added to an existing group
+// as a learner. peers[] are addresses of current members to
+// ask about the group; me is this peer's address. Join()
+// waits until some member knows that me has been added.
+//
+func Join(peers []string, me string, rpcs *rpc.Server) *Paxos {
+  return JoinOn(transport.Unix, peers, me, rpcs)
+}
+
+func JoinOn(t transport.Transport, peers []string, me string,
+            rpcs *rpc.Server) *Paxos {
+  gob.Register(Reconfig{})
+  for {
+    for _, srv := range peers {
+      var reply MembershipReply
+      if transport.Call(t, srv, "Paxos.Membership", &MembershipArgs{}, &reply) == false {
+        continue
+      }
+      for id, a := range reply.Peers {
+        if a != me {
+          continue
+        }
+        px := newPaxos(t, reply.Peers, id)
+        px.configs = reply.Configs
+        px.floor = reply.Min
+        px.contiguous = reply.Min - 1
+        px.EnableReconfig()
+        px.listen(rpcs)
+        return px
+      }
+    }
+    time.Sleep(CatchUpInterval)
+  }
+}
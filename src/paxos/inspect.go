@@ -0,0 +1,106 @@
+package paxos
+
+//
+// read-only introspection, for debugging a stalled group.
+//
+// px.Inspect(from, to) reports this peer's view of instances
+// from..to: what it has promised, what it has accepted, and
+// whether it knows the instance is decided, along with every
+// peer's Done() value as this peer last heard it.
+// InspectPeer() fetches the same thing from another peer
+// with a State RPC; see main/pxinspect.go.
+//
+
+import "fmt"
+import "transport"
+
+type InstanceInfo struct {
+  Seq int
+  Np int // highest proposal promised, or -1
+  Na int // highest proposal accepted, or -1
+  Va interface{} // value accepted with Na; nil over RPC
+  Text string // Va, formatted with %v
+  Decided bool
+}
+
+type PeerState struct {
+  Me int
+  Peers []string
+  Min int
+  Max int
+  Dones []int // last Done() value heard from each peer
+  Leader int // peer holding this one's range promise, or -1
+  Instances []InstanceInfo // only instances this peer has state for
+}
+
+type StateArgs struct {
+  From int
+  To int
+}
+
+type StateReply struct {
+  State PeerState
+}
+
+//
+// this peer's view of instances from..to.
+//
+func (px *Paxos) Inspect(from int, to int) PeerState {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  st := PeerState{}
+  st.Me = px.me
+  st.Peers = append([]string{}, px.peers...)
+  st.Min = px.min()
+  st.Max = px.maxSeq
+  st.Dones = append([]int{}, px.dones...)
+  st.Leader = px.leader
+  if from < st.Min {
+    from = st.Min
+  }
+  for seq := from; seq <= to && seq <= px.maxSeq; seq++ {
+    inst, ok := px.instances[seq]
+    np := px.promised(seq)
+    if !ok && np < 0 {
+      continue
+    }
+    info := InstanceInfo{Seq: seq, Np: np, Na: -1}
+    if ok {
+      info.Na = inst.na
+      info.Va = inst.va
+      info.Text = fmt.Sprintf("%v", inst.va)
+      info.Decided = inst.decided
+    }
+    st.Instances = append(st.Instances, info)
+  }
+  return st
+}
+
+//
+// ask the peer at srv for its view of instances from..to.
+//
+func InspectPeer(srv string, from int, to int) (PeerState, bool) {
+  return InspectPeerOn(transport.Unix, srv, from, to)
+}
+
+func InspectPeerOn(t transport.Transport, srv string,
+                   from int, to int) (PeerState, bool) {
+  args := &StateArgs{from, to}
+  var reply StateReply
+  ok := transport.Call(t, srv, "Paxos.State", args, &reply)
+  return reply.State, ok
+}
+
+//
+// State RPC handler.
+//
+func (px *Paxos) State(args *StateArgs, reply *StateReply) error {
+  reply.State = px.Inspect(args.From, args.To)
+  // the caller may not have the values' types
+  // registered with gob, so send only Text.
+  for i := range reply.State.Instances {
+    reply.State.Instances[i].Va = nil
+  }
+  return nil
+}
@@ -0,0 +1,424 @@
+package paxos
+
+//
+// distinguished-leader mode (Multi-Paxos).
+//
+// after EnableLeader(), peers elect a leader. a candidate
+// sends one PrepareRange covering every instance from the
+// lowest one it hasn't seen decided onwards; a majority of
+// OKs makes it leader for that range, and from then on it
+// runs only the Accept and Decided phases for new instances.
+// other peers forward Start() to the leader.
+//
+// the leader keeps its position with Heartbeat RPCs. each
+// acceptor that grants a range promise or a heartbeat also
+// grants a lease: it won't give a range promise to a
+// different candidate until the lease runs out. leases only
+// keep leadership stable; safety rests on proposal numbers
+// alone, so a stale leader's Accepts are simply rejected.
+//
+// whenever the fast path fails (no leader, lost leadership,
+// an instance below the leader's range or with different
+// voters, an Accept rejected by a higher classic Prepare),
+// the peer falls back to ordinary two-phase propose().
+//
+
+import "time"
+
+const (
+  LeaseTime = 1000 * time.Millisecond
+  HeartbeatInterval = 100 * time.Millisecond
+)
+
+type PrepareRangeArgs struct {
+  From int // first instance covered
+  N int
+  Me int
+  Done int
+}
+
+type RangeEntry struct {
+  Seq int
+  Na int
+  Va interface{}
+  Decided bool
+}
+
+type PrepareRangeReply struct {
+  OK bool
+  Np int // the acceptor's range promise after this call
+  Accepted []RangeEntry // instances >= From with an accepted value
+  Done int
+}
+
+type HeartbeatArgs struct {
+  N int
+  Me int
+  Dones []int // the leader's view of every peer's Done()
+}
+
+type HeartbeatReply struct {
+  OK bool
+  Np int
+  Done int
+}
+
+type ForwardArgs struct {
+  Seq int
+  V interface{}
+}
+
+type ForwardReply struct {
+  Decided bool
+  V interface{}
+}
+
+//
+// switch this peer to distinguished-leader mode.
+// every peer in the group should do the same.
+//
+func (px *Paxos) EnableLeader() {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  if px.leaderMode {
+    return
+  }
+  px.leaderMode = true
+  // behave as if a lease were just granted, so that at
+  // startup peers campaign in index order, not all at once.
+  px.leaseUntil = time.Now()
+  go func() {
+    for px.dead == false {
+      px.tick()
+      time.Sleep(HeartbeatInterval)
+    }
+  }()
+}
+
+//
+// is this peer the leader, as far as it knows?
+// caller must hold px.mu.
+//
+func (px *Paxos) isLeader() bool {
+  if px.leading && time.Now().After(px.leadUntil) {
+    px.leading = false
+  }
+  return px.leading
+}
+
+//
+// heartbeat if leader; otherwise campaign once the
+// current leader's lease has run out. peers wait
+// longer the higher their index, to avoid duels.
+//
+func (px *Paxos) tick() {
+  px.mu.Lock()
+  leader := px.isLeader()
+  wait := px.leaseUntil.Add(time.Duration(px.me) * LeaseTime / 2)
+  campaign := !leader && time.Now().After(wait)
+  px.mu.Unlock()
+
+  if leader {
+    px.heartbeat()
+  } else if campaign {
+    px.campaign()
+  }
+}
+
+func (px *Paxos) heartbeat() {
+  px.mu.Lock()
+  n := px.leadN
+  dones := make([]int, len(px.dones))
+  copy(dones, px.dones)
+  voters, learners := px.members(px.leadFrom)
+  px.mu.Unlock()
+
+  // followers mostly talk only to the leader, so the
+  // leader relays everyone's Done() values, learners'
+  // included.
+  start := time.Now()
+  nok := 0
+  for k, ids := range [][]int{voters, learners} {
+    for _, i := range ids {
+      args := &HeartbeatArgs{n, px.me, dones}
+      var reply HeartbeatReply
+      if px.callPeer(i, "Paxos.Heartbeat", args, &reply) {
+        px.noteDone(i, reply.Done)
+        if reply.OK && k == 0 {
+          nok++
+        }
+      }
+    }
+  }
+
+  // without a majority the lease just runs out, and
+  // isLeader() notices. the leader's lease is timed from
+  // before the heartbeats went out, so it expires no later
+  // than any acceptor's.
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  if px.leadN == n && nok > len(voters) / 2 {
+    px.leadUntil = start.Add(LeaseTime)
+  }
+}
+
+//
+// try to become leader for every instance from the
+// lowest one this peer hasn't seen decided.
+//
+func (px *Paxos) campaign() {
+  px.mu.Lock()
+  from := px.min()
+  for {
+    inst, ok := px.instances[from]
+    if !ok || !inst.decided {
+      break
+    }
+    from++
+  }
+  highest := px.rangeNp
+  if px.leadN > highest {
+    highest = px.leadN
+  }
+  n := (highest / maxPeers + 1) * maxPeers + px.me
+  voters, _ := px.members(from)
+  done := px.dones[px.me]
+  px.mu.Unlock()
+
+  start := time.Now()
+  nok := 0
+  highest = n
+  na := make(map[int]int)
+  values := make(map[int]interface{})
+  decided := make(map[int]bool)
+  for _, i := range voters {
+    args := &PrepareRangeArgs{from, n, px.me, done}
+    var reply PrepareRangeReply
+    if px.callPeer(i, "Paxos.PrepareRange", args, &reply) == false {
+      continue
+    }
+    px.noteDone(i, reply.Done)
+    if reply.Np > highest {
+      highest = reply.Np
+    }
+    if reply.OK == false {
+      continue
+    }
+    nok++
+    for _, e := range reply.Accepted {
+      if decided[e.Seq] {
+        continue
+      }
+      old, ok := na[e.Seq]
+      if e.Decided || !ok || e.Na > old {
+        na[e.Seq] = e.Na
+        values[e.Seq] = e.Va
+        decided[e.Seq] = e.Decided
+      }
+    }
+  }
+
+  px.mu.Lock()
+  if nok <= len(voters) / 2 {
+    // remember the highest number seen, so the
+    // next attempt picks a higher one.
+    if highest > px.leadN {
+      px.leadN = highest
+    }
+    px.mu.Unlock()
+    return
+  }
+  px.leading = true
+  px.leadN = n
+  px.leadFrom = from
+  px.leadUntil = start.Add(LeaseTime)
+  px.leadValues = values
+  px.mu.Unlock()
+
+  // finish off whatever earlier leaders left
+  // accepted but not known to be decided.
+  for seq, v := range values {
+    go px.leaderAccept(seq, v)
+  }
+}
+
+//
+// Start() in leader mode: propose directly if leader,
+// forward to the leader if there is one, and otherwise
+// fall back to two-phase Paxos. a forwarding peer keeps
+// asking until it learns the outcome, since the leader's
+// Decided message may be lost.
+//
+func (px *Paxos) startLeader(seq int, v interface{}) {
+  backoff := 10 * time.Millisecond
+  for px.dead == false {
+    px.mu.Lock()
+    inst, ok := px.instances[seq]
+    if seq < px.min() || (ok && inst.decided) {
+      px.mu.Unlock()
+      return
+    }
+    leading := px.isLeader()
+    leader := px.leader
+    forward := !leading && leader >= 0 && leader != px.me &&
+      time.Now().Before(px.leaseUntil)
+    px.mu.Unlock()
+
+    if leading {
+      px.leaderAccept(seq, v)
+      return
+    }
+    if !forward {
+      break
+    }
+    args := &ForwardArgs{seq, v}
+    var reply ForwardReply
+    if px.call(px.peers[leader], "Paxos.Forward", args, &reply) == false {
+      break
+    }
+    if reply.Decided {
+      px.learn(seq, reply.V)
+      return
+    }
+    time.Sleep(backoff)
+    if backoff < LeaseTime / 4 {
+      backoff *= 2
+    }
+  }
+  px.propose(seq, v)
+}
+
+//
+// as leader, run just the Accept phase for seq.
+//
+func (px *Paxos) leaderAccept(seq int, v interface{}) {
+  px.mu.Lock()
+  inst, ok := px.instances[seq]
+  if seq < px.min() || (ok && inst.decided) {
+    px.mu.Unlock()
+    return
+  }
+  if !px.isLeader() || seq < px.leadFrom || !px.sameVoters(seq, px.leadFrom) ||
+     (px.reconfig && seq - Alpha > px.contiguous) {
+    px.mu.Unlock()
+    px.propose(seq, v)
+    return
+  }
+  // never propose two values for one
+  // instance under the same number.
+  if old, ok := px.leadValues[seq]; ok {
+    v = old
+  } else {
+    px.leadValues[seq] = v
+  }
+  n := px.leadN
+  voters, learners := px.members(seq)
+  done := px.dones[px.me]
+  px.mu.Unlock()
+
+  nok := 0
+  for _, i := range voters {
+    args := &AcceptArgs{seq, n, v, px.me, done}
+    var reply AcceptReply
+    if px.callPeer(i, "Paxos.Accept", args, &reply) {
+      px.noteDone(i, reply.Done)
+      if reply.OK {
+        nok++
+      }
+    }
+  }
+
+  if nok <= len(voters) / 2 {
+    px.propose(seq, v)
+    return
+  }
+  px.broadcastDecided(seq, v, done, voters, learners)
+}
+
+//
+// PrepareRange RPC handler: a candidate asks for a promise
+// covering every instance >= args.From.
+//
+func (px *Paxos) PrepareRange(args *PrepareRangeArgs, reply *PrepareRangeReply) error {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  px.updateDone(args.Me, args.Done)
+  reply.Done = px.dones[px.me]
+  reply.Np = px.rangeNp
+
+  if args.N <= px.rangeNp {
+    return nil
+  }
+  if args.Me != px.leader && time.Now().Before(px.leaseUntil) {
+    return nil
+  }
+
+  // widening the range is always safe; narrowing it
+  // would break the earlier promise for the gap.
+  from, np := px.rangeFrom, px.rangeNp
+  if px.rangeNp < 0 || args.From < px.rangeFrom {
+    px.rangeFrom = args.From
+  }
+  px.rangeNp = args.N
+  if err := px.persistRange(); err != nil {
+    // the promise isn't on disk, so it isn't made.
+    px.rangeFrom, px.rangeNp = from, np
+    return err
+  }
+  px.leader = args.Me
+  px.leaseUntil = time.Now().Add(LeaseTime)
+
+  reply.OK = true
+  reply.Np = px.rangeNp
+  for seq, inst := range px.instances {
+    if seq >= args.From && (inst.na >= 0 || inst.decided) {
+      reply.Accepted = append(reply.Accepted,
+        RangeEntry{seq, inst.na, inst.va, inst.decided})
+    }
+  }
+  return nil
+}
+
+//
+// Heartbeat RPC handler: the leader renews its lease.
+//
+func (px *Paxos) Heartbeat(args *HeartbeatArgs, reply *HeartbeatReply) error {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  for i := 0; i < len(args.Dones) && i < len(px.dones); i++ {
+    px.updateDone(i, args.Dones[i])
+  }
+  reply.Done = px.dones[px.me]
+  reply.Np = px.rangeNp
+  if args.N == px.rangeNp && args.Me == px.leader {
+    px.leaseUntil = time.Now().Add(LeaseTime)
+    reply.OK = true
+  }
+  return nil
+}
+
+//
+// Forward RPC handler: another peer wants agreement on
+// args.Seq and thinks we are the leader. if we already
+// know the outcome, hand it back.
+//
+func (px *Paxos) Forward(args *ForwardArgs, reply *ForwardReply) error {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  if args.Seq < px.min() {
+    return nil
+  }
+  if inst, ok := px.instances[args.Seq]; ok && inst.decided {
+    reply.Decided = true
+    reply.V = inst.va
+    return nil
+  }
+  if args.Seq > px.maxSeq {
+    px.maxSeq = args.Seq
+  }
+  go px.leaderAccept(args.Seq, args.V)
+  return nil
+}
@@ -0,0 +1,214 @@
+package paxos
+
+//
+// push-style notification of decisions, so applications
+// need not poll Status() in a sleep loop.
+//
+// Wait(seq, timeout) blocks until this peer learns that seq
+// is decided. Decisions(from) returns a channel that yields
+// every decided instance from seq from onwards, in order and
+// without gaps, until the application calls the stop function
+// it also returns. if the peer seems to have missed a decision
+// that its peers know about (it has heard of later instances
+// but this one is still open), the delivery thread asks the
+// other peers for the outcome with a Learn RPC rather than
+// waiting for someone to call Start() on it.
+//
+
+import "time"
+import "sync"
+
+// how long Decisions() waits on an open instance
+// before asking the other peers about it.
+const CatchUpInterval = 100 * time.Millisecond
+
+type Decision struct {
+  Seq int
+  Value interface{}
+}
+
+type LearnArgs struct {
+  Seq int
+  Me int
+  Done int
+}
+
+type LearnReply struct {
+  Decided bool
+  V interface{}
+  Forgotten bool
+  Done int
+}
+
+//
+// wait until instance seq is decided, is forgotten, the
+// peer is killed, or timeout passes, whichever is first.
+// returns the same thing Status(seq) would at that point.
+//
+func (px *Paxos) Wait(seq int, timeout time.Duration) (bool, interface{}) {
+  px.mu.Lock()
+  if inst, ok := px.instances[seq]; ok && inst.decided {
+    v := inst.va
+    px.mu.Unlock()
+    return true, v
+  }
+  if seq < px.min() || px.dead {
+    px.mu.Unlock()
+    return false, nil
+  }
+  ch := make(chan bool)
+  px.waiters[seq] = append(px.waiters[seq], ch)
+  px.mu.Unlock()
+
+  timer := time.NewTimer(timeout)
+  select {
+  case <-ch:
+    timer.Stop()
+  case <-timer.C:
+    px.mu.Lock()
+    ws := px.waiters[seq]
+    for i := range ws {
+      if ws[i] == ch {
+        px.waiters[seq] = append(ws[:i], ws[i+1:]...)
+        break
+      }
+    }
+    if len(px.waiters[seq]) == 0 {
+      delete(px.waiters, seq)
+    }
+    px.mu.Unlock()
+  }
+  return px.Status(seq)
+}
+
+//
+// release everyone waiting on seq.
+// caller must hold px.mu.
+//
+func (px *Paxos) wake(seq int) {
+  for _, ch := range px.waiters[seq] {
+    close(ch)
+  }
+  delete(px.waiters, seq)
+}
+
+//
+// returns a channel carrying each decided instance
+// from seq from onwards, in seq order, and a function
+// that stops the deliveries, for an application that
+// stops reading. instances covered by a snapshot
+// installed meanwhile (see snapshot.go) are skipped.
+// the channel is closed once stopped, if the peer is
+// killed, or if the next instance is forgotten before
+// it could be delivered (which can't happen if the
+// application calls Done() only for instances it has
+// received).
+//
+func (px *Paxos) Decisions(from int) (<-chan Decision, func()) {
+  ch := make(chan Decision)
+  stopped := make(chan bool)
+  var once sync.Once
+  stop := func() {
+    once.Do(func() { close(stopped) })
+  }
+  go func() {
+    defer close(ch)
+    for seq := from; ; seq++ {
+      for {
+        decided, v := px.Wait(seq, CatchUpInterval)
+        if decided {
+          select {
+          case ch <- Decision{seq, v}:
+          case <-stopped:
+            return
+          case <-px.killed:
+            return
+          }
+          break
+        }
+        select {
+        case <-stopped:
+          return
+        default:
+        }
+        if px.dead {
+          return
+        }
+        if seq < px.Min() {
+          // skip what an installed snapshot covers.
+          snap := px.Snapshotted()
+          if snap < seq {
+            return
+          }
+          seq = snap
+          break
+        }
+        px.catchUp(seq)
+      }
+    }
+  }()
+  return ch, stop
+}
+
+//
+// if other peers have moved past seq, ask
+// them whether it was decided.
+//
+func (px *Paxos) catchUp(seq int) {
+  px.mu.Lock()
+  behind := px.maxSeq > seq
+  done := px.dones[px.me]
+  px.mu.Unlock()
+  if !behind {
+    return
+  }
+
+  for i := 0; i < len(px.peers); i++ {
+    if i == px.me {
+      continue
+    }
+    args := &LearnArgs{seq, px.me, done}
+    var reply LearnReply
+    if px.call(px.peers[i], "Paxos.Learn", args, &reply) {
+      px.noteDone(i, reply.Done)
+      if reply.Decided {
+        px.learn(seq, reply.V)
+        return
+      }
+      if reply.Forgotten && px.fetchSnapshot(i) {
+        return
+      }
+    }
+  }
+}
+
+//
+// record a decision heard about from another peer.
+//
+func (px *Paxos) learn(seq int, v interface{}) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  if seq < px.min() {
+    return
+  }
+  px.decide(seq, v)
+}
+
+//
+// Learn RPC handler: another peer wants to know
+// whether seq was decided.
+//
+func (px *Paxos) Learn(args *LearnArgs, reply *LearnReply) error {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  px.updateDone(args.Me, args.Done)
+  reply.Done = px.dones[px.me]
+  if args.Seq < px.min() {
+    reply.Forgotten = true
+  } else if inst, ok := px.instances[args.Seq]; ok && inst.decided {
+    reply.Decided = true
+    reply.V = inst.va
+  }
+  return nil
+}
@@ -6,79 +6,151 @@ package paxos
 // a Paxos peer.
 //
 // Manages a sequence of agreed-on values.
-// The set of peers is fixed.
+// The set of peers is fixed unless the application turns on
+// membership changes (see config.go).
 // Copes with network failures (partition, msg loss, &c).
-// Does not store anything persistently, so cannot handle crash+restart.
+// A peer made with Make() and a directory keeps its acceptor
+// state and Done() value in a write-ahead log there, written
+// before it replies, and picks up where it left off when
+// restarted. A peer made without one stores nothing
+// persistently, so cannot handle crash+restart.
 //
 // The application interface:
 //
-// px = paxos.Make(peers []string, me string)
+// px = paxos.Make(peers []string, me string, rpcs, dir string) -- dir "" for none
+// px = paxos.MakeOn(t transport.Transport, peers, me, rpcs, dir)
 // px.Start(seq int, v interface{}) -- start agreement on new instance
 // px.Status(seq int) (decided bool, v interface{}) -- get info about an instance
 // px.Done(seq int) -- ok to forget all instances <= seq
 // px.Max() int -- highest instance seq known, or -1
 // px.Min() int -- instances before this seq have been forgotten
+// px.EnableLeader() -- switch to distinguished-leader mode (see leader.go)
+// px.Wait(seq int, timeout) (decided bool, v interface{}) -- block until decided
+// px.Decisions(from int) (<-chan Decision, stop func()) -- decided instances, in order
+// px.Append(v interface{}) (seq int, ok bool) -- agree on v in the next free instance
+// px.EnableReconfig() -- allow membership changes (see config.go)
+// px.Reconfigure(voters, learners []string) (seq int, ok bool) -- change membership
+// px = paxos.Join(peers []string, me string, rpcs) -- start a newly added learner
+// px.Promote(addr string) (seq int, ok bool) -- make a caught-up learner a voter
+// px.SetSnapshot(save, install) -- let lagging peers catch up from a snapshot
+// px.Inspect(from, to int) PeerState -- this peer's view, for debugging
 //
 
 import "net"
 import "net/rpc"
 import "log"
-import "os"
-import "syscall"
 import "sync"
 import "fmt"
 import "math/rand"
+import "time"
+import "encoding/gob"
+import "transport"
 
 
 type Paxos struct {
   mu sync.Mutex
   l net.Listener
   dead bool
+  killed chan bool // closed by Kill()
+  killOnce sync.Once
   unreliable bool
   rpcCount int
-  peers []string
+  peers []string // every peer ever in the group; see config.go
   me int // index into peers[]
+  transport transport.Transport
 
+  instances map[int]*instance // seq -> acceptor/learner state
+  dones []int // highest Done() argument heard from each peer
+  maxSeq int // highest seq this peer has heard of
+  log *wal // nil unless made with a directory
+  waiters map[int][]chan bool // closed when seq is decided or forgotten
+  app appendState // see append.go
 
-  // Your data here.
+  // membership state; see config.go.
+  reconfig bool
+  configs []Config // in order of Start; configs[0].Start is 0
+  contiguous int // every instance <= contiguous is decided here
+  floor int // Min() never goes below this
+  filling map[int]bool // instances with a nil proposal running
+
+  // application snapshots; see snapshot.go.
+  save func() (int, []byte)
+  install func(int, []byte)
+  snapSeq int // newest snapshot installed here
+  fetching bool
+
+  // distinguished-leader state; see leader.go.
+  leaderMode bool
+  rangeFrom int // as acceptor, promised rangeNp for every seq >= rangeFrom
+  rangeNp int
+  leader int // peer holding our range promise, or -1
+  leaseUntil time.Time // promise no other leader before this
+  leading bool // as proposer, do we hold a majority range promise?
+  leadN int
+  leadFrom int
+  leadUntil time.Time
+  leadValues map[int]interface{} // values proposed at leadN, by seq
 }
 
 //
-// call() sends an RPC to the rpcname handler on server srv
-// with arguments args, waits for the reply, and leaves the
-// reply in reply. the reply argument should be a pointer
-// to a reply structure.
-//
-// the return value is true if the server responded, and false
-// if call() was not able to contact the server. in particular,
-// the replys contents are only valid if call() returned true.
+// acceptor and learner state for one instance.
+// once decided, va holds the agreed value.
 //
-// you should assume that call() will time out and return an
-// error after a while if it does not get a reply from the server.
+type instance struct {
+  np int // highest prepare seen
+  na int // highest accept seen
+  va interface{} // value accepted with na
+  decided bool
+}
+
 //
-// please use call() to send all RPCs, in client.go and server.go.
-// please do not change this function.
+// RPC arguments and replies. every message carries the
+// sender's index and its highest Done() argument, so that
+// peers learn each other's Done() values as a side effect
+// of ordinary agreement.
 //
-func call(srv string, name string, args interface{}, reply interface{}) bool {
-  c, err := rpc.Dial("unix", srv)
-  if err != nil {
-    err1 := err.(*net.OpError)
-    if err1.Err != syscall.ENOENT && err1.Err != syscall.ECONNREFUSED {
-      fmt.Printf("paxos Dial() failed: %v\n", err1)
-    }
-    return false
-  }
-  defer c.Close()
-    
-  err = c.Call(name, args, reply)
-  if err == nil {
-    return true
-  }
+type PrepareArgs struct {
+  Seq int
+  N int
+  Me int
+  Done int
+}
 
-  fmt.Println(err)
-  return false
+type PrepareReply struct {
+  OK bool
+  Np int
+  Na int
+  Va interface{}
+  Forgotten bool // Seq is below the acceptor's Min()
+  Done int
 }
 
+type AcceptArgs struct {
+  Seq int
+  N int
+  V interface{}
+  Me int
+  Done int
+}
+
+type AcceptReply struct {
+  OK bool
+  Np int
+  Done int
+}
+
+type DecidedArgs struct {
+  Seq int
+  V interface{}
+  Me int
+  Done int
+}
+
+type DecidedReply struct {
+  Done int
+}
+
+
 
 //
 // the application wants paxos to start agreement on
@@ -88,7 +160,362 @@ func call(srv string, name string, args interface{}, reply interface{}) bool {
 // is reached.
 //
 func (px *Paxos) Start(seq int, v interface{}) {
-  // Your code here.
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  if seq < px.min() {
+    return
+  }
+  if seq > px.maxSeq {
+    px.maxSeq = seq
+  }
+  if px.leaderMode {
+    go px.startLeader(seq, v)
+  } else {
+    go px.propose(seq, v)
+  }
+}
+
+//
+// call the rpcname handler on peer i, short-circuiting
+// the network when i is this peer.
+//
+func (px *Paxos) callPeer(i int, name string, args interface{}, reply interface{}) bool {
+  if i != px.me {
+    return px.call(px.peers[i], name, args, reply)
+  }
+  var err error
+  switch name {
+  case "Paxos.Prepare":
+    err = px.Prepare(args.(*PrepareArgs), reply.(*PrepareReply))
+  case "Paxos.Accept":
+    err = px.Accept(args.(*AcceptArgs), reply.(*AcceptReply))
+  case "Paxos.Decided":
+    err = px.Decided(args.(*DecidedArgs), reply.(*DecidedReply))
+  case "Paxos.PrepareRange":
+    err = px.PrepareRange(args.(*PrepareRangeArgs), reply.(*PrepareRangeReply))
+  case "Paxos.Heartbeat":
+    err = px.Heartbeat(args.(*HeartbeatArgs), reply.(*HeartbeatReply))
+  default:
+    log.Fatal("callPeer: unknown rpc ", name)
+  }
+  return err == nil
+}
+
+func (px *Paxos) call(srv string, name string, args interface{}, reply interface{}) bool {
+  return transport.Call(px.transport, srv, name, args, reply)
+}
+
+//
+// drive instance seq to a decision, proposing v if no
+// value has been accepted yet. gives up once the
+// instance is decided or forgotten, or the peer is killed.
+//
+func (px *Paxos) propose(seq int, v interface{}) {
+  highest := -1
+  backoff := 10 * time.Millisecond
+
+  for px.dead == false {
+    px.mu.Lock()
+    inst, ok := px.instances[seq]
+    if seq < px.min() || (ok && inst.decided) {
+      px.mu.Unlock()
+      return
+    }
+    if px.reconfig && seq - Alpha > px.contiguous {
+      // an earlier instance might change who votes on seq.
+      px.mu.Unlock()
+      px.fillTo(seq - Alpha)
+      time.Sleep(time.Duration(rand.Int63() % int64(backoff)))
+      if backoff < time.Second {
+        backoff *= 2
+      }
+      continue
+    }
+    if np := px.promised(seq); np > highest {
+      highest = np
+    }
+    voters, learners := px.members(seq)
+    done := px.dones[px.me]
+    px.mu.Unlock()
+
+    // pick a proposal number higher than any seen,
+    // and unique to this peer.
+    n := (highest / maxPeers + 1) * maxPeers + px.me
+
+    nok := 0
+    na := -1
+    va := v
+    for _, i := range voters {
+      args := &PrepareArgs{seq, n, px.me, done}
+      var reply PrepareReply
+      if px.callPeer(i, "Paxos.Prepare", args, &reply) {
+        px.noteDone(i, reply.Done)
+        if reply.Forgotten && i != px.me && px.fetchSnapshot(i) {
+          // this peer is behind the group's Min().
+          return
+        }
+        if reply.OK {
+          nok++
+          if reply.Na > na {
+            na = reply.Na
+            va = reply.Va
+          }
+        }
+        if reply.Np > highest {
+          highest = reply.Np
+        }
+      }
+    }
+
+    if nok > len(voters) / 2 {
+      nok = 0
+      for _, i := range voters {
+        args := &AcceptArgs{seq, n, va, px.me, done}
+        var reply AcceptReply
+        if px.callPeer(i, "Paxos.Accept", args, &reply) {
+          px.noteDone(i, reply.Done)
+          if reply.OK {
+            nok++
+          }
+          if reply.Np > highest {
+            highest = reply.Np
+          }
+        }
+      }
+
+      if nok > len(voters) / 2 {
+        px.broadcastDecided(seq, va, done, voters, learners)
+        return
+      }
+    }
+
+    // lost to a competing proposer, or could not reach
+    // a majority. back off for a random interval so that
+    // dueling proposers eventually let one of them win.
+    time.Sleep(time.Duration(rand.Int63() % int64(backoff)))
+    if backoff < time.Second {
+      backoff *= 2
+    }
+  }
+}
+
+//
+// tell voters and learners that seq was decided with v.
+//
+func (px *Paxos) broadcastDecided(seq int, v interface{}, done int,
+                                  voters []int, learners []int) {
+  for _, ids := range [][]int{voters, learners} {
+    for _, i := range ids {
+      args := &DecidedArgs{seq, v, px.me, done}
+      var reply DecidedReply
+      if px.callPeer(i, "Paxos.Decided", args, &reply) {
+        px.noteDone(i, reply.Done)
+      }
+    }
+  }
+}
+
+//
+// Prepare RPC handler.
+//
+func (px *Paxos) Prepare(args *PrepareArgs, reply *PrepareReply) error {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  px.updateDone(args.Me, args.Done)
+  reply.Done = px.dones[px.me]
+  if args.Seq < px.min() {
+    reply.Forgotten = true
+    return nil
+  }
+
+  inst := px.instance(args.Seq)
+  if args.N > px.promised(args.Seq) {
+    // the promise must be on disk before it is made.
+    next := *inst
+    next.np = args.N
+    if err := px.persist(args.Seq, &next); err != nil {
+      return err
+    }
+    *inst = next
+    reply.OK = true
+    reply.Na = inst.na
+    reply.Va = inst.va
+  }
+  reply.Np = px.promised(args.Seq)
+  return nil
+}
+
+//
+// Accept RPC handler.
+//
+func (px *Paxos) Accept(args *AcceptArgs, reply *AcceptReply) error {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  px.updateDone(args.Me, args.Done)
+  reply.Done = px.dones[px.me]
+  if args.Seq < px.min() {
+    return nil
+  }
+
+  inst := px.instance(args.Seq)
+  if args.N >= px.promised(args.Seq) {
+    next := *inst
+    next.np = args.N
+    next.na = args.N
+    next.va = args.V
+    if err := px.persist(args.Seq, &next); err != nil {
+      return err
+    }
+    *inst = next
+    reply.OK = true
+  }
+  reply.Np = px.promised(args.Seq)
+  return nil
+}
+
+//
+// Decided RPC handler: a proposer tells us the
+// outcome of an instance.
+//
+func (px *Paxos) Decided(args *DecidedArgs, reply *DecidedReply) error {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+
+  px.updateDone(args.Me, args.Done)
+  reply.Done = px.dones[px.me]
+  if args.Seq < px.min() {
+    return nil
+  }
+
+  return px.decide(args.Seq, args.V)
+}
+
+//
+// record that seq was decided with value v, and wake
+// anyone waiting for it. caller must hold px.mu.
+//
+func (px *Paxos) decide(seq int, v interface{}) error {
+  inst := px.instance(seq)
+  if inst.decided {
+    return nil
+  }
+  inst.decided = true
+  inst.va = v
+  err := px.persist(seq, inst)
+  px.wake(seq)
+  px.advance()
+  return err
+}
+
+//
+// the highest proposal number this acceptor has promised
+// for seq, counting a leader's promise over a range of
+// instances. caller must hold px.mu.
+//
+func (px *Paxos) promised(seq int) int {
+  np := -1
+  if inst, ok := px.instances[seq]; ok {
+    np = inst.np
+  }
+  if seq >= px.rangeFrom && px.rangeNp > np {
+    np = px.rangeNp
+  }
+  return np
+}
+
+//
+// find or create the state for instance seq.
+// caller must hold px.mu.
+//
+func (px *Paxos) instance(seq int) *instance {
+  inst, ok := px.instances[seq]
+  if !ok {
+    inst = &instance{np: -1, na: -1}
+    px.instances[seq] = inst
+  }
+  if seq > px.maxSeq {
+    px.maxSeq = seq
+  }
+  return inst
+}
+
+func (px *Paxos) noteDone(peer int, done int) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  px.updateDone(peer, done)
+}
+
+//
+// record peer's Done() value and forget any instances
+// that everyone is now done with.
+// caller must hold px.mu.
+//
+func (px *Paxos) updateDone(peer int, done int) {
+  if peer >= len(px.dones) {
+    // a new member we haven't heard about yet.
+    return
+  }
+  if done > px.dones[peer] {
+    px.dones[peer] = done
+    px.forget()
+  }
+}
+
+//
+// free instances below Min(). caller must hold px.mu.
+//
+func (px *Paxos) forget() {
+  min := px.min()
+  for seq := range px.instances {
+    if seq < min {
+      delete(px.instances, seq)
+    }
+  }
+  for seq := range px.leadValues {
+    if seq < min {
+      delete(px.leadValues, seq)
+    }
+  }
+  for seq := range px.waiters {
+    if seq < min {
+      px.wake(seq)
+    }
+  }
+  if px.contiguous < min - 1 {
+    px.contiguous = min - 1
+    px.advance()
+  }
+  if px.log != nil && px.log.nrecords > 2 * len(px.instances) + walSlack {
+    px.checkpoint()
+  }
+}
+
+//
+// Min() without locking. caller must hold px.mu.
+//
+func (px *Paxos) min() int {
+  // only members of the configurations for instances this
+  // peer hasn't seen decided yet count; peers removed
+  // before then no longer need anything.
+  min := px.dones[px.me]
+  for i, c := range px.configs {
+    if i + 1 < len(px.configs) && px.configs[i + 1].Start <= px.contiguous + 1 {
+      continue
+    }
+    for _, ids := range [][]int{c.Voters, c.Learners} {
+      for _, id := range ids {
+        if px.dones[id] < min {
+          min = px.dones[id]
+        }
+      }
+    }
+  }
+  if min + 1 > px.floor {
+    px.floor = min + 1
+  }
+  return px.floor
 }
 
 //
@@ -98,7 +525,13 @@ func (px *Paxos) Start(seq int, v interface{}) {
 // see the comments for Min() for more explanation.
 //
 func (px *Paxos) Done(seq int) {
-  // Your code here.
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  if seq > px.dones[px.me] {
+    px.dones[px.me] = seq
+    px.warn("Done", px.persistDones())
+    px.forget()
+  }
 }
 
 //
@@ -107,8 +540,9 @@ func (px *Paxos) Done(seq int) {
 // this peer.
 //
 func (px *Paxos) Max() int {
-  // Your code here.
-  return 0
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  return px.maxSeq
 }
 
 //
@@ -140,8 +574,9 @@ func (px *Paxos) Max() int {
 // instances.
 // 
 func (px *Paxos) Min() int {
-  // You code here.
-  return 0
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  return px.min()
 }
 
 //
@@ -152,7 +587,15 @@ func (px *Paxos) Min() int {
 // it should not contact other Paxos peers.
 //
 func (px *Paxos) Status(seq int) (bool, interface{}) {
-  // Your code here.
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  if seq < px.min() {
+    return false, nil
+  }
+  inst, ok := px.instances[seq]
+  if ok && inst.decided {
+    return true, inst.va
+  }
   return false, nil
 }
 
@@ -164,24 +607,90 @@ func (px *Paxos) Status(seq int) (bool, interface{}) {
 //
 func (px *Paxos) Kill() {
   px.dead = true
+  px.killOnce.Do(func() { close(px.killed) })
   if px.l != nil {
     px.l.Close()
   }
+  px.mu.Lock()
+  if px.log != nil {
+    px.log.close()
+  }
+  for seq := range px.waiters {
+    px.wake(seq)
+  }
+  px.mu.Unlock()
 }
 
 //
 // the application wants to create a paxos peer.
 // the ports of all the paxos peers (including this one)
 // are in peers[]. this servers port is peers[me].
+// the peer keeps its acceptor state in a write-ahead
+// log in directory dir, and recovers from it if a
+// previous incarnation of this peer left one behind;
+// an empty dir means keep everything in memory.
 //
-func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
+func Make(peers []string, me int, rpcs *rpc.Server, dir string) *Paxos {
+  return MakeOn(transport.Unix, peers, me, rpcs, dir)
+}
+
+//
+// like Make(), but reach the other peers, and listen
+// if rpcs is nil, through t rather than Unix sockets.
+//
+func MakeOn(t transport.Transport, peers []string, me int,
+            rpcs *rpc.Server, dir string) *Paxos {
+  px := newPaxos(t, peers, me)
+
+  if dir != "" {
+    w, err := openWAL(dir)
+    if err != nil {
+      log.Fatal("paxos wal: ", err)
+    }
+    px.log = w
+    if err := px.recover(); err != nil {
+      log.Fatal("paxos recover: ", err)
+    }
+  }
+
+  px.listen(rpcs)
+  return px
+}
+
+func newPaxos(t transport.Transport, peers []string, me int) *Paxos {
   px := &Paxos{}
-  px.peers = peers
+  px.transport = t
+  px.peers = append([]string{}, peers...)
   px.me = me
+  px.instances = make(map[int]*instance)
+  px.dones = make([]int, len(peers))
+  for i := range px.dones {
+    px.dones[i] = -1
+  }
+  px.maxSeq = -1
+  px.killed = make(chan bool)
+  px.rangeNp = -1
+  px.leader = -1
+  px.leadValues = make(map[int]interface{})
+  px.waiters = make(map[int][]chan bool)
+  px.app.window = DefaultWindow
+  px.app.batch = DefaultBatch
+  gob.Register(Batch{})
+  gob.Register(Reconfig{})
 
+  c := Config{Start: 0}
+  for i := range peers {
+    c.Voters = append(c.Voters, i)
+  }
+  px.configs = []Config{c}
+  px.contiguous = -1
+  px.filling = make(map[int]bool)
+  px.snapSeq = -1
+  return px
+}
 
-  // Your initialization code here.
-
+func (px *Paxos) listen(rpcs *rpc.Server) {
+  me := px.me
   if rpcs != nil {
     // caller will create socket &c
     rpcs.Register(px)
@@ -190,9 +699,7 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
     rpcs.Register(px)
 
     // prepare to receive connections from clients.
-    // change "unix" to "tcp" to use over a network.
-    os.Remove(peers[me]) // only needed for "unix"
-    l, e := net.Listen("unix", peers[me]);
+    l, e := px.transport.Listen(px.peers[me]);
     if e != nil {
       log.Fatal("listen error: ", e);
     }
@@ -211,9 +718,7 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
             conn.Close()
           } else if px.unreliable && (rand.Int63() % 1000) < 200 {
             // process the request but force discard of reply.
-            c1 := conn.(*net.UnixConn)
-            f, _ := c1.File()
-            err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
+            err := transport.CloseWrite(conn)
             if err != nil {
               fmt.Printf("shutdown: %v\n", err)
             }
@@ -232,7 +737,4 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
       }
     }()
   }
-
-
-  return px
 }
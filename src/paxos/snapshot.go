@@ -0,0 +1,140 @@
+package paxos
+
+//
+// application snapshots, so a peer that has fallen behind
+// Min() (say, one restarted without its state) can catch up.
+//
+// the application registers two callbacks with SetSnapshot():
+//
+// save() (seq int, data []byte) -- the application's state
+//   after applying every instance <= seq
+// install(seq int, data []byte) -- replace the application's
+//   state with one that save() returned on some peer
+//
+// when another peer says it has forgotten an instance this
+// peer asked about, either in a Prepare reply or in the
+// catch-up that Decisions() does, this peer fetches a
+// snapshot from it with a Snapshot RPC and hands it to
+// install(). afterwards Min() is above the snapshot's seq,
+// and Decisions() carries on from the instance after it.
+//
+// paxos calls both callbacks without holding its own lock,
+// so they may call into the Paxos peer.
+//
+
+type SnapshotArgs struct {
+  Me int
+  Done int
+}
+
+type SnapshotReply struct {
+  OK bool
+  Seq int
+  Data []byte
+  Peers []string // membership as of the snapshot; see config.go
+  Configs []Config
+  Done int
+}
+
+//
+// register the application's snapshot callbacks.
+//
+func (px *Paxos) SetSnapshot(save func() (int, []byte),
+                             install func(int, []byte)) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  px.save = save
+  px.install = install
+}
+
+//
+// the seq of the newest snapshot installed here, or -1.
+//
+func (px *Paxos) Snapshotted() int {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  return px.snapSeq
+}
+
+//
+// fetch a snapshot from peer and install it. returns
+// true if this peer moved forward as a result.
+//
+func (px *Paxos) fetchSnapshot(peer int) bool {
+  px.mu.Lock()
+  if px.install == nil || px.fetching {
+    px.mu.Unlock()
+    return false
+  }
+  px.fetching = true
+  done := px.dones[px.me]
+  px.mu.Unlock()
+
+  defer func() {
+    px.mu.Lock()
+    px.fetching = false
+    px.mu.Unlock()
+  }()
+
+  args := &SnapshotArgs{px.me, done}
+  var reply SnapshotReply
+  if px.call(px.peers[peer], "Paxos.Snapshot", args, &reply) == false {
+    return false
+  }
+  px.noteDone(peer, reply.Done)
+
+  px.mu.Lock()
+  stale := !reply.OK || reply.Seq < px.min()
+  px.mu.Unlock()
+  if stale {
+    return false
+  }
+
+  px.install(reply.Seq, reply.Data)
+
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  if len(reply.Configs) > len(px.configs) {
+    for _, a := range reply.Peers {
+      px.peerId(a)
+    }
+    px.configs = reply.Configs
+    px.warn("config", px.persistConfig())
+  }
+  if reply.Seq > px.snapSeq {
+    px.snapSeq = reply.Seq
+  }
+  // the application has everything up to reply.Seq.
+  if reply.Seq > px.dones[px.me] {
+    px.dones[px.me] = reply.Seq
+    px.warn("Done", px.persistDones())
+  }
+  if reply.Seq + 1 > px.floor {
+    px.floor = reply.Seq + 1
+  }
+  px.forget()
+  return true
+}
+
+//
+// Snapshot RPC handler: a lagging peer wants
+// the application's state.
+//
+func (px *Paxos) Snapshot(args *SnapshotArgs, reply *SnapshotReply) error {
+  px.mu.Lock()
+  px.updateDone(args.Me, args.Done)
+  save := px.save
+  px.mu.Unlock()
+
+  if save != nil {
+    reply.Seq, reply.Data = save()
+    reply.OK = true
+  }
+
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  reply.Peers = append([]string{}, px.peers...)
+  reply.Configs = append([]Config{}, px.configs...)
+  reply.Done = px.dones[px.me]
+  return nil
+}
@@ -7,6 +7,8 @@ import "os"
 import "time"
 import "fmt"
 import "math/rand"
+import "sync"
+import "transport"
 
 func port(tag string, host int) string {
   s := "/var/tmp/824-"
@@ -87,7 +89,7 @@ func noTestSpeed(t *testing.T) {
     pxh[i] = port("time", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, "")
   }
 
   t0 := time.Now()
@@ -113,7 +115,7 @@ func TestBasic(t *testing.T) {
     pxh[i] = port("basic", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, "")
   }
 
   fmt.Printf("Test: Single proposer ...\n")
@@ -173,7 +175,7 @@ func TestDeaf(t *testing.T) {
     pxh[i] = port("deaf", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, "")
   }
 
   fmt.Printf("Test: Deaf proposer ...\n")
@@ -216,7 +218,7 @@ func TestForget(t *testing.T) {
     pxh[i] = port("gc", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, "")
   }
 
   fmt.Printf("Test: Forgetting ...\n")
@@ -298,7 +300,7 @@ func TestManyForget(t *testing.T) {
     pxh[i] = port("manygc", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, "")
     pxa[i].unreliable = true
   }
 
@@ -367,7 +369,7 @@ func TestForgetMem(t *testing.T) {
     pxh[i] = port("gcmem", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, "")
   }
 
   pxa[0].Start(0, "x")
@@ -431,7 +433,7 @@ func TestRPCCount(t *testing.T) {
     pxh[i] = port("count", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, "")
   }
 
   ninst1 := 5
@@ -506,7 +508,7 @@ func TestMany(t *testing.T) {
     pxh[i] = port("many", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, "")
     pxa[i].Start(0, 0)
   }
 
@@ -556,20 +558,20 @@ func TestOld(t *testing.T) {
     pxh[i] = port("old", i)
   }
 
-  pxa[1] = Make(pxh, 1, nil)
-  pxa[2] = Make(pxh, 2, nil)
-  pxa[3] = Make(pxh, 3, nil)
+  pxa[1] = Make(pxh, 1, nil, "")
+  pxa[2] = Make(pxh, 2, nil, "")
+  pxa[3] = Make(pxh, 3, nil, "")
   pxa[1].Start(1, 111)
 
   waitmajority(t, pxa, 1)
 
-  pxa[0] = Make(pxh, 0, nil)
+  pxa[0] = Make(pxh, 0, nil, "")
   pxa[0].Start(1, 222)
 
   waitn(t, pxa, 1, 4)
 
   if false {
-    pxa[4] = Make(pxh, 4, nil)
+    pxa[4] = Make(pxh, 4, nil, "")
     waitn(t, pxa, 1, npaxos)
   }
 
@@ -593,7 +595,7 @@ func TestManyUnreliable(t *testing.T) {
     pxh[i] = port("manyun", i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, "")
     pxa[i].unreliable = true
     pxa[i].Start(0, 0)
   }
@@ -685,7 +687,7 @@ func TestPartition(t *testing.T) {
         pxh[j] = pp(tag, i, j)
       }
     }
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, "")
   }
   defer part(t, tag, npaxos, []int{}, []int{}, []int{})
 
@@ -787,7 +789,7 @@ func TestLots(t *testing.T) {
         pxh[j] = pp(tag, i, j)
       }
     }
-    pxa[i] = Make(pxh, i, nil)
+    pxa[i] = Make(pxh, i, nil, "")
     pxa[i].unreliable = true
   }
   defer part(t, tag, npaxos, []int{}, []int{}, []int{})
@@ -872,3 +874,657 @@ func TestLots(t *testing.T) {
 
   fmt.Printf("  ... Passed\n")
 }
+
+func TestRestart(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  var dirs []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("restart", i)
+    dirs[i] = port("restart-dir", i)
+    os.RemoveAll(dirs[i])
+    defer os.RemoveAll(dirs[i])
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil, dirs[i])
+  }
+
+  fmt.Printf("Test: Restarted peer remembers decisions ...\n")
+
+  for seq := 0; seq < 5; seq++ {
+    pxa[seq % npaxos].Start(seq, seq * 10)
+    waitn(t, pxa, seq, npaxos)
+  }
+
+  pxa[2].Kill()
+  pxa[2] = nil
+
+  // a crash in the middle of an append leaves a torn record.
+  f, err := os.OpenFile(dirs[2] + "/paxos-log", os.O_WRONLY|os.O_APPEND, 0666)
+  if err != nil {
+    t.Fatalf("open log: %v", err)
+  }
+  f.Write([]byte{0x40, 0, 0, 0, 1, 2, 3})
+  f.Close()
+
+  pxa[2] = Make(pxh, 2, nil, dirs[2])
+  for seq := 0; seq < 5; seq++ {
+    decided, v := pxa[2].Status(seq)
+    if !decided || v != seq * 10 {
+      t.Fatalf("restarted peer lost seq %v; decided=%v v=%v", seq, decided, v)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Restarted peer rejoins agreement ...\n")
+
+  pxa[0].Kill()
+  pxa[0] = nil
+
+  pxa[1].Start(5, "after")
+  waitn(t, pxa, 5, npaxos - 1)
+
+  pxa[2].Kill()
+  pxa[2] = Make(pxh, 2, nil, dirs[2])
+  pxa[2].mu.Lock()
+  inst, ok := pxa[2].instances[5]
+  pxa[2].mu.Unlock()
+  if !ok || inst.np < 0 || inst.na < 0 {
+    t.Fatalf("restarted peer forgot its promise for seq 5")
+  }
+
+  pxa[2].Start(6, "again")
+  waitn(t, pxa, 6, npaxos - 1)
+
+  fmt.Printf("  ... Passed\n")
+  fmt.Printf("Test: No promise without a log write ...\n")
+
+  // the log can't be written any more.
+  pxa[2].mu.Lock()
+  pxa[2].log.close()
+  pxa[2].mu.Unlock()
+  var preply PrepareReply
+  if pxa[2].Prepare(&PrepareArgs{Seq: 7, N: 1000, Me: 1, Done: -1}, &preply) == nil {
+    t.Fatalf("Prepare() succeeded without the log")
+  }
+  var areply AcceptReply
+  if pxa[2].Accept(&AcceptArgs{Seq: 8, N: 1000, V: "x", Me: 1, Done: -1}, &areply) == nil {
+    t.Fatalf("Accept() succeeded without the log")
+  }
+  pxa[2].mu.Lock()
+  np7, np8 := pxa[2].promised(7), pxa[2].promised(8)
+  pxa[2].mu.Unlock()
+  if np7 == 1000 || np8 == 1000 {
+    t.Fatalf("promised %v and %v without logging them", np7, np8)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestLeader(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("leader", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil, "")
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i].EnableLeader()
+  }
+
+  leader := func() (int, int) {
+    for i := 0; i < npaxos; i++ {
+      if pxa[i] != nil {
+        pxa[i].mu.Lock()
+        leading, n := pxa[i].isLeader(), pxa[i].leadN
+        pxa[i].mu.Unlock()
+        if leading {
+          return i, n
+        }
+      }
+    }
+    return -1, -1
+  }
+
+  fmt.Printf("Test: Leader skips the prepare phase ...\n")
+
+  time.Sleep(LeaseTime)
+  l, n := leader()
+  if l < 0 {
+    t.Fatalf("no leader elected")
+  }
+
+  seq := 0
+  for ; seq < 10; seq++ {
+    pxa[seq % npaxos].Start(seq, seq)
+    waitn(t, pxa, seq, npaxos)
+  }
+
+  // every instance was accepted under the leader's
+  // single proposal number.
+  for s := 0; s < seq; s++ {
+    pxa[l].mu.Lock()
+    na := pxa[l].instances[s].na
+    pxa[l].mu.Unlock()
+    if na != n {
+      t.Fatalf("seq %v accepted at %v, leader's n is %v", s, na, n)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: New leader after leader dies ...\n")
+
+  pxa[l].Kill()
+  pxa[l] = nil
+
+  for ; seq < 20; seq++ {
+    pxa[(l + 1 + seq % 2) % npaxos].Start(seq, seq)
+    waitn(t, pxa, seq, npaxos - 1)
+  }
+
+  time.Sleep(2 * LeaseTime)
+  if l1, _ := leader(); l1 < 0 {
+    t.Fatalf("no new leader after leader died")
+  }
+
+  for ; seq < 25; seq++ {
+    pxa[(l + 1) % npaxos].Start(seq, seq)
+    waitn(t, pxa, seq, npaxos - 1)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestDecisions(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("decisions", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil, "")
+  }
+
+  fmt.Printf("Test: Wait() ...\n")
+
+  if decided, _ := pxa[0].Wait(0, 100 * time.Millisecond); decided {
+    t.Fatalf("Wait() says undecided instance is decided")
+  }
+  go func() {
+    time.Sleep(100 * time.Millisecond)
+    pxa[1].Start(0, "zero")
+  }()
+  decided, v := pxa[0].Wait(0, 5 * time.Second)
+  if !decided || v != "zero" {
+    t.Fatalf("Wait() returned %v %v", decided, v)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Decisions() in order, with catch-up ...\n")
+
+  ch, stop := pxa[2].Decisions(0)
+
+  // peer 2 can't hear from anyone, so it misses
+  // the Decided messages for 1..9.
+  os.Remove(pxh[2])
+
+  const ninst = 10
+  for _, seq := range rand.Perm(ninst - 1) {
+    pxa[seq % 2].Start(seq + 1, seq + 1)
+  }
+  for seq := 1; seq < ninst; seq++ {
+    waitn(t, pxa, seq, npaxos - 1)
+  }
+  pxa[2].Start(ninst, ninst)
+
+  for seq := 0; seq <= ninst; seq++ {
+    select {
+    case d := <-ch:
+      if d.Seq != seq {
+        t.Fatalf("Decisions() delivered seq %v, expected %v", d.Seq, seq)
+      }
+      if seq > 0 && d.Value != seq {
+        t.Fatalf("Decisions() delivered value %v for seq %v", d.Value, seq)
+      }
+    case <-time.After(10 * time.Second):
+      t.Fatalf("Decisions() did not deliver seq %v", seq)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Decisions() stops when the reader does ...\n")
+
+  // nobody reads seq ninst+1 from ch, or anything from ch2.
+  ch2, stop2 := pxa[0].Decisions(0)
+  pxa[0].Start(ninst + 1, "unread")
+  waitn(t, pxa, ninst + 1, npaxos - 1)
+  time.Sleep(100 * time.Millisecond)
+  stop()
+  pxa[0].Kill()
+  for _, c := range []<-chan Decision{ch, ch2} {
+    timeout := time.After(5 * time.Second)
+    for open := true; open; {
+      select {
+      case _, open = <-c:
+        // whatever the goroutine had ready, then closed.
+      case <-timeout:
+        t.Fatalf("Decisions() goroutine still running")
+      }
+    }
+  }
+  stop2() // after Kill(), stopping does no harm.
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestAppend(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("append", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil, "")
+    pxa[i].SetPipeline(2, 8)
+  }
+
+  fmt.Printf("Test: Concurrent Append()s, batched ...\n")
+
+  const nper = 30
+  type result struct {
+    v int
+    seq int
+  }
+  ch := make(chan result)
+  for i := 0; i < npaxos; i++ {
+    for j := 0; j < nper; j++ {
+      go func(i int, v int) {
+        seq, ok := pxa[i].Append(v)
+        if !ok {
+          seq = -1
+        }
+        ch <- result{v, seq}
+      }(i, i * 1000 + j)
+    }
+  }
+
+  seen := map[int]bool{}
+  for k := 0; k < npaxos * nper; k++ {
+    r := <-ch
+    if r.seq < 0 {
+      t.Fatalf("Append(%v) failed", r.v)
+    }
+    decided, v := pxa[0].Wait(r.seq, 10 * time.Second)
+    if !decided {
+      t.Fatalf("seq %v returned by Append() isn't decided", r.seq)
+    }
+    found := false
+    for _, x := range v.(Batch).Values {
+      if x == r.v {
+        found = true
+      }
+    }
+    if !found {
+      t.Fatalf("Append(%v) returned seq %v, which doesn't hold it", r.v, r.seq)
+    }
+    seen[r.seq] = true
+  }
+
+  // with a window of 2, most values had to share an instance.
+  if len(seen) >= npaxos * nper {
+    t.Fatalf("no batching; %v values in %v instances", npaxos * nper, len(seen))
+  }
+  for seq := range seen {
+    _, v0 := pxa[0].Status(seq)
+    for i := 1; i < npaxos; i++ {
+      decided, v := pxa[i].Wait(seq, 10 * time.Second)
+      if !decided || v.(Batch).Id != v0.(Batch).Id {
+        t.Fatalf("peers disagree on seq %v", seq)
+      }
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestMembership(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 4
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("member", i)
+  }
+  for i := 0; i < 3; i++ {
+    pxa[i] = Make(pxh[0:3], i, nil, "")
+    pxa[i].EnableReconfig()
+  }
+
+  fmt.Printf("Test: Add a learner ...\n")
+
+  for seq := 0; seq < 5; seq++ {
+    pxa[seq % 3].Start(seq, seq * 10)
+    waitn(t, pxa, seq, 3)
+  }
+
+  s, ok := pxa[0].Reconfigure(pxh[0:3], pxh[3:4])
+  if !ok {
+    t.Fatalf("Reconfigure() failed")
+  }
+  pxa[3] = Join(pxh[0:3], pxh[3], nil)
+
+  last := s + Alpha + 5
+  for seq := s + 1; seq <= last; seq++ {
+    pxa[0].Start(seq, seq * 10)
+  }
+  for seq := 0; seq <= last; seq++ {
+    if seq != s {
+      waitn(t, pxa, seq, 4)
+    }
+  }
+  if decided, _ := pxa[3].Wait(s, 10 * time.Second); !decided {
+    t.Fatalf("learner never learned instance %v", s)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Promote the learner and remove a voter ...\n")
+
+  if _, ok := pxa[1].Promote(pxh[3]); !ok {
+    t.Fatalf("Promote() failed")
+  }
+  r, ok := pxa[1].Reconfigure(pxh[1:4], nil)
+  if !ok {
+    t.Fatalf("Reconfigure() failed")
+  }
+  pxa[0].Kill()
+  pxa[0] = nil
+
+  // the change takes effect at r+Alpha; the instances
+  // in between still have peer 0 as a voter, but three
+  // of those four voters are enough.
+  last = r + Alpha + 5
+  for seq := r + 1; seq <= last; seq++ {
+    pxa[3].Start(seq, seq * 10)
+  }
+  for seq := r + 1; seq <= last; seq++ {
+    waitn(t, pxa, seq, 3)
+  }
+
+  for i := 1; i < npaxos; i++ {
+    voters, learners := pxa[i].Members()
+    if len(voters) != 3 || voters[0] != pxh[1] || voters[2] != pxh[3] ||
+       len(learners) != 0 {
+      t.Fatalf("peer %v has members %v %v", i, voters, learners)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Min() ignores removed peers ...\n")
+
+  for i := 1; i < npaxos; i++ {
+    pxa[i].Done(last)
+  }
+  for i := 1; i < npaxos; i++ {
+    pxa[i].Start(last + i, "x")
+  }
+  for i := 1; i < npaxos; i++ {
+    waitn(t, pxa, last + i, 3)
+  }
+  for iters := 0; iters < 30; iters++ {
+    ok := true
+    for i := 1; i < npaxos; i++ {
+      if pxa[i].Min() <= last {
+        ok = false
+      }
+    }
+    if ok {
+      break
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+  for i := 1; i < npaxos; i++ {
+    if m := pxa[i].Min(); m <= last {
+      t.Fatalf("peer %v Min() is %v, wanted %v", i, m, last + 1)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// a tiny state machine for TestSnapshot: the sum
+// of the decided values, fed by Decisions().
+//
+type summer struct {
+  mu sync.Mutex
+  px *Paxos
+  applied int
+  sum int
+}
+
+func (s *summer) save() (int, []byte) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return s.applied, []byte(strconv.Itoa(s.sum))
+}
+
+func (s *summer) install(seq int, data []byte) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if seq > s.applied {
+    s.applied = seq
+    s.sum, _ = strconv.Atoi(string(data))
+  }
+}
+
+func (s *summer) run() {
+  s.px.SetSnapshot(s.save, s.install)
+  ch, _ := s.px.Decisions(0)
+  for d := range ch {
+    s.mu.Lock()
+    if d.Seq > s.applied {
+      s.applied = d.Seq
+      s.sum += d.Value.(int)
+    }
+    s.mu.Unlock()
+    s.px.Done(d.Seq)
+  }
+}
+
+func (s *summer) get() (int, int) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return s.applied, s.sum
+}
+
+func TestSnapshot(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  var sma []*summer = make([]*summer, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("snapshot", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil, "")
+    sma[i] = &summer{px: pxa[i]}
+    go sma[i].run()
+  }
+
+  fmt.Printf("Test: Restarted peer catches up from a snapshot ...\n")
+
+  // instance 0 is a placeholder, so that
+  // applied == 0 means nothing applied yet.
+  pxa[0].Start(0, 0)
+  waitn(t, pxa, 0, npaxos)
+
+  const ninst = 20
+  for seq := 1; seq <= ninst; seq++ {
+    pxa[seq % npaxos].Start(seq, seq)
+    waitn(t, pxa, seq, npaxos)
+  }
+
+  // everyone is done with 1..ninst-1. restart peer 2
+  // with no state; the others have forgotten what
+  // it would need to replay.
+  for iters := 0; iters < 30; iters++ {
+    if pxa[0].Min() >= ninst - 1 {
+      break
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+  if pxa[0].Min() < ninst - 1 {
+    t.Fatalf("Min() did not advance; %v", pxa[0].Min())
+  }
+  pxa[2].Kill()
+  pxa[2] = Make(pxh, 2, nil, "")
+  sma[2] = &summer{px: pxa[2]}
+  go sma[2].run()
+
+  pxa[0].Start(ninst + 1, ninst + 1)
+  waitn(t, pxa, ninst + 1, npaxos)
+
+  want := (ninst + 1) * (ninst + 2) / 2
+  for iters := 0; iters < 50; iters++ {
+    if applied, _ := sma[2].get(); applied >= ninst + 1 {
+      break
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+  if applied, sum := sma[2].get(); applied != ninst + 1 || sum != want {
+    t.Fatalf("restarted peer has applied=%v sum=%v; wanted %v %v",
+      applied, sum, ninst + 1, want)
+  }
+  if pxa[2].Snapshotted() < 0 {
+    t.Fatalf("restarted peer did not install a snapshot")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestInspect(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("inspect", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil, "")
+  }
+
+  fmt.Printf("Test: Inspect() and the State RPC ...\n")
+
+  pxa[0].Start(0, "zero")
+  waitn(t, pxa, 0, npaxos)
+  pxa[1].Done(0)
+  pxa[1].Start(1, "one")
+  waitn(t, pxa, 1, npaxos)
+
+  st := pxa[0].Inspect(0, 5)
+  if st.Me != 0 || st.Min != 0 || st.Max != 1 || len(st.Instances) != 2 {
+    t.Fatalf("Inspect() = %v", st)
+  }
+  if st.Dones[1] != 0 || st.Dones[2] != -1 {
+    t.Fatalf("Inspect() Dones = %v", st.Dones)
+  }
+  for i, inst := range st.Instances {
+    if inst.Seq != i || !inst.Decided || inst.Na < 0 || inst.Np < inst.Na {
+      t.Fatalf("Inspect() instance %v = %v", i, inst)
+    }
+  }
+  if st.Instances[1].Va != "one" || st.Instances[1].Text != "one" {
+    t.Fatalf("Inspect() value = %v", st.Instances[1])
+  }
+
+  rst, ok := InspectPeer(pxh[2], 1, 1)
+  if !ok || rst.Me != 2 || len(rst.Instances) != 1 {
+    t.Fatalf("InspectPeer() = %v %v", rst, ok)
+  }
+  if inst := rst.Instances[0]; inst.Seq != 1 || inst.Text != "one" ||
+     inst.Va != nil || !inst.Decided {
+    t.Fatalf("InspectPeer() instance = %v", inst)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestMemTransport(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  net := transport.NewMem()
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = "px" + strconv.Itoa(i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = MakeOn(net, pxh, i, nil, "")
+    pxa[i].unreliable = true
+  }
+
+  fmt.Printf("Test: Agreement over an in-memory network, unreliable ...\n")
+
+  const ninst = 20
+  for seq := 0; seq < ninst; seq++ {
+    for i := 0; i < npaxos; i++ {
+      pxa[i].Start(seq, seq * 10 + i)
+    }
+  }
+  for seq := 0; seq < ninst; seq++ {
+    waitn(t, pxa, seq, npaxos)
+  }
+
+  // a deaf peer, as in TestDeaf.
+  net.Remove(pxh[2])
+  pxa[0].Start(ninst, "deaf")
+  waitmajority(t, pxa, ninst)
+  time.Sleep(500 * time.Millisecond)
+  if ndecided(t, pxa, ninst) != npaxos - 1 {
+    t.Fatalf("a deaf peer heard about a decision")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
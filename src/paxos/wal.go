@@ -0,0 +1,322 @@
+package paxos
+
+//
+// write-ahead log for peers made with a directory (see Make()).
+//
+// every change to an instance's acceptor state (np, na, va,
+// decided), to the range promise made to a leader, to the
+// group's membership, and to this peer's Done() value is
+// appended to the log and
+// fsync()ed before the peer replies to the RPC that caused
+// it, so a restarted peer never forgets a promise or an
+// acceptance it told anyone about.
+//
+// each record is framed as
+//   4-byte length | 4-byte crc32 | gob-encoded walRecord
+// and encoded with a fresh gob encoder, so records written by
+// different incarnations of the peer can sit in one file.
+// a torn record at the end of the log (crash mid-write) is
+// detected by its length or checksum and truncated away.
+//
+// forget() rewrites the log from the in-memory state once
+// forgotten instances make up most of it.
+//
+
+import "os"
+import "fmt"
+import "io"
+import "bytes"
+import "bufio"
+import "encoding/binary"
+import "encoding/gob"
+import "hash/crc32"
+import "path/filepath"
+
+const (
+  recInstance = iota
+  recDones
+  recRange
+  recConfig
+)
+
+// rewrite the log once it holds this many records
+// beyond twice the number of live instances.
+const walSlack = 1000
+
+type walRecord struct {
+  Kind int
+  Seq int
+  Np int
+  Na int
+  Va interface{}
+  Decided bool
+  Dones []int
+  Peers []string
+  Configs []Config
+}
+
+type wal struct {
+  path string
+  f *os.File
+  nrecords int // records in the file
+}
+
+func openWAL(dir string) (*wal, error) {
+  if err := os.MkdirAll(dir, 0777); err != nil {
+    return nil, err
+  }
+  w := &wal{path: filepath.Join(dir, "paxos-log")}
+  f, err := os.OpenFile(w.path, os.O_RDWR|os.O_CREATE, 0666)
+  if err != nil {
+    return nil, err
+  }
+  w.f = f
+  return w, nil
+}
+
+func encodeRecord(r *walRecord) ([]byte, error) {
+  var body bytes.Buffer
+  if err := gob.NewEncoder(&body).Encode(r); err != nil {
+    return nil, err
+  }
+  buf := make([]byte, 8 + body.Len())
+  binary.LittleEndian.PutUint32(buf[0:4], uint32(body.Len()))
+  binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(body.Bytes()))
+  copy(buf[8:], body.Bytes())
+  return buf, nil
+}
+
+//
+// call fn on each intact record in the log, in order,
+// then truncate any torn tail and position the file
+// for appending.
+//
+func (w *wal) replay(fn func(r *walRecord)) error {
+  if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+    return err
+  }
+  rd := bufio.NewReader(w.f)
+  var good int64
+  var hdr [8]byte
+  for {
+    if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+      break
+    }
+    n := binary.LittleEndian.Uint32(hdr[0:4])
+    body := make([]byte, n)
+    if _, err := io.ReadFull(rd, body); err != nil {
+      break
+    }
+    if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(hdr[4:8]) {
+      break
+    }
+    var r walRecord
+    if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&r); err != nil {
+      break
+    }
+    fn(&r)
+    w.nrecords++
+    good += int64(8 + n)
+  }
+  if err := w.f.Truncate(good); err != nil {
+    return err
+  }
+  _, err := w.f.Seek(good, io.SeekStart)
+  return err
+}
+
+func (w *wal) append(r *walRecord) error {
+  if w.f == nil {
+    return os.ErrClosed
+  }
+  buf, err := encodeRecord(r)
+  if err != nil {
+    return err
+  }
+  if _, err := w.f.Write(buf); err != nil {
+    return err
+  }
+  w.nrecords++
+  return w.f.Sync()
+}
+
+//
+// atomically replace the log with records.
+//
+func (w *wal) rewrite(records []*walRecord) error {
+  if w.f == nil {
+    return os.ErrClosed
+  }
+  tmp := w.path + ".tmp"
+  f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+  if err != nil {
+    return err
+  }
+  bw := bufio.NewWriter(f)
+  for _, r := range records {
+    buf, err := encodeRecord(r)
+    if err == nil {
+      _, err = bw.Write(buf)
+    }
+    if err != nil {
+      f.Close()
+      return err
+    }
+  }
+  err = bw.Flush()
+  if err == nil {
+    err = f.Sync()
+  }
+  if err == nil {
+    err = os.Rename(tmp, w.path)
+  }
+  if err != nil {
+    f.Close()
+    return err
+  }
+  if d, err := os.Open(filepath.Dir(w.path)); err == nil {
+    d.Sync()
+    d.Close()
+  }
+  w.f.Close()
+  w.f = f
+  w.nrecords = len(records)
+  return nil
+}
+
+func (w *wal) close() {
+  if w.f != nil {
+    w.f.Close()
+    w.f = nil
+  }
+}
+
+//
+// log the current state of instance seq.
+// caller must hold px.mu.
+//
+func (px *Paxos) persist(seq int, inst *instance) error {
+  if px.log == nil {
+    return nil
+  }
+  r := &walRecord{Kind: recInstance, Seq: seq, Np: inst.np, Na: inst.na,
+                  Va: inst.va, Decided: inst.decided}
+  return px.log.append(r)
+}
+
+//
+// report a log write that failed where there's no caller to
+// return the error to. the peer carries on, but may lose
+// what wasn't written if it crashes.
+//
+func (px *Paxos) warn(what string, err error) {
+  if err != nil {
+    fmt.Printf("Paxos(%v) wal %s: %v\n", px.me, what, err)
+  }
+}
+
+//
+// log the Done() values this peer knows about.
+// caller must hold px.mu.
+//
+func (px *Paxos) persistDones() error {
+  if px.log == nil {
+    return nil
+  }
+  dones := make([]int, len(px.dones))
+  copy(dones, px.dones)
+  return px.log.append(&walRecord{Kind: recDones, Dones: dones})
+}
+
+//
+// log the range promise made to a leader.
+// caller must hold px.mu.
+//
+func (px *Paxos) persistRange() error {
+  if px.log == nil {
+    return nil
+  }
+  return px.log.append(&walRecord{Kind: recRange, Seq: px.rangeFrom,
+    Np: px.rangeNp})
+}
+
+//
+// log the member list and configurations.
+// caller must hold px.mu.
+//
+func (px *Paxos) persistConfig() error {
+  if px.log == nil {
+    return nil
+  }
+  return px.log.append(px.configRecord())
+}
+
+func (px *Paxos) configRecord() *walRecord {
+  peers := append([]string{}, px.peers...)
+  configs := append([]Config{}, px.configs...)
+  return &walRecord{Kind: recConfig, Peers: peers, Configs: configs}
+}
+
+//
+// rewrite the log to hold just the live instances.
+// caller must hold px.mu.
+//
+func (px *Paxos) checkpoint() {
+  dones := make([]int, len(px.dones))
+  copy(dones, px.dones)
+  // the member list goes first, so that replay knows
+  // about every peer whose Done() value it reads.
+  records := []*walRecord{px.configRecord(),
+    &walRecord{Kind: recDones, Dones: dones}}
+  if px.rangeNp >= 0 {
+    records = append(records, &walRecord{Kind: recRange, Seq: px.rangeFrom,
+      Np: px.rangeNp})
+  }
+  for seq, inst := range px.instances {
+    records = append(records, &walRecord{Kind: recInstance, Seq: seq,
+      Np: inst.np, Na: inst.na, Va: inst.va, Decided: inst.decided})
+  }
+  // a failed rewrite leaves the old log in place,
+  // which is still correct, just longer.
+  px.log.rewrite(records)
+}
+
+//
+// rebuild in-memory state from the log.
+// called from MakeOn() before the peer serves RPCs.
+//
+func (px *Paxos) recover() error {
+  err := px.log.replay(func(r *walRecord) {
+    switch r.Kind {
+    case recInstance:
+      // np and na only grow, so the last record
+      // for an instance is its current state.
+      inst := px.instance(r.Seq)
+      inst.np = r.Np
+      inst.na = r.Na
+      inst.va = r.Va
+      inst.decided = r.Decided
+    case recRange:
+      px.rangeFrom = r.Seq
+      px.rangeNp = r.Np
+    case recConfig:
+      for len(px.peers) < len(r.Peers) {
+        px.peers = append(px.peers, r.Peers[len(px.peers)])
+        px.dones = append(px.dones, -1)
+      }
+      px.configs = r.Configs
+    case recDones:
+      for i := 0; i < len(r.Dones) && i < len(px.dones); i++ {
+        if r.Dones[i] > px.dones[i] {
+          px.dones[i] = r.Dones[i]
+        }
+      }
+    }
+  })
+  if err != nil {
+    return err
+  }
+  px.forget()
+  px.advance()
+  return nil
+}
@@ -2,8 +2,9 @@ package pbservice
 
 import "viewservice"
 import "sync"
-import "time"
 import "strconv"
+import "context"
+import "transport"
 
 //import "fmt"
 
@@ -19,12 +20,22 @@ type Clerk struct {
 	mu     *sync.Mutex
 	view   viewservice.View
 	vshost string
+	t      transport.Transport
 	// Your declarations here
 }
 
 func MakeClerk(vshost string, me string) *Clerk {
+	return MakeClerkOn(transport.Unix, vshost, me)
+}
+
+//
+// like MakeClerk(), but reach the viewservice
+// and the servers through t.
+//
+func MakeClerkOn(t transport.Transport, vshost string, me string) *Clerk {
 	ck := new(Clerk)
-	ck.vs = viewservice.MakeClerk(me, vshost)
+	ck.t = t
+	ck.vs = viewservice.MakeClerkOn(t, me, vshost)
 	ck.vshost = vshost
 	//ck.Me = me
 	ck.Me = strconv.FormatInt(nrand(), 10)
@@ -39,9 +50,13 @@ func MakeClerk(vshost string, me string) *Clerk {
 }
 
 func (ck *Clerk) UpdateServer() {
+	ck.updateServer(context.Background())
+}
+
+func (ck *Clerk) updateServer(ctx context.Context) {
 	//ck.mu.Lock()
-	view, ok := ck.vs.Get()
-	if !ok {
+	view, err := ck.vs.GetContext(ctx)
+	if err != nil {
 		//fmt.Println("********** vs", ck.vshost)
 
 		return
@@ -60,28 +75,42 @@ func (ck *Clerk) UpdateServer() {
 // says the key doesn't exist (has never been Put().
 //
 func (ck *Clerk) Get(key string) string {
+	v, _ := ck.GetContext(context.Background(), key)
+	return v
+}
+
+//
+// like Get(), but stop trying once ctx is done, and
+// return a *transport.Error saying why.
+//
+func (ck *Clerk) GetContext(ctx context.Context, key string) (string, error) {
 	args := &GetArgs{key, false}
-	var reply GetReply
 	cnt := 0
 
 	//if ck.view.Viewnum == 0 {
 	if ck.server == "" {
-		ck.UpdateServer()
+		ck.updateServer(ctx)
 	}
 
-	for !call(ck.server, "PBServer.Get", args, &reply) {
-		time.Sleep(viewservice.PingInterval)
+	for {
+		// a fresh reply each time, since an abandoned
+		// RPC may still write into the old one.
+		var reply GetReply
+		if transport.CallContext(ctx, ck.t, ck.server, "PBServer.Get", args, &reply) {
+			return reply.Value, nil
+		}
+		if !transport.Sleep(ctx, viewservice.PingInterval) {
+			return "", transport.Abandoned("pbservice.Get", ctx)
+		}
 		//fmt.Println("-----------------  get" + ck.Me)
 		if reply.Err == ErrWrongServer || cnt >= RETRY {
 			//fmt.Println(ck.view)
-			ck.UpdateServer()
+			ck.updateServer(ctx)
 			cnt = 0
 		} else {
 			cnt++
 		}
 	}
-
-	return reply.Value
 }
 
 //
@@ -89,25 +118,38 @@ func (ck *Clerk) Get(key string) string {
 // must keep trying until it succeeds.
 //
 func (ck *Clerk) PutExt(key string, value string, dohash bool) string {
+	v, _ := ck.PutExtContext(context.Background(), key, value, dohash)
+	return v
+}
+
+//
+// like PutExt(), but stop trying once ctx is done. the
+// Put may or may not have happened if an error is returned.
+//
+func (ck *Clerk) PutExtContext(ctx context.Context, key string, value string,
+	dohash bool) (string, error) {
 	args := &PutArgs{key, value, dohash, nrand(), ck.Me}
-	var reply PutReply
 	cnt := 0
 
 	if ck.server == "" {
-		ck.UpdateServer()
+		ck.updateServer(ctx)
 	}
-	for !call(ck.server, "PBServer.Put", args, &reply) {
-		time.Sleep(viewservice.PingInterval)
+	for {
+		var reply PutReply
+		if transport.CallContext(ctx, ck.t, ck.server, "PBServer.Put", args, &reply) {
+			return reply.PreviousValue, nil
+		}
+		if !transport.Sleep(ctx, viewservice.PingInterval) {
+			return "", transport.Abandoned("pbservice.PutExt", ctx)
+		}
 		//fmt.Println("-----------------  put" + ck.Me)
 		if reply.Err == ErrWrongServer || cnt >= RETRY {
-			ck.UpdateServer()
+			ck.updateServer(ctx)
 			cnt = 0
 		} else {
 			cnt++
 		}
 	}
-
-	return reply.PreviousValue
 }
 
 func (ck *Clerk) Put(key string, value string) {
@@ -117,3 +159,11 @@ func (ck *Clerk) PutHash(key string, value string) string {
 	v := ck.PutExt(key, value, true)
 	return v
 }
+
+func (ck *Clerk) PutContext(ctx context.Context, key string, value string) error {
+	_, err := ck.PutExtContext(ctx, key, value, false)
+	return err
+}
+func (ck *Clerk) PutHashContext(ctx context.Context, key string, value string) (string, error) {
+	return ck.PutExtContext(ctx, key, value, true)
+}
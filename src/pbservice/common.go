@@ -3,10 +3,8 @@ package pbservice
 import "hash/fnv"
 
 //import "time"
-import "fmt"
 import "crypto/rand"
 import "math/big"
-import "net/rpc"
 
 const (
 	OK             = "OK"
@@ -60,36 +58,3 @@ func nrand() int64 {
 	return x
 }
 
-//
-// call() sends an RPC to the rpcname handler on server srv
-// with arguments args, waits for the reply, and leaves the
-// reply in reply. the reply argument should be a pointer
-// to a reply structure.
-//
-// the return value is true if the server responded, and false
-// if call() was not able to contact the server. in particular,
-// the reply's contents are only valid if call() returned true.
-//
-// you should assume that call() will time out and return an
-// error after a while if it doesn't get a reply from the server.
-//
-// please use call() to send all RPCs, in client.go and server.go.
-// please don't change this function.
-//
-func call(srv string, rpcname string,
-	args interface{}, reply interface{}) bool {
-	c, errx := rpc.Dial("unix", srv)
-	if errx != nil {
-		//fmt.Println("### "+srv+"  "+rpcname+"   Connect fail.  ", errx)
-		return false
-	}
-	defer c.Close()
-
-	err := c.Call(rpcname, args, reply)
-	if err == nil {
-		return true
-	}
-	fmt.Println("### " + srv + "  " + rpcname + "   ")
-	fmt.Println(err)
-	return false
-}
@@ -6,12 +6,11 @@ import "net/rpc"
 import "log"
 import "time"
 import "viewservice"
-import "os"
-import "syscall"
 import "math/rand"
 import "sync"
 import "strconv"
 import "errors"
+import "transport"
 
 //import "errors"
 
@@ -44,6 +43,7 @@ type PBServer struct {
 	mu           *sync.Mutex
 	filter       map[string]Node
 	initialnized bool
+	t            transport.Transport
 
 	// Your declarations here.
 }
@@ -111,7 +111,7 @@ func (pb *PBServer) Put(args *PutArgs, reply *PutReply) error {
 		// fmt.Println("Sync success!")
 
 		// }
-		ok := call(pb.view.Backup, "PBServer.SyncPut", args, &BackupReply)
+		ok := transport.Call(pb.t, pb.view.Backup, "PBServer.SyncPut", args, &BackupReply)
 		if !ok {
 			//	pb.UpdateServer()
 			//	fmt.Println(pb.view)
@@ -208,7 +208,7 @@ func (pb *PBServer) tick() {
 		var reply GetReply
 		reply.Db = make(map[string]string)
 
-		ok := call(pb.view.Primary, "PBServer.Get", args, &reply)
+		ok := transport.Call(pb.t, pb.view.Primary, "PBServer.Get", args, &reply)
 		// for !call(pb.view.Primary, "PBServer.Get", args, &reply) {
 		// 	time.Sleep(viewservice.PingInterval)
 		// }
@@ -232,9 +232,18 @@ func (pb *PBServer) kill() {
 }
 
 func StartServer(vshost string, me string) *PBServer {
+	return StartServerOn(transport.Unix, vshost, me)
+}
+
+//
+// like StartServer(), but listen, and reach the
+// viewservice and the other server, through t.
+//
+func StartServerOn(t transport.Transport, vshost string, me string) *PBServer {
 	pb := new(PBServer)
 	pb.me = me
-	pb.vs = viewservice.MakeClerk(me, vshost)
+	pb.t = t
+	pb.vs = viewservice.MakeClerkOn(t, me, vshost)
 	pb.finish = make(chan interface{})
 	pb.whoami = "Unknown"
 	pb.db = make(map[string]string)
@@ -247,8 +256,7 @@ func StartServer(vshost string, me string) *PBServer {
 	rpcs := rpc.NewServer()
 	rpcs.Register(pb)
 
-	os.Remove(pb.me)
-	l, e := net.Listen("unix", pb.me)
+	l, e := t.Listen(pb.me)
 	if e != nil {
 		log.Fatal("listen error: ", e)
 	}
@@ -266,9 +274,7 @@ func StartServer(vshost string, me string) *PBServer {
 					conn.Close()
 				} else if pb.unreliable && (rand.Int63()%1000) < 200 {
 					// process the request but force discard of reply.
-					c1 := conn.(*net.UnixConn)
-					f, _ := c1.File()
-					err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
+					err := transport.CloseWrite(conn)
 					if err != nil {
 						fmt.Printf("shutdown: %v\n", err)
 					}
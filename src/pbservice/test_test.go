@@ -11,6 +11,8 @@ import "runtime"
 import "math/rand"
 import "os"
 import "strconv"
+import "context"
+import "transport"
 
 func check(ck *Clerk, key string, value string) {
 	v := ck.Get(key)
@@ -503,3 +505,52 @@ func TestPartition2(t *testing.T) {
 	s3.kill()
 	vs.Kill()
 }
+
+// a Clerk whose primary has died, with no backup to take
+// over, gives up when its context is done.
+func TestContext(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	tag := "ctx"
+	vshost := port(tag+"v", 1)
+	vs := viewservice.StartServer(vshost)
+	time.Sleep(time.Second)
+	vck := viewservice.MakeClerk("", vshost)
+
+	s1 := StartServer(vshost, port(tag, 1))
+
+	deadtime := viewservice.PingInterval * viewservice.DeadPings
+	time.Sleep(deadtime * 2)
+	if vck.Primary() != s1.me {
+		t.Fatal("primary never formed initial view")
+	}
+
+	ck := MakeClerk(vshost, "")
+	ck.Put("a", "1")
+	check(ck, "a", "1")
+
+	fmt.Printf("Test: GetContext() gives up when the primary is gone ...\n")
+
+	s1.kill()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	t0 := time.Now()
+	_, err := ck.GetContext(ctx, "a")
+	if e, ok := err.(*transport.Error); !ok || !e.Timeout() {
+		t.Fatalf("GetContext() returned %v; expected a timeout", err)
+	}
+	if d := time.Since(t0); d > 3*time.Second {
+		t.Fatalf("GetContext() took %v to give up", d)
+	}
+
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	cancel2()
+	if _, err := ck.PutExtContext(ctx2, "a", "2", false); err == nil {
+		t.Fatalf("PutExtContext() with a cancelled context succeeded")
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	vs.Kill()
+}
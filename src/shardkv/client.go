@@ -1,60 +1,38 @@
 package shardkv
 
 import "shardmaster"
-import "net/rpc"
 import "time"
 import "sync"
-import "fmt"
+import "context"
+import "transport"
 
 type Clerk struct {
   mu sync.Mutex // one RPC at a time
   sm *shardmaster.Clerk
   config shardmaster.Config
+  transport transport.Transport
   // You'll have to modify Clerk.
 }
 
 
 
 func MakeClerk(shardmasters []string) *Clerk {
-  ck := new(Clerk)
-  ck.sm = shardmaster.MakeClerk(shardmasters)
-  // You'll have to modify MakeClerk.
-  return ck
+  return MakeClerkOn(transport.Unix, shardmasters)
 }
 
 //
-// call() sends an RPC to the rpcname handler on server srv
-// with arguments args, waits for the reply, and leaves the
-// reply in reply. the reply argument should be a pointer
-// to a reply structure.
-//
-// the return value is true if the server responded, and false
-// if call() was not able to contact the server. in particular,
-// the reply's contents are only valid if call() returned true.
+// like MakeClerk(), but reach the shardmasters
+// and the replica groups through t.
 //
-// you should assume that call() will time out and return an
-// error after a while if it doesn't get a reply from the server.
-//
-// please use call() to send all RPCs, in client.go and server.go.
-// please don't change this function.
-//
-func call(srv string, rpcname string,
-          args interface{}, reply interface{}) bool {
-  c, errx := rpc.Dial("unix", srv)
-  if errx != nil {
-    return false
-  }
-  defer c.Close()
-    
-  err := c.Call(rpcname, args, reply)
-  if err == nil {
-    return true
-  }
-
-  fmt.Println(err)
-  return false
+func MakeClerkOn(t transport.Transport, shardmasters []string) *Clerk {
+  ck := new(Clerk)
+  ck.transport = t
+  ck.sm = shardmaster.MakeClerkOn(t, shardmasters)
+  // You'll have to modify MakeClerk.
+  return ck
 }
 
+
 //
 // which shard is a key in?
 // please use this function,
@@ -75,6 +53,15 @@ func key2shard(key string) int {
 // keeps trying forever in the face of all other errors.
 //
 func (ck *Clerk) Get(key string) string {
+  v, _ := ck.GetContext(context.Background(), key)
+  return v
+}
+
+//
+// like Get(), but stop trying once ctx is done, and
+// return a *transport.Error saying why.
+//
+func (ck *Clerk) GetContext(ctx context.Context, key string) (string, error) {
   ck.mu.Lock()
   defer ck.mu.Unlock()
 
@@ -93,9 +80,9 @@ func (ck *Clerk) Get(key string) string {
         args := &GetArgs{}
         args.Key = key
         var reply GetReply
-        ok := call(srv, "ShardKV.Get", args, &reply)
+        ok := transport.CallContext(ctx, ck.transport, srv, "ShardKV.Get", args, &reply)
         if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
-          return reply.Value
+          return reply.Value, nil
         }
         if ok && (reply.Err == ErrWrongGroup) {
           break
@@ -103,15 +90,30 @@ func (ck *Clerk) Get(key string) string {
       }
     }
 
-    time.Sleep(100 * time.Millisecond)
+    if !transport.Sleep(ctx, 100 * time.Millisecond) {
+      return "", transport.Abandoned("shardkv.Get", ctx)
+    }
 
     // ask master for a new configuration.
-    ck.config = ck.sm.Query(-1)
+    config, err := ck.sm.QueryContext(ctx, -1)
+    if err != nil {
+      return "", transport.Abandoned("shardkv.Get", ctx)
+    }
+    ck.config = config
   }
-  return ""
 }
 
 func (ck *Clerk) PutExt(key string, value string, dohash bool) string {
+  v, _ := ck.PutExtContext(context.Background(), key, value, dohash)
+  return v
+}
+
+//
+// like PutExt(), but stop trying once ctx is done. the
+// Put may or may not have happened if an error is returned.
+//
+func (ck *Clerk) PutExtContext(ctx context.Context, key string, value string,
+                               dohash bool) (string, error) {
   ck.mu.Lock()
   defer ck.mu.Unlock()
 
@@ -132,9 +134,9 @@ func (ck *Clerk) PutExt(key string, value string, dohash bool) string {
         args.Value = value
         args.DoHash = dohash
         var reply PutReply
-        ok := call(srv, "ShardKV.Put", args, &reply)
+        ok := transport.CallContext(ctx, ck.transport, srv, "ShardKV.Put", args, &reply)
         if ok && reply.Err == OK {
-          return reply.PreviousValue
+          return reply.PreviousValue, nil
         }
         if ok && (reply.Err == ErrWrongGroup) {
           break
@@ -142,10 +144,16 @@ func (ck *Clerk) PutExt(key string, value string, dohash bool) string {
       }
     }
 
-    time.Sleep(100 * time.Millisecond)
+    if !transport.Sleep(ctx, 100 * time.Millisecond) {
+      return "", transport.Abandoned("shardkv.PutExt", ctx)
+    }
 
     // ask master for a new configuration.
-    ck.config = ck.sm.Query(-1)
+    config, err := ck.sm.QueryContext(ctx, -1)
+    if err != nil {
+      return "", transport.Abandoned("shardkv.PutExt", ctx)
+    }
+    ck.config = config
   }
 }
 
@@ -156,3 +164,11 @@ func (ck *Clerk) PutHash(key string, value string) string {
   v := ck.PutExt(key, value, true)
   return v
 }
+
+func (ck *Clerk) PutContext(ctx context.Context, key string, value string) error {
+  _, err := ck.PutExtContext(ctx, key, value, false)
+  return err
+}
+func (ck *Clerk) PutHashContext(ctx context.Context, key string, value string) (string, error) {
+  return ck.PutExtContext(ctx, key, value, true)
+}
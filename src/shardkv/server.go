@@ -7,10 +7,9 @@ import "log"
 import "time"
 import "paxos"
 import "sync"
-import "os"
-import "syscall"
 import "encoding/gob"
 import "math/rand"
+import "transport"
 import "shardmaster"
 
 const Debug=0
@@ -38,6 +37,7 @@ type ShardKV struct {
   px *paxos.Paxos
 
   gid int64 // my replica group ID
+  transport transport.Transport // for RPCs to other groups
 
   // Your definitions here.
 }
@@ -79,12 +79,22 @@ func (kv *ShardKV) kill() {
 //
 func StartServer(gid int64, shardmasters []string,
                  servers []string, me int) *ShardKV {
+  return StartServerOn(transport.Unix, gid, shardmasters, servers, me)
+}
+
+//
+// like StartServer(), but listen, and reach the shardmasters
+// and the other servers, through t.
+//
+func StartServerOn(t transport.Transport, gid int64, shardmasters []string,
+                   servers []string, me int) *ShardKV {
   gob.Register(Op{})
 
   kv := new(ShardKV)
   kv.me = me
   kv.gid = gid
-  kv.sm = shardmaster.MakeClerk(shardmasters)
+  kv.transport = t
+  kv.sm = shardmaster.MakeClerkOn(t, shardmasters)
 
   // Your initialization code here.
   // Don't call Join().
@@ -92,11 +102,10 @@ func StartServer(gid int64, shardmasters []string,
   rpcs := rpc.NewServer()
   rpcs.Register(kv)
 
-  kv.px = paxos.Make(servers, me, rpcs)
+  kv.px = paxos.MakeOn(t, servers, me, rpcs, "")
 
 
-  os.Remove(servers[me])
-  l, e := net.Listen("unix", servers[me]);
+  l, e := t.Listen(servers[me]);
   if e != nil {
     log.Fatal("listen error: ", e);
   }
@@ -114,9 +123,7 @@ func StartServer(gid int64, shardmasters []string,
           conn.Close()
         } else if kv.unreliable && (rand.Int63() % 1000) < 200 {
           // process the request but force discard of reply.
-          c1 := conn.(*net.UnixConn)
-          f, _ := c1.File()
-          err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
+          err := transport.CloseWrite(conn)
           if err != nil {
             fmt.Printf("shutdown: %v\n", err)
           }
@@ -5,71 +5,62 @@ package shardmaster
 // Please don't change this file.
 //
 
-import "net/rpc"
 import "time"
-import "fmt"
+import "context"
+import "transport"
 
 type Clerk struct {
   servers []string // shardmaster replicas
+  transport transport.Transport
 }
 
 func MakeClerk(servers []string) *Clerk {
+  return MakeClerkOn(transport.Unix, servers)
+}
+
+//
+// like MakeClerk(), but send RPCs through t.
+//
+func MakeClerkOn(t transport.Transport, servers []string) *Clerk {
   ck := new(Clerk)
   ck.servers = servers
+  ck.transport = t
   return ck
 }
 
-//
-// call() sends an RPC to the rpcname handler on server srv
-// with arguments args, waits for the reply, and leaves the
-// reply in reply. the reply argument should be a pointer
-// to a reply structure.
-//
-// the return value is true if the server responded, and false
-// if call() was not able to contact the server. in particular,
-// the reply's contents are only valid if call() returned true.
-//
-// you should assume that call() will time out and return an
-// error after a while if it doesn't get a reply from the server.
-//
-// please use call() to send all RPCs, in client.go and server.go.
-// please don't change this function.
-//
-func call(srv string, rpcname string,
-          args interface{}, reply interface{}) bool {
-  c, errx := rpc.Dial("unix", srv)
-  if errx != nil {
-    return false
-  }
-  defer c.Close()
-    
-  err := c.Call(rpcname, args, reply)
-  if err == nil {
-    return true
-  }
 
-  fmt.Println(err)
-  return false
+func (ck *Clerk) Query(num int) Config {
+  config, _ := ck.QueryContext(context.Background(), num)
+  return config
 }
 
-func (ck *Clerk) Query(num int) Config {
+//
+// like Query(), but stop trying once ctx is done, and
+// return a *transport.Error saying why.
+//
+func (ck *Clerk) QueryContext(ctx context.Context, num int) (Config, error) {
   for {
     // try each known server.
     for _, srv := range ck.servers {
       args := &QueryArgs{}
       args.Num = num
       var reply QueryReply
-      ok := call(srv, "ShardMaster.Query", args, &reply)
+      ok := transport.CallContext(ctx, ck.transport, srv, "ShardMaster.Query", args, &reply)
       if ok {
-        return reply.Config
+        return reply.Config, nil
       }
     }
-    time.Sleep(100 * time.Millisecond)
+    if !transport.Sleep(ctx, 100 * time.Millisecond) {
+      return Config{}, transport.Abandoned("shardmaster.Query", ctx)
+    }
   }
-  return Config{}
 }
 
 func (ck *Clerk) Join(gid int64, servers []string) {
+  ck.JoinContext(context.Background(), gid, servers)
+}
+
+func (ck *Clerk) JoinContext(ctx context.Context, gid int64, servers []string) error {
   for {
     // try each known server.
     for _, srv := range ck.servers {
@@ -77,32 +68,44 @@ func (ck *Clerk) Join(gid int64, servers []string) {
       args.GID = gid
       args.Servers = servers
       var reply JoinReply
-      ok := call(srv, "ShardMaster.Join", args, &reply)
+      ok := transport.CallContext(ctx, ck.transport, srv, "ShardMaster.Join", args, &reply)
       if ok {
-        return
+        return nil
       }
     }
-    time.Sleep(100 * time.Millisecond)
+    if !transport.Sleep(ctx, 100 * time.Millisecond) {
+      return transport.Abandoned("shardmaster.Join", ctx)
+    }
   }
 }
 
 func (ck *Clerk) Leave(gid int64) {
+  ck.LeaveContext(context.Background(), gid)
+}
+
+func (ck *Clerk) LeaveContext(ctx context.Context, gid int64) error {
   for {
     // try each known server.
     for _, srv := range ck.servers {
       args := &LeaveArgs{}
       args.GID = gid
       var reply LeaveReply
-      ok := call(srv, "ShardMaster.Leave", args, &reply)
+      ok := transport.CallContext(ctx, ck.transport, srv, "ShardMaster.Leave", args, &reply)
       if ok {
-        return
+        return nil
       }
     }
-    time.Sleep(100 * time.Millisecond)
+    if !transport.Sleep(ctx, 100 * time.Millisecond) {
+      return transport.Abandoned("shardmaster.Leave", ctx)
+    }
   }
 }
 
 func (ck *Clerk) Move(shard int, gid int64) {
+  ck.MoveContext(context.Background(), shard, gid)
+}
+
+func (ck *Clerk) MoveContext(ctx context.Context, shard int, gid int64) error {
   for {
     // try each known server.
     for _, srv := range ck.servers {
@@ -110,11 +113,13 @@ func (ck *Clerk) Move(shard int, gid int64) {
       args.Shard = shard
       args.GID = gid
       var reply LeaveReply
-      ok := call(srv, "ShardMaster.Move", args, &reply)
+      ok := transport.CallContext(ctx, ck.transport, srv, "ShardMaster.Move", args, &reply)
       if ok {
-        return
+        return nil
       }
     }
-    time.Sleep(100 * time.Millisecond)
+    if !transport.Sleep(ctx, 100 * time.Millisecond) {
+      return transport.Abandoned("shardmaster.Move", ctx)
+    }
   }
 }
@@ -6,10 +6,9 @@ import "net/rpc"
 import "log"
 import "paxos"
 import "sync"
-import "os"
-import "syscall"
 import "encoding/gob"
 import "math/rand"
+import "transport"
 
 type ShardMaster struct {
   mu sync.Mutex
@@ -66,6 +65,14 @@ func (sm *ShardMaster) Kill() {
 // me is the index of the current server in servers[].
 // 
 func StartServer(servers []string, me int) *ShardMaster {
+  return StartServerOn(transport.Unix, servers, me)
+}
+
+//
+// like StartServer(), but listen, and reach
+// the other servers, through t.
+//
+func StartServerOn(t transport.Transport, servers []string, me int) *ShardMaster {
   gob.Register(Op{})
 
   sm := new(ShardMaster)
@@ -77,10 +84,9 @@ func StartServer(servers []string, me int) *ShardMaster {
   rpcs := rpc.NewServer()
   rpcs.Register(sm)
 
-  sm.px = paxos.Make(servers, me, rpcs)
+  sm.px = paxos.MakeOn(t, servers, me, rpcs, "")
 
-  os.Remove(servers[me])
-  l, e := net.Listen("unix", servers[me]);
+  l, e := t.Listen(servers[me]);
   if e != nil {
     log.Fatal("listen error: ", e);
   }
@@ -98,9 +104,7 @@ func StartServer(servers []string, me int) *ShardMaster {
           conn.Close()
         } else if sm.unreliable && (rand.Int63() % 1000) < 200 {
           // process the request but force discard of reply.
-          c1 := conn.(*net.UnixConn)
-          f, _ := c1.File()
-          err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
+          err := transport.CloseWrite(conn)
           if err != nil {
             fmt.Printf("shutdown: %v\n", err)
           }
@@ -0,0 +1,174 @@
+package transport
+
+//
+// deadlines and cancellation.
+//
+// Call() waits as long as the server takes, and a server that
+// accepts a request but never replies (lockservice's DeafConn,
+// or a wedged peer) holds the caller forever. CallContext()
+// gives up when its context.Context is done, and the Clerks'
+// ...Context methods use it to stop retrying, returning an
+// *Error that says why:
+//
+//   ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+//   defer cancel()
+//   v, err := ck.GetContext(ctx, "k")
+//   if err != nil && err.(*transport.Error).Timeout() { ... }
+//
+// an RPC that CallContext() gives up on may still be delivered
+// and executed, and its reply may still be written into reply
+// after CallContext() returns, so don't reuse reply.
+//
+
+import "context"
+import "errors"
+import "net"
+import "net/rpc"
+import "time"
+
+//
+// a Caller that can give up when ctx is done.
+//
+type ContextCaller interface {
+  CallContext(ctx context.Context, srv string, rpcname string,
+              args interface{}, reply interface{}) bool
+}
+
+//
+// what a Clerk's ...Context method returns if ctx
+// is done before the operation completes, or if
+// a method that doesn't retry got no reply.
+//
+type Error struct {
+  Op string // the Clerk method, e.g. "kvpaxos.Get"
+  Err error // ctx.Err(), or ErrNoReply
+}
+
+var ErrNoReply = errors.New("transport: no reply")
+
+func (e *Error) Error() string {
+  return e.Op + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+  return e.Err
+}
+
+//
+// did the operation run out of time, rather than
+// being cancelled?
+//
+func (e *Error) Timeout() bool {
+  return e.Err == context.DeadlineExceeded
+}
+
+//
+// the *Error for op, now that ctx is done.
+//
+func Abandoned(op string, ctx context.Context) error {
+  return &Error{op, ctx.Err()}
+}
+
+//
+// like Call(), but give up and return false once ctx is done.
+//
+func CallContext(ctx context.Context, t Transport, srv string, rpcname string,
+                 args interface{}, reply interface{}) bool {
+  if c, ok := t.(ContextCaller); ok {
+    return c.CallContext(ctx, srv, rpcname, args, reply)
+  }
+  if ctx.Err() != nil {
+    return false
+  }
+  if c, ok := t.(Caller); ok {
+    if ctx.Done() == nil {
+      return c.Call(srv, rpcname, args, reply)
+    }
+    done := make(chan bool, 1)
+    go func() {
+      done <- c.Call(srv, rpcname, args, reply)
+    }()
+    select {
+    case ok := <-done:
+      return ok
+    case <-ctx.Done():
+      return false
+    }
+  }
+
+  conn, errx := dialContext(ctx, t, srv)
+  if errx != nil {
+    return false
+  }
+  c := rpc.NewClient(conn)
+  defer c.Close()
+
+  return wait(ctx, c, rpcname, args, reply) == nil
+}
+
+//
+// sleep for d, or until ctx is done.
+// returns false if ctx is done.
+//
+func Sleep(ctx context.Context, d time.Duration) bool {
+  t := time.NewTimer(d)
+  defer t.Stop()
+  select {
+  case <-t.C:
+    return true
+  case <-ctx.Done():
+    return false
+  }
+}
+
+//
+// send an RPC over c and wait for the reply, or for ctx to
+// be done. sending can block too, if the server isn't reading,
+// so it happens in the background unless ctx can't be done.
+//
+func wait(ctx context.Context, c *rpc.Client, rpcname string,
+          args interface{}, reply interface{}) error {
+  done := make(chan *rpc.Call, 1)
+  if ctx.Done() == nil {
+    c.Go(rpcname, args, reply, done)
+  } else {
+    go c.Go(rpcname, args, reply, done)
+  }
+  select {
+  case call := <-done:
+    return call.Error
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+}
+
+//
+// t.Dial(addr), but give up once ctx is done. Dial() can
+// block, e.g. on a full Mem backlog or an unanswered TCP SYN.
+//
+func dialContext(ctx context.Context, t Transport, addr string) (net.Conn, error) {
+  if ctx.Done() == nil {
+    return t.Dial(addr)
+  }
+  type dialed struct {
+    conn net.Conn
+    err error
+  }
+  ch := make(chan dialed, 1)
+  go func() {
+    conn, err := t.Dial(addr)
+    ch <- dialed{conn, err}
+  }()
+  select {
+  case d := <-ch:
+    return d.conn, d.err
+  case <-ctx.Done():
+    go func() {
+      // nobody wants the connection any more.
+      if d := <-ch; d.conn != nil {
+        d.conn.Close()
+      }
+    }()
+    return nil, ctx.Err()
+  }
+}
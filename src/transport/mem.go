@@ -0,0 +1,172 @@
+package transport
+
+//
+// an in-memory network, for running a whole group of
+// servers inside one process without touching the file
+// system. each connection is a net.Pipe().
+//
+
+import "net"
+import "sync"
+import "errors"
+import "io"
+import "time"
+
+// how many dialed connections may wait for Accept().
+const memBacklog = 128
+
+var errRefused = errors.New("transport: connection refused")
+
+type Mem struct {
+  mu sync.Mutex
+  listeners map[string]*memListener
+}
+
+func NewMem() *Mem {
+  m := &Mem{}
+  m.listeners = make(map[string]*memListener)
+  return m
+}
+
+//
+// listen on addr. like a Unix socket, a new listener
+// takes the address over from an old one.
+//
+func (m *Mem) Listen(addr string) (net.Listener, error) {
+  l := &memListener{m: m, addr: addr}
+  l.conns = make(chan net.Conn, memBacklog)
+  l.done = make(chan bool)
+  m.mu.Lock()
+  m.listeners[addr] = l
+  m.mu.Unlock()
+  return l, nil
+}
+
+func (m *Mem) Dial(addr string) (net.Conn, error) {
+  m.mu.Lock()
+  l := m.listeners[addr]
+  m.mu.Unlock()
+  if l == nil {
+    return nil, errRefused
+  }
+
+  c1, c2 := net.Pipe()
+  client := &memConn{Conn: c1, addr: addr}
+  server := &memConn{Conn: c2, addr: addr}
+  client.peer = server
+  server.peer = client
+  select {
+  case l.conns <- server:
+    return client, nil
+  case <-l.done:
+    c1.Close()
+    c2.Close()
+    return nil, errRefused
+  }
+}
+
+//
+// make addr unreachable without closing its listener,
+// as removing a Unix socket's file does.
+//
+func (m *Mem) Remove(addr string) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  delete(m.listeners, addr)
+}
+
+type memListener struct {
+  m *Mem
+  addr string
+  conns chan net.Conn
+  done chan bool
+  once sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+  select {
+  case c := <-l.conns:
+    return c, nil
+  case <-l.done:
+    return nil, errors.New("transport: listener closed")
+  }
+}
+
+func (l *memListener) Close() error {
+  l.once.Do(func() {
+    close(l.done)
+    l.m.mu.Lock()
+    if l.m.listeners[l.addr] == l {
+      delete(l.m.listeners, l.addr)
+    }
+    l.m.mu.Unlock()
+  })
+  return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+  return memAddr(l.addr)
+}
+
+type memAddr string
+
+func (a memAddr) Network() string {
+  return "mem"
+}
+
+func (a memAddr) String() string {
+  return string(a)
+}
+
+//
+// one end of a net.Pipe() that can be half-closed, as
+// a socket can: after CloseWrite(), writes fail and the
+// other end reads EOF.
+//
+type memConn struct {
+  net.Conn
+  addr string
+  peer *memConn
+  mu sync.Mutex
+  wclosed bool
+  eof bool
+}
+
+func (c *memConn) Read(p []byte) (int, error) {
+  n, err := c.Conn.Read(p)
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if err != nil && c.eof {
+    // the deadline set by the peer's CloseWrite().
+    return n, io.EOF
+  }
+  return n, err
+}
+
+func (c *memConn) Write(p []byte) (int, error) {
+  c.mu.Lock()
+  wclosed := c.wclosed
+  c.mu.Unlock()
+  if wclosed {
+    return 0, io.ErrClosedPipe
+  }
+  return c.Conn.Write(p)
+}
+
+func (c *memConn) CloseWrite() error {
+  c.mu.Lock()
+  c.wclosed = true
+  c.mu.Unlock()
+
+  c.peer.mu.Lock()
+  c.peer.eof = true
+  c.peer.mu.Unlock()
+  // wake the peer if it is blocked in Read(). this fails
+  // only if the pipe is already closed, which is fine.
+  c.peer.Conn.SetReadDeadline(time.Now())
+  return nil
+}
+
+func (c *memConn) RemoteAddr() net.Addr {
+  return memAddr(c.addr)
+}
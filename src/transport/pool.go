@@ -0,0 +1,200 @@
+package transport
+
+//
+// persistent RPC clients.
+//
+// Call() dials a fresh connection for every RPC. a Pool
+// instead keeps one net/rpc client per destination and
+// sends every RPC to that destination over it, concurrently;
+// if the connection breaks, the next RPC dials a new one.
+//
+// a Pool is itself a Transport, so any service can be handed
+// one in place of the Transport it wraps:
+//
+//   ck := kvpaxos.MakeClerkOn(transport.Pooled(transport.Unix), servers)
+//
+// Call() returns true only if the server responded, as
+// before. an RPC that finds its cached connection already
+// shut down was never sent, so the Pool redials and sends it
+// once more; an RPC whose connection breaks while it waits
+// for a reply is not retried, since the server may have
+// executed it. an RPC that CallContext() gives up on is
+// abandoned, and, since the server may be wedged, the next
+// RPC to that server dials a new connection; the old one is
+// closed once the other RPCs already sent over it are done.
+//
+// tests that make a server deaf by removing its socket, or
+// that count connections, expect a connection per RPC, so
+// the services don't pool unless asked to.
+//
+
+import "net/rpc"
+import "context"
+import "sync"
+import "time"
+
+type Pool struct {
+  Transport // the Transport connections are made with
+  mu sync.Mutex
+  clients map[string]*pooled
+  alive map[string]time.Time
+}
+
+//
+// a connection, and how many RPCs are using it.
+// protected by Pool.mu.
+//
+type pooled struct {
+  c *rpc.Client
+  calls int
+  retired bool // no longer in clients; close once calls is 0
+}
+
+func Pooled(t Transport) *Pool {
+  p := &Pool{Transport: t}
+  p.clients = make(map[string]*pooled)
+  p.alive = make(map[string]time.Time)
+  return p
+}
+
+//
+// send an RPC over the cached connection to srv.
+// same contract as the package-level Call().
+//
+func (p *Pool) Call(srv string, rpcname string,
+                    args interface{}, reply interface{}) bool {
+  return p.CallContext(context.Background(), srv, rpcname, args, reply)
+}
+
+//
+// like Call(), but give up once ctx is done.
+//
+func (p *Pool) CallContext(ctx context.Context, srv string, rpcname string,
+                           args interface{}, reply interface{}) bool {
+  for ctx.Err() == nil {
+    pc, fresh, errx := p.client(ctx, srv)
+    if errx != nil {
+      return false
+    }
+
+    err := wait(ctx, pc.c, rpcname, args, reply)
+    if err != nil && err == ctx.Err() {
+      // only this RPC is abandoned; others may
+      // still be waiting on the connection.
+      p.retire(srv, pc)
+      p.done(pc)
+      return false
+    }
+    if err == nil {
+      p.mu.Lock()
+      p.alive[srv] = time.Now()
+      p.mu.Unlock()
+      p.done(pc)
+      return true
+    }
+    if _, ok := err.(rpc.ServerError); ok {
+      // the handler returned an error; the
+      // connection itself is fine.
+      p.mu.Lock()
+      p.alive[srv] = time.Now()
+      p.mu.Unlock()
+      p.done(pc)
+      return false
+    }
+
+    // the connection is broken, for everyone.
+    p.retire(srv, pc)
+    p.done(pc)
+    if err != rpc.ErrShutdown || fresh {
+      return false
+    }
+    // the cached connection had died before
+    // this RPC was sent; try a new one.
+  }
+  return false
+}
+
+//
+// when the Pool last got a reply from srv, or the
+// zero time if it never has.
+//
+func (p *Pool) LastAlive(srv string) time.Time {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  return p.alive[srv]
+}
+
+//
+// close every cached connection.
+//
+func (p *Pool) Close() {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  for srv, pc := range p.clients {
+    pc.c.Close()
+    delete(p.clients, srv)
+  }
+}
+
+//
+// the cached client for srv, dialing one if there is none,
+// counted as in use until done() is called. fresh is true
+// if it was just dialed.
+//
+func (p *Pool) client(ctx context.Context, srv string) (*pooled, bool, error) {
+  p.mu.Lock()
+  pc, ok := p.clients[srv]
+  if ok {
+    pc.calls++
+  }
+  p.mu.Unlock()
+  if ok {
+    return pc, false, nil
+  }
+
+  // dial without holding p.mu, so that a slow or dead
+  // destination doesn't hold up RPCs to the others.
+  conn, err := dialContext(ctx, p.Transport, srv)
+  if err != nil {
+    return nil, false, err
+  }
+  c := rpc.NewClient(conn)
+
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  if old, ok := p.clients[srv]; ok {
+    // lost a race with another caller.
+    c.Close()
+    old.calls++
+    return old, false, nil
+  }
+  pc = &pooled{c: c, calls: 1}
+  p.clients[srv] = pc
+  return pc, true, nil
+}
+
+//
+// stop handing out pc for srv; the next RPC dials
+// a new connection.
+//
+func (p *Pool) retire(srv string, pc *pooled) {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  if p.clients[srv] == pc {
+    delete(p.clients, srv)
+  }
+  pc.retired = true
+}
+
+//
+// an RPC is done with pc; close it if it is retired
+// and this was the last one.
+//
+func (p *Pool) done(pc *pooled) {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  pc.calls--
+  if pc.retired && pc.calls == 0 {
+    pc.c.Close()
+  }
+}
@@ -0,0 +1,414 @@
+package transport
+
+import "testing"
+import "net"
+import "net/rpc"
+import "os"
+import "strconv"
+import "fmt"
+import "sync"
+import "time"
+import "context"
+import "errors"
+
+type Echo struct {
+  mu sync.Mutex
+  calls int
+  delay time.Duration // before each reply
+}
+
+type EchoArgs struct {
+  S string
+}
+
+type EchoReply struct {
+  S string
+}
+
+func (e *Echo) Echo(args *EchoArgs, reply *EchoReply) error {
+  e.mu.Lock()
+  e.calls++
+  delay := e.delay
+  e.mu.Unlock()
+  time.Sleep(delay)
+  reply.S = args.S
+  return nil
+}
+
+//
+// serve Echo on l. if deaf, process each request
+// but lose the reply.
+//
+func serve(t *testing.T, l net.Listener, e *Echo, deaf bool) {
+  rpcs := rpc.NewServer()
+  rpcs.Register(e)
+  go func() {
+    for {
+      conn, err := l.Accept()
+      if err != nil {
+        return
+      }
+      if deaf {
+        if err := CloseWrite(conn); err != nil {
+          t.Errorf("CloseWrite: %v", err)
+        }
+      }
+      go rpcs.ServeConn(conn)
+    }
+  }()
+}
+
+func (e *Echo) count() int {
+  e.mu.Lock()
+  defer e.mu.Unlock()
+  return e.calls
+}
+
+func echo(tr Transport, srv string, s string) bool {
+  args := &EchoArgs{s}
+  var reply EchoReply
+  return Call(tr, srv, "Echo.Echo", args, &reply) && reply.S == s
+}
+
+func check(t *testing.T, tr Transport, addr string) {
+  l, err := tr.Listen(addr)
+  if err != nil {
+    t.Fatalf("Listen(%v): %v", addr, err)
+  }
+  addr = l.Addr().String() // the port, for TCP
+  e := &Echo{}
+  serve(t, l, e, false)
+  for i := 0; i < 5; i++ {
+    if !echo(tr, addr, strconv.Itoa(i)) {
+      t.Fatalf("Call() to %v failed", addr)
+    }
+  }
+  l.Close()
+  if echo(tr, addr, "x") {
+    t.Fatalf("Call() succeeded after Close()")
+  }
+  if e.count() != 5 {
+    t.Fatalf("server saw %v calls, expected 5", e.count())
+  }
+}
+
+func TestUnix(t *testing.T) {
+  fmt.Printf("Test: Unix transport ...\n")
+  addr := "/var/tmp/824-" + strconv.Itoa(os.Getuid()) + "-tr-" +
+    strconv.Itoa(os.Getpid())
+  defer os.Remove(addr)
+  check(t, Unix, addr)
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestTCP(t *testing.T) {
+  fmt.Printf("Test: TCP transport ...\n")
+  check(t, TCP, "127.0.0.1:0")
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestMem(t *testing.T) {
+  fmt.Printf("Test: in-memory transport ...\n")
+
+  m := NewMem()
+  check(t, m, "a")
+
+  if echo(m, "nowhere", "x") {
+    t.Fatalf("Call() to an unknown address succeeded")
+  }
+
+  // Remove() makes the address unreachable,
+  // and a new Listen() takes it over.
+  l1, _ := m.Listen("b")
+  serve(t, l1, &Echo{}, false)
+  m.Remove("b")
+  if echo(m, "b", "x") {
+    t.Fatalf("Call() succeeded after Remove()")
+  }
+  e2 := &Echo{}
+  l2, _ := m.Listen("b")
+  serve(t, l2, e2, false)
+  if !echo(m, "b", "x") || e2.count() != 1 {
+    t.Fatalf("Listen() did not take over a removed address")
+  }
+  l1.Close()
+  l2.Close()
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: CloseWrite() loses the reply ...\n")
+
+  e := &Echo{}
+  l, _ := m.Listen("deaf")
+  serve(t, l, e, true)
+  if echo(m, "deaf", "x") {
+    t.Fatalf("Call() got a reply through CloseWrite()")
+  }
+  // the client may hear EOF before the handler runs.
+  for iters := 0; iters < 50 && e.count() == 0; iters++ {
+    time.Sleep(10 * time.Millisecond)
+  }
+  if e.count() != 1 {
+    t.Fatalf("server saw %v calls, expected 1", e.count())
+  }
+  l.Close()
+
+  fmt.Printf("  ... Passed\n")
+}
+
+//
+// a listener that counts connections and can
+// break the ones it has accepted.
+//
+type tracker struct {
+  net.Listener
+  mu sync.Mutex
+  conns []net.Conn
+}
+
+func (tr *tracker) Accept() (net.Conn, error) {
+  c, err := tr.Listener.Accept()
+  if err == nil {
+    tr.mu.Lock()
+    tr.conns = append(tr.conns, c)
+    tr.mu.Unlock()
+  }
+  return c, err
+}
+
+func (tr *tracker) accepted() int {
+  tr.mu.Lock()
+  defer tr.mu.Unlock()
+  return len(tr.conns)
+}
+
+func (tr *tracker) breakAll() {
+  tr.mu.Lock()
+  defer tr.mu.Unlock()
+  for _, c := range tr.conns {
+    c.Close()
+  }
+}
+
+func TestPool(t *testing.T) {
+  fmt.Printf("Test: Pool reuses one connection ...\n")
+
+  m := NewMem()
+  p := Pooled(m)
+  defer p.Close()
+
+  l, _ := m.Listen("a")
+  tr := &tracker{Listener: l}
+  serve(t, tr, &Echo{}, false)
+
+  if !p.LastAlive("a").IsZero() {
+    t.Fatalf("LastAlive() is set before any RPC")
+  }
+  var wg sync.WaitGroup
+  for i := 0; i < 20; i++ {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      if !echo(p, "a", strconv.Itoa(i)) {
+        t.Errorf("Call() %v failed", i)
+      }
+    }(i)
+  }
+  wg.Wait()
+  if n := tr.accepted(); n != 1 {
+    t.Fatalf("20 RPCs used %v connections, expected 1", n)
+  }
+  alive := p.LastAlive("a")
+  if alive.IsZero() {
+    t.Fatalf("LastAlive() not set after RPCs")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Pool reconnects after a failure ...\n")
+
+  // the server goes away; RPCs fail and
+  // LastAlive() stays put.
+  l.Close()
+  tr.breakAll()
+  time.Sleep(10 * time.Millisecond)
+  if echo(p, "a", "x") {
+    t.Fatalf("Call() succeeded with the server gone")
+  }
+  if !p.LastAlive("a").Equal(alive) {
+    t.Fatalf("LastAlive() moved without a reply")
+  }
+
+  // it comes back; the next RPC redials.
+  l2, _ := m.Listen("a")
+  tr2 := &tracker{Listener: l2}
+  serve(t, tr2, &Echo{}, false)
+  if !echo(p, "a", "y") || !echo(p, "a", "z") {
+    t.Fatalf("Call() failed after the server came back")
+  }
+  if n := tr2.accepted(); n != 1 {
+    t.Fatalf("used %v new connections, expected 1", n)
+  }
+  if !p.LastAlive("a").After(alive) {
+    t.Fatalf("LastAlive() did not advance")
+  }
+
+  // a connection that breaks between RPCs is
+  // replaced without the caller seeing a failure.
+  tr2.breakAll()
+  time.Sleep(10 * time.Millisecond)
+  if !echo(p, "a", "w") {
+    t.Fatalf("Call() failed over a connection broken while idle")
+  }
+  l2.Close()
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Pool redials after an abandoned RPC ...\n")
+
+  // the server wedges: it holds the connection
+  // but never reads a request.
+  l3, _ := m.Listen("b")
+  var mu sync.Mutex
+  var held []net.Conn
+  go func() {
+    for {
+      conn, err := l3.Accept()
+      if err != nil {
+        return
+      }
+      mu.Lock()
+      held = append(held, conn)
+      mu.Unlock()
+    }
+  }()
+  ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+  var reply EchoReply
+  if p.CallContext(ctx, "b", "Echo.Echo", &EchoArgs{"x"}, &reply) {
+    t.Fatalf("CallContext() to a wedged server succeeded")
+  }
+  cancel()
+  l3.Close()
+
+  // it restarts; the next RPC must not wait on
+  // the wedged connection.
+  l4, _ := m.Listen("b")
+  tr4 := &tracker{Listener: l4}
+  serve(t, tr4, &Echo{}, false)
+  ctx, cancel = context.WithTimeout(context.Background(), 2 * time.Second)
+  reply = EchoReply{}
+  if !p.CallContext(ctx, "b", "Echo.Echo", &EchoArgs{"y"}, &reply) || reply.S != "y" {
+    t.Fatalf("CallContext() failed after the server restarted")
+  }
+  cancel()
+  if n := tr4.accepted(); n != 1 {
+    t.Fatalf("used %v new connections, expected 1", n)
+  }
+  l4.Close()
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: an abandoned RPC doesn't fail the others ...\n")
+
+  l5, _ := m.Listen("c")
+  tr5 := &tracker{Listener: l5}
+  serve(t, tr5, &Echo{delay: 300 * time.Millisecond}, false)
+  for i := 0; i < 3; i++ {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      if !echo(p, "c", strconv.Itoa(i)) {
+        t.Errorf("Call() %v failed after another RPC was abandoned", i)
+      }
+    }(i)
+  }
+  time.Sleep(50 * time.Millisecond)
+  ctx, cancel = context.WithTimeout(context.Background(), 100 * time.Millisecond)
+  if p.CallContext(ctx, "c", "Echo.Echo", &EchoArgs{"x"}, &EchoReply{}) {
+    t.Fatalf("CallContext() beat its deadline")
+  }
+  cancel()
+  wg.Wait()
+  if n := tr5.accepted(); n != 1 {
+    t.Fatalf("used %v connections, expected 1", n)
+  }
+  l5.Close()
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestContext(t *testing.T) {
+  m := NewMem()
+
+  // a server that accepts connections but never
+  // reads a request or sends a reply.
+  l, _ := m.Listen("silent")
+  var mu sync.Mutex
+  var held []net.Conn
+  go func() {
+    for {
+      conn, err := l.Accept()
+      if err != nil {
+        return
+      }
+      mu.Lock()
+      held = append(held, conn)
+      mu.Unlock()
+    }
+  }()
+  defer l.Close()
+
+  fmt.Printf("Test: CallContext() gives up on a silent server ...\n")
+
+  for _, tr := range []Transport{m, Pooled(m)} {
+    ctx, cancel := context.WithTimeout(context.Background(), 200 * time.Millisecond)
+    t0 := time.Now()
+    var reply EchoReply
+    if CallContext(ctx, tr, "silent", "Echo.Echo", &EchoArgs{"x"}, &reply) {
+      t.Fatalf("CallContext() to a silent server succeeded")
+    }
+    if d := time.Since(t0); d > 2 * time.Second {
+      t.Fatalf("CallContext() took %v to give up", d)
+    }
+    err := Abandoned("test.Echo", ctx)
+    if e, ok := err.(*Error); !ok || !e.Timeout() {
+      t.Fatalf("Abandoned() = %v; want a timeout", err)
+    }
+    cancel()
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: cancellation ...\n")
+
+  ctx, cancel := context.WithCancel(context.Background())
+  go func() {
+    time.Sleep(100 * time.Millisecond)
+    cancel()
+  }()
+  var reply EchoReply
+  if CallContext(ctx, m, "silent", "Echo.Echo", &EchoArgs{"x"}, &reply) {
+    t.Fatalf("CallContext() succeeded after cancel")
+  }
+  err := Abandoned("test.Echo", ctx)
+  if !errors.Is(err, context.Canceled) || err.(*Error).Timeout() {
+    t.Fatalf("Abandoned() = %v; want cancelled", err)
+  }
+  if Sleep(ctx, 10 * time.Second) {
+    t.Fatalf("Sleep() didn't notice cancel")
+  }
+
+  // a done ctx sends nothing, even to a live server.
+  l2, _ := m.Listen("echo")
+  defer l2.Close()
+  e := &Echo{}
+  serve(t, l2, e, false)
+  if CallContext(ctx, m, "echo", "Echo.Echo", &EchoArgs{"x"}, &reply) {
+    t.Fatalf("CallContext() with a done ctx succeeded")
+  }
+  if !echo(m, "echo", "y") || e.count() != 1 {
+    t.Fatalf("wrong Echo count %v", e.count())
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
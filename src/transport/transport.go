@@ -0,0 +1,90 @@
+package transport
+
+//
+// how the services reach each other.
+//
+// every service listens and dials through a Transport, so the
+// same code can run over Unix-domain sockets on one machine
+// (the default, and what the tests use), over TCP across real
+// hosts, or over an in-memory network inside one process.
+// addresses are whatever the Transport understands: a socket
+// path for Unix, host:port for TCP, any string for Mem.
+//
+// Call() replaces the call() function each package used to
+// carry its own copy of. a Transport that also has a Call()
+// method, such as a Pool (see pool.go), sends RPCs its own
+// way. CallContext() (see context.go) is Call() with a
+// deadline.
+//
+
+import "net"
+import "context"
+import "os"
+import "errors"
+
+type Transport interface {
+  Listen(addr string) (net.Listener, error)
+  Dial(addr string) (net.Conn, error)
+}
+
+//
+// a Transport that sends RPCs itself, rather than
+// over a new connection per RPC.
+//
+type Caller interface {
+  Call(srv string, rpcname string, args interface{}, reply interface{}) bool
+}
+
+var Unix Transport = unixTransport{}
+var TCP Transport = tcpTransport{}
+
+type unixTransport struct{}
+
+func (unixTransport) Listen(addr string) (net.Listener, error) {
+  os.Remove(addr) // a stale socket from an earlier run
+  return net.Listen("unix", addr)
+}
+
+func (unixTransport) Dial(addr string) (net.Conn, error) {
+  return net.Dial("unix", addr)
+}
+
+type tcpTransport struct{}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+  return net.Listen("tcp", addr)
+}
+
+func (tcpTransport) Dial(addr string) (net.Conn, error) {
+  return net.Dial("tcp", addr)
+}
+
+//
+// Call() sends an RPC to the rpcname handler on server srv
+// with arguments args, waits for the reply, and leaves the
+// reply in reply. the reply argument should be the address
+// of a reply structure.
+//
+// Call() returns true if the server responded, and false
+// if Call() was not able to contact the server. in particular,
+// reply's contents are valid if and only if Call() returned true.
+//
+// Call() waits as long as the server takes to reply; use
+// CallContext() to bound the wait.
+//
+func Call(t Transport, srv string, rpcname string,
+          args interface{}, reply interface{}) bool {
+  return CallContext(context.Background(), t, srv, rpcname, args, reply)
+}
+
+//
+// shut down the sending side of conn, so that a server can
+// process a request but its reply is lost. the servers'
+// "unreliable" test mode uses this.
+//
+func CloseWrite(conn net.Conn) error {
+  if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+    return cw.CloseWrite()
+  }
+  return errors.New("transport: connection can't be half-closed")
+}
@@ -1,59 +1,43 @@
 package viewservice
 
-import "net/rpc"
-import "fmt"
+import "context"
+import "transport"
 
 //
 // the viewservice Clerk lives in the client
 // and maintains a little state.
 //
 type Clerk struct {
-	me     string // client's name (host:port)
-	server string // viewservice's host:port
+	me        string // client's name (host:port)
+	server    string // viewservice's host:port
+	transport transport.Transport
 }
 
 func MakeClerk(me string, server string) *Clerk {
+	return MakeClerkOn(transport.Unix, me, server)
+}
+
+//
+// like MakeClerk(), but talk to the viewservice through t.
+//
+func MakeClerkOn(t transport.Transport, me string, server string) *Clerk {
 	ck := new(Clerk)
 	ck.me = me
 	ck.server = server
+	ck.transport = t
 	return ck
 }
 
-//
-// call() sends an RPC to the rpcname handler on server srv
-// with arguments args, waits for the reply, and leaves the
-// reply in reply. the reply argument should be a pointer
-// to a reply structure.
-//
-// the return value is true if the server responded, and false
-// if call() was not able to contact the server. in particular,
-// the reply's contents are only valid if call() returned true.
-//
-// you should assume that call() will time out and return an
-// error after a while if it doesn't get a reply from the server.
-//
-// please use call() to send all RPCs, in client.go and server.go.
-// please don't change this function.
-//
-func call(srv string, rpcname string,
-	args interface{}, reply interface{}) bool {
-	c, errx := rpc.Dial("unix", srv)
-	if errx != nil {
-		//fmt.Println("### "+srv+"  "+rpcname+"   Connect fail.  ", errx)
-		return false
-	}
-	defer c.Close()
 
-	err := c.Call(rpcname, args, reply)
-	if err == nil {
-		return true
-	}
-
-	fmt.Println(err)
-	return false
+func (ck *Clerk) Ping(viewnum uint) (View, error) {
+	return ck.PingContext(context.Background(), viewnum)
 }
 
-func (ck *Clerk) Ping(viewnum uint) (View, error) {
+//
+// like Ping(), but give up once ctx is done. fails with
+// a *transport.Error, wrapping ctx.Err() or ErrNoReply.
+//
+func (ck *Clerk) PingContext(ctx context.Context, viewnum uint) (View, error) {
 	// prepare the arguments.
 	args := &PingArgs{}
 	args.Me = ck.me
@@ -61,22 +45,37 @@ func (ck *Clerk) Ping(viewnum uint) (View, error) {
 	var reply PingReply
 
 	// send an RPC request, wait for the reply.
-	ok := call(ck.server, "ViewServer.Ping", args, &reply)
+	ok := transport.CallContext(ctx, ck.transport, ck.server, "ViewServer.Ping", args, &reply)
 	if ok == false {
-		return View{}, fmt.Errorf("Ping(%v) failed", viewnum)
+		if ctx.Err() != nil {
+			return View{}, transport.Abandoned("viewservice.Ping", ctx)
+		}
+		return View{}, &transport.Error{Op: "viewservice.Ping", Err: transport.ErrNoReply}
 	}
 
 	return reply.View, nil
 }
 
 func (ck *Clerk) Get() (View, bool) {
+	v, err := ck.GetContext(context.Background())
+	return v, err == nil
+}
+
+//
+// like Get(), but give up once ctx is done. fails with
+// a *transport.Error, wrapping ctx.Err() or ErrNoReply.
+//
+func (ck *Clerk) GetContext(ctx context.Context) (View, error) {
 	args := &GetArgs{}
 	var reply GetReply
-	ok := call(ck.server, "ViewServer.Get", args, &reply)
+	ok := transport.CallContext(ctx, ck.transport, ck.server, "ViewServer.Get", args, &reply)
 	if ok == false {
-		return View{}, false
+		if ctx.Err() != nil {
+			return View{}, transport.Abandoned("viewservice.Get", ctx)
+		}
+		return View{}, &transport.Error{Op: "viewservice.Get", Err: transport.ErrNoReply}
 	}
-	return reply.View, true
+	return reply.View, nil
 }
 
 func (ck *Clerk) Primary() string {
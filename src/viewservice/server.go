@@ -6,9 +6,9 @@ import (
 	"log"
 	"net"
 	"net/rpc"
-	"os"
 	"sync"
 	"time"
+	"transport"
 )
 
 type ServerStat struct {
@@ -191,6 +191,13 @@ func (vs *ViewServer) Kill() {
 }
 
 func StartServer(me string) *ViewServer {
+	return StartServerOn(transport.Unix, me)
+}
+
+//
+// like StartServer(), but listen through t.
+//
+func StartServerOn(t transport.Transport, me string) *ViewServer {
 	vs := new(ViewServer)
 	vs.me = me
 	vs.state = make(map[string]*ServerStat)
@@ -203,9 +210,7 @@ func StartServer(me string) *ViewServer {
 	rpcs.Register(vs)
 
 	// prepare to receive connections from clients.
-	// change "unix" to "tcp" to use over a network.
-	os.Remove(vs.me) // only needed for "unix"
-	l, e := net.Listen("unix", vs.me)
+	l, e := t.Listen(vs.me)
 	if e != nil {
 		log.Fatal("listen error: ", e)
 	}
@@ -6,6 +6,9 @@ import "time"
 import "fmt"
 import "os"
 import "strconv"
+import "context"
+import "errors"
+import "transport"
 
 func check(t *testing.T, ck *Clerk, p string, b string, n uint) {
 	view, _ := ck.Get()
@@ -228,3 +231,23 @@ func Test1(t *testing.T) {
 
 	vs.Kill()
 }
+
+func TestNoReply(t *testing.T) {
+	fmt.Printf("Test: Ping() and Get() without a viewserver fail with ErrNoReply ...\n")
+
+	ck := MakeClerk(port("noreply-c"), port("noreply-v"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := ck.PingContext(ctx, 0); !isNoReply(err) {
+		t.Fatalf("PingContext() returned %v; expected ErrNoReply", err)
+	}
+	if _, err := ck.GetContext(ctx); !isNoReply(err) {
+		t.Fatalf("GetContext() returned %v; expected ErrNoReply", err)
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+func isNoReply(err error) bool {
+	e, ok := err.(*transport.Error)
+	return ok && errors.Is(e, transport.ErrNoReply) && !e.Timeout()
+}